@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 
 	"github.com/nwright-nz/openfaas-cf-backend/metrics"
 	"github.com/nwright-nz/openfaas-cf-backend/requests"
@@ -19,8 +20,14 @@ func MakeAsyncReport(metrics metrics.MetricOptions) http.HandlerFunc {
 
 		report := requests.AsyncReport{}
 		bytesOut, _ := ioutil.ReadAll(r.Body)
-		json.Unmarshal(bytesOut, &report)
+		if err := json.Unmarshal(bytesOut, &report); err != nil || !validFunctionName.MatchString(report.FunctionName) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Invalid async report."))
+			return
+		}
 
-		//trackInvocation(report.FunctionName, metrics, report.StatusCode)
+		metrics.GatewayAsyncInvocation.WithLabelValues(report.FunctionName, strconv.Itoa(report.StatusCode)).Inc()
+		metrics.GatewayAsyncHistogram.WithLabelValues(report.FunctionName).Observe(report.TimeTaken)
+		w.WriteHeader(http.StatusOK)
 	}
 }
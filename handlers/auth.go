@@ -0,0 +1,485 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	cfclient "github.com/nwright-nz/go-cfclient"
+	"github.com/nwright-nz/openfaas-cf-backend/metrics"
+	"github.com/nwright-nz/openfaas-cf-backend/requests"
+)
+
+// Labels which set who may call a function.
+const (
+	// AuthLabel is public (default), apikey, jwt or apikey,jwt to accept either.
+	AuthLabel = "com.openfaas.auth"
+	// AuthIssuerLabel and AuthAudienceLabel override the gateway's JWT issuer and audience.
+	AuthIssuerLabel   = "com.openfaas.auth.jwt.issuer"
+	AuthAudienceLabel = "com.openfaas.auth.jwt.audience"
+	// AuthClaimsLabel lists the JWT claims passed to the function as X-Jwt-Claim-<name> headers, sub by default.
+	AuthClaimsLabel = "com.openfaas.auth.jwt.claims"
+)
+
+const (
+	jwtClaimHeaderPrefix = "X-Jwt-Claim-"
+	apiKeyNameHeader     = "X-Api-Key-Name"
+	// apiKeyIDHeader identifies the checked key, names aren't unique.
+	apiKeyIDHeader = "X-Api-Key-Id"
+	// apiKeyAnnotationPrefix prefixes the annotations on the gateway app which hold API keys.
+	apiKeyAnnotationPrefix = "apikeys.openfaas.com/"
+)
+
+// APIKeyRecord is an API key as stored, with a SHA-256 hash in place of the key.
+type APIKeyRecord struct {
+	requests.APIKey
+	Hash string `json:"hash"`
+}
+
+// APIKeyStore keeps API keys.
+type APIKeyStore interface {
+	List() ([]APIKeyRecord, error)
+	Save(record APIKeyRecord) error
+	Delete(id string) error
+}
+
+// MemoryAPIKeyStore keeps API keys in the gateway's memory.
+type MemoryAPIKeyStore struct {
+	mu   sync.Mutex
+	keys map[string]APIKeyRecord
+}
+
+// NewMemoryAPIKeyStore creates an empty MemoryAPIKeyStore.
+func NewMemoryAPIKeyStore() *MemoryAPIKeyStore {
+	return &MemoryAPIKeyStore{keys: make(map[string]APIKeyRecord)}
+}
+
+// List implements APIKeyStore.
+func (s *MemoryAPIKeyStore) List() ([]APIKeyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records := []APIKeyRecord{}
+	for _, record := range s.keys {
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// Save implements APIKeyStore.
+func (s *MemoryAPIKeyStore) Save(record APIKeyRecord) error {
+	s.mu.Lock()
+	s.keys[record.ID] = record
+	s.mu.Unlock()
+	return nil
+}
+
+// Delete implements APIKeyStore.
+func (s *MemoryAPIKeyStore) Delete(id string) error {
+	s.mu.Lock()
+	delete(s.keys, id)
+	s.mu.Unlock()
+	return nil
+}
+
+// AppAPIKeyStore keeps API keys as annotations on the gateway's own app.
+type AppAPIKeyStore struct {
+	client  *cfclient.Client
+	appGUID string
+}
+
+// NewAppAPIKeyStore creates a store on the app with appGUID.
+func NewAppAPIKeyStore(client *cfclient.Client, appGUID string) *AppAPIKeyStore {
+	return &AppAPIKeyStore{client: client, appGUID: appGUID}
+}
+
+// List implements APIKeyStore.
+func (s *AppAPIKeyStore) List() ([]APIKeyRecord, error) {
+	annotations, err := appAnnotations(s.client, s.appGUID)
+	if err != nil {
+		return nil, err
+	}
+
+	records := []APIKeyRecord{}
+	for key, value := range annotations {
+		if !strings.HasPrefix(key, apiKeyAnnotationPrefix) {
+			continue
+		}
+		record := APIKeyRecord{}
+		if err := json.Unmarshal([]byte(value), &record); err != nil {
+			log.Printf("Ignoring unreadable API key %s: %s", key, err)
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// Save implements APIKeyStore.
+func (s *AppAPIKeyStore) Save(record APIKeyRecord) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	encoded := string(value)
+	return annotateApp(s.client, s.appGUID, map[string]*string{apiKeyAnnotationPrefix + record.ID: &encoded})
+}
+
+// Delete implements APIKeyStore.
+func (s *AppAPIKeyStore) Delete(id string) error {
+	return annotateApp(s.client, s.appGUID, map[string]*string{apiKeyAnnotationPrefix + id: nil})
+}
+
+// APIKeys creates and checks API keys, caching the keys in a store.
+type APIKeys struct {
+	store   APIKeyStore
+	refresh time.Duration
+
+	mu      sync.Mutex
+	records map[string]APIKeyRecord
+	fetched time.Time
+}
+
+// NewAPIKeys re-reads the store when its keys are older than refresh.
+func NewAPIKeys(store APIKeyStore, refresh time.Duration) *APIKeys {
+	return &APIKeys{store: store, refresh: refresh}
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (k *APIKeys) cached() (map[string]APIKeyRecord, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.records != nil && time.Since(k.fetched) < k.refresh {
+		return k.records, nil
+	}
+
+	list, err := k.store.List()
+	if err != nil {
+		return nil, err
+	}
+	records := make(map[string]APIKeyRecord)
+	for _, record := range list {
+		records[record.ID] = record
+	}
+	k.records = records
+	k.fetched = time.Now()
+	return records, nil
+}
+
+func (k *APIKeys) forget() {
+	k.mu.Lock()
+	k.records = nil
+	k.mu.Unlock()
+}
+
+// Create makes a new key, the returned APIKey is the only place the key itself appears.
+func (k *APIKeys) Create(name string, functions []string) (requests.APIKey, error) {
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return requests.APIKey{}, err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return requests.APIKey{}, err
+	}
+
+	apiKey := requests.APIKey{
+		ID:        hex.EncodeToString(id),
+		Name:      name,
+		Functions: functions,
+		Created:   time.Now().UTC().Format(time.RFC3339),
+	}
+	apiKey.Key = apiKey.ID + "." + base64.RawURLEncoding.EncodeToString(secret)
+
+	record := APIKeyRecord{APIKey: apiKey, Hash: hashAPIKey(apiKey.Key)}
+	record.Key = ""
+	if err := k.store.Save(record); err != nil {
+		return requests.APIKey{}, err
+	}
+	k.forget()
+	return apiKey, nil
+}
+
+// List returns the keys without their hashes.
+func (k *APIKeys) List() ([]requests.APIKey, error) {
+	records, err := k.cached()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []requests.APIKey{}
+	for _, record := range records {
+		keys = append(keys, record.APIKey)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Created < keys[j].Created })
+	return keys, nil
+}
+
+// Delete revokes a key.
+func (k *APIKeys) Delete(id string) error {
+	if err := k.store.Delete(id); err != nil {
+		return err
+	}
+	k.forget()
+	return nil
+}
+
+// Check finds the key and reports whether it may call function.
+func (k *APIKeys) Check(key string, function string) (requests.APIKey, bool, error) {
+	id := strings.SplitN(key, ".", 2)[0]
+
+	records, err := k.cached()
+	if err != nil {
+		return requests.APIKey{}, false, err
+	}
+	record, ok := records[id]
+	if !ok || subtle.ConstantTimeCompare([]byte(record.Hash), []byte(hashAPIKey(key))) != 1 {
+		return requests.APIKey{}, false, nil
+	}
+
+	if len(record.Functions) == 0 {
+		return record.APIKey, true, nil
+	}
+	for _, allowed := range record.Functions {
+		if allowed == function {
+			return record.APIKey, true, nil
+		}
+	}
+	return record.APIKey, false, nil
+}
+
+// Authenticator enforces the auth policy in each function's labels. Functions are public unless
+// they set com.openfaas.auth.
+type Authenticator struct {
+	lookup   FunctionLabelLookup
+	keys     *APIKeys
+	verifier *JWTVerifier
+	metrics  metrics.MetricOptions
+}
+
+// NewAuthenticator creates an Authenticator, verifier may be nil when JWTs aren't configured.
+func NewAuthenticator(lookup FunctionLabelLookup, keys *APIKeys, verifier *JWTVerifier, metricsOptions metrics.MetricOptions) *Authenticator {
+	return &Authenticator{lookup: lookup, keys: keys, verifier: verifier, metrics: metricsOptions}
+}
+
+// stripAuthHeaders removes the headers the gateway sets after checking a caller so they can't be forged.
+func stripAuthHeaders(header http.Header) {
+	for name := range header {
+		if strings.HasPrefix(name, jwtClaimHeaderPrefix) {
+			header.Del(name)
+		}
+	}
+	header.Del(apiKeyNameHeader)
+	header.Del(apiKeyIDHeader)
+}
+
+// Authorise checks the caller may call the function, otherwise it writes a 401 and returns false.
+func (a *Authenticator) Authorise(w http.ResponseWriter, r *http.Request, name string) bool {
+	// Calls from the queue worker were checked when they were queued and keep the headers set then.
+	if isQueuedCall(r) {
+		return true
+	}
+	stripAuthHeaders(r.Header)
+
+	labels, err := a.lookup(name)
+	if err != nil {
+		log.Printf("Unable to read auth policy of %s: %s", name, err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(fmt.Sprintf("Unable to read auth policy of function: %s.", name)))
+		return false
+	}
+
+	var allowAPIKey, allowJWT bool
+	for _, p := range strings.Split(strings.ToLower(labels[AuthLabel]), ",") {
+		switch strings.TrimSpace(p) {
+		case "apikey":
+			allowAPIKey = true
+		case "jwt":
+			allowJWT = true
+		}
+	}
+	if !allowAPIKey && !allowJWT {
+		return true
+	}
+
+	var reason string
+	if apiKey := r.Header.Get(apiKeyHeader); allowAPIKey && len(apiKey) > 0 {
+		key, ok, err := a.keys.Check(apiKey, name)
+		if err != nil {
+			log.Printf("Unable to read API keys: %s", err)
+		}
+		if ok {
+			r.Header.Set(apiKeyNameHeader, key.Name)
+			r.Header.Set(apiKeyIDHeader, key.ID)
+			return true
+		}
+		reason = "invalid API key"
+	}
+
+	if bearer := r.Header.Get("Authorization"); allowJWT && strings.HasPrefix(bearer, "Bearer ") {
+		if a.verifier == nil {
+			reason = "JWT auth isn't configured on the gateway"
+		} else {
+			claims, err := a.verifier.Verify(strings.TrimPrefix(bearer, "Bearer "), labels[AuthIssuerLabel], labels[AuthAudienceLabel])
+			if err == nil {
+				forwardClaims(r.Header, claims, labels[AuthClaimsLabel])
+				return true
+			}
+			reason = err.Error()
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="invalid_token", error_description=%q`, reason))
+		}
+	}
+
+	if len(reason) == 0 {
+		reason = "credentials required"
+	}
+	if allowJWT && len(w.Header().Get("WWW-Authenticate")) == 0 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="openfaas"`)
+	}
+
+	a.metrics.GatewayUnauthorized.WithLabelValues(name).Inc()
+	log.Printf("[%s] Unauthorised call to %s: %s", r.Header.Get(CallIDHeader), name, reason)
+	w.WriteHeader(http.StatusUnauthorized)
+	w.Write([]byte(fmt.Sprintf("Unauthorised call to function %s: %s.", name, reason)))
+	return false
+}
+
+// MakeAuthHandler only calls next when the caller may call the function named in the route or
+// X-Function header.
+func MakeAuthHandler(next http.HandlerFunc, authenticator *Authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+		if len(name) == 0 {
+			name = r.Header.Get("X-Function")
+		}
+		if len(name) == 0 {
+			stripAuthHeaders(r.Header)
+			next(w, r)
+			return
+		}
+
+		if authenticator.Authorise(w, r, name) {
+			next(w, r)
+		}
+	}
+}
+
+// forwardClaims passes the listed claims to the function, strings as they are and other values as JSON.
+func forwardClaims(header http.Header, claims JWTClaims, names string) {
+	if len(names) == 0 {
+		names = "sub"
+	}
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		value, ok := claims[name]
+		if !ok {
+			continue
+		}
+		if s, isString := value.(string); isString {
+			header.Set(jwtClaimHeaderPrefix+name, s)
+		} else {
+			encoded, _ := json.Marshal(value)
+			header.Set(jwtClaimHeaderPrefix+name, string(encoded))
+		}
+	}
+}
+
+// callerIdentity names who made a call: the checked API key, or the JWT subject when the function
+// receives it, otherwise the client's address.
+func callerIdentity(r *http.Request) string {
+	if keyID := r.Header.Get(apiKeyIDHeader); len(keyID) > 0 {
+		return "apikey:" + keyID
+	}
+	if subject := r.Header.Get(jwtClaimHeaderPrefix + "sub"); len(subject) > 0 {
+		return "jwt:" + subject
+	}
+	return "ip:" + clientIP(r)
+}
+
+// MakeAdminAuthHandler only lets callers with the admin token through, sent either as a bearer
+// token or as the password of basic auth.
+func MakeAdminAuthHandler(next http.HandlerFunc, token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		presented := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if _, password, ok := r.BasicAuth(); ok {
+			presented = password
+		}
+		if len(token) == 0 || subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="OpenFaaS admin"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("Unauthorized."))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// MakeAPIKeysHandler lists (GET /system/keys), creates (POST /system/keys) or revokes
+// (DELETE /system/keys/{id}) API keys.
+func MakeAPIKeysHandler(keys *APIKeys) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		switch r.Method {
+		case http.MethodGet:
+			list, err := keys.List()
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(err.Error()))
+				return
+			}
+			keyBytes, _ := json.Marshal(list)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			w.Write(keyBytes)
+
+		case http.MethodDelete:
+			if err := keys.Delete(mux.Vars(r)["id"]); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(err.Error()))
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+
+		default:
+			request := requests.APIKey{}
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(err.Error()))
+				return
+			}
+			if len(request.Name) == 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("Provide a name for the key."))
+				return
+			}
+
+			created, err := keys.Create(request.Name, request.Functions)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(err.Error()))
+				return
+			}
+			keyBytes, _ := json.Marshal(created)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			w.Write(keyBytes)
+		}
+	}
+}
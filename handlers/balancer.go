@@ -0,0 +1,190 @@
+package handlers
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	cfclient "github.com/nwright-nz/go-cfclient"
+)
+
+const (
+	// RoundRobin cycles through the healthy instances of a function.
+	RoundRobin = "round_robin"
+	// LeastInflight picks the healthy instance with the fewest calls in progress.
+	LeastInflight = "least_inflight"
+)
+
+// InstanceDiscovery lists the addresses (host:port) of the running instances of an app.
+type InstanceDiscovery func(app cfclient.App) ([]string, error)
+
+// NewStatsDiscovery finds instances through the Cloud Controller stats endpoint.
+func NewStatsDiscovery(c *cfclient.Client) InstanceDiscovery {
+	return func(app cfclient.App) ([]string, error) {
+		stats, err := c.GetAppStats(app.Guid)
+		if err != nil {
+			return nil, err
+		}
+
+		var addresses []string
+		for _, instance := range stats {
+			if instance.State == "RUNNING" && len(instance.Stats.Host) > 0 && instance.Stats.Port > 0 {
+				addresses = append(addresses, net.JoinHostPort(instance.Stats.Host, strconv.Itoa(instance.Stats.Port)))
+			}
+		}
+		sort.Strings(addresses)
+		return addresses, nil
+	}
+}
+
+// NewInternalDomainDiscovery finds instances through container-to-container DNS
+// i.e. <app>.apps.internal, which resolves to one address per instance.
+func NewInternalDomainDiscovery(domain string, port int) InstanceDiscovery {
+	return func(app cfclient.App) ([]string, error) {
+		ips, err := net.LookupHost(fmt.Sprintf("%s.%s", app.Name, domain))
+		if err != nil {
+			return nil, err
+		}
+
+		var addresses []string
+		for _, ip := range ips {
+			addresses = append(addresses, net.JoinHostPort(ip, strconv.Itoa(port)))
+		}
+		sort.Strings(addresses)
+		return addresses, nil
+	}
+}
+
+// Endpoint is a single app instance which calls can be routed to.
+type Endpoint struct {
+	Address string
+
+	inflight     int
+	ejectedUntil time.Time
+}
+
+type instancePool struct {
+	endpoints []*Endpoint
+	next      int
+	fetched   time.Time
+}
+
+// InstanceBalancer spreads calls over the instances of each function and
+// ejects instances which can't be reached for a period of time.
+type InstanceBalancer struct {
+	discover InstanceDiscovery
+	strategy string
+	ejectFor time.Duration
+	refresh  time.Duration
+
+	mu    sync.Mutex
+	pools map[string]*instancePool
+}
+
+// NewInstanceBalancer create a balancer using the given strategy, RoundRobin or LeastInflight.
+func NewInstanceBalancer(discover InstanceDiscovery, strategy string, ejectFor time.Duration, refresh time.Duration) *InstanceBalancer {
+	return &InstanceBalancer{
+		discover: discover,
+		strategy: strategy,
+		ejectFor: ejectFor,
+		refresh:  refresh,
+		pools:    make(map[string]*instancePool),
+	}
+}
+
+// Acquire picks an instance of the app, the caller must Release it when the call completes.
+func (b *InstanceBalancer) Acquire(app cfclient.App) (*Endpoint, error) {
+	b.mu.Lock()
+	pool, ok := b.pools[app.Name]
+	stale := !ok || time.Since(pool.fetched) > b.refresh
+	b.mu.Unlock()
+
+	if stale {
+		addresses, err := b.discover(app)
+		if err != nil {
+			return nil, err
+		}
+		b.mu.Lock()
+		pool = b.update(app.Name, addresses)
+		b.mu.Unlock()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(pool.endpoints) == 0 {
+		return nil, fmt.Errorf("no running instances of %s", app.Name)
+	}
+
+	now := time.Now()
+	var healthy []*Endpoint
+	for _, endpoint := range pool.endpoints {
+		if now.After(endpoint.ejectedUntil) {
+			healthy = append(healthy, endpoint)
+		}
+	}
+
+	// With every instance ejected it's better to try one than to fail the call outright.
+	if len(healthy) == 0 {
+		healthy = pool.endpoints
+	}
+
+	offset := pool.next % len(healthy)
+	pool.next++
+
+	selected := healthy[offset]
+	if b.strategy == LeastInflight {
+		for i := range healthy {
+			candidate := healthy[(offset+i)%len(healthy)]
+			if candidate.inflight < selected.inflight {
+				selected = candidate
+			}
+		}
+	}
+
+	selected.inflight++
+	return selected, nil
+}
+
+// Release returns an instance picked by Acquire, a failed call ejects the instance.
+func (b *InstanceBalancer) Release(endpoint *Endpoint, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if endpoint.inflight > 0 {
+		endpoint.inflight--
+	}
+	if failed {
+		endpoint.ejectedUntil = time.Now().Add(b.ejectFor)
+	}
+}
+
+// update replaces the known instances of a function, keeping state for instances which remain.
+func (b *InstanceBalancer) update(name string, addresses []string) *instancePool {
+	pool, ok := b.pools[name]
+	if !ok {
+		pool = &instancePool{}
+		b.pools[name] = pool
+	}
+
+	existing := make(map[string]*Endpoint)
+	for _, endpoint := range pool.endpoints {
+		existing[endpoint.Address] = endpoint
+	}
+
+	endpoints := make([]*Endpoint, 0, len(addresses))
+	for _, address := range addresses {
+		if endpoint, ok := existing[address]; ok {
+			endpoints = append(endpoints, endpoint)
+		} else {
+			endpoints = append(endpoints, &Endpoint{Address: address})
+		}
+	}
+
+	pool.endpoints = endpoints
+	pool.fetched = time.Now()
+	return pool
+}
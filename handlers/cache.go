@@ -0,0 +1,343 @@
+package handlers
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nwright-nz/openfaas-cf-backend/metrics"
+)
+
+// Labels which enable response caching for a function.
+const (
+	// CacheLabel set to true caches the function's responses.
+	CacheLabel = "com.openfaas.cache"
+	// CacheTTLLabel is how long to keep responses which have no Cache-Control or Expires, default 60s.
+	CacheTTLLabel = "com.openfaas.cache.ttl"
+	// CacheVaryLabel lists request headers which are part of the cache key i.e. Accept,Authorization
+	CacheVaryLabel = "com.openfaas.cache.vary"
+	// CachePublicLabel set to true shares responses between callers, otherwise each caller has their own.
+	CachePublicLabel = "com.openfaas.cache.public"
+)
+
+// maxCachedBodyBytes is the largest request body hashed for a cache key, calls with a larger
+// or unknown body aren't cached.
+const maxCachedBodyBytes = 1024 * 1024
+
+// maxCachedResponseBytes is the largest response kept, larger responses are only passed through.
+const maxCachedResponseBytes = 4 * 1024 * 1024
+
+type cacheEntry struct {
+	key      string
+	function string
+	status   int
+	header   http.Header
+	body     []byte
+	stored   time.Time
+	expires  time.Time
+}
+
+func (e *cacheEntry) size() int64 {
+	size := int64(len(e.key) + len(e.body))
+	for k, vv := range e.header {
+		for _, v := range vv {
+			size += int64(len(k) + len(v))
+		}
+	}
+	return size
+}
+
+// ResponseCache is an LRU of function responses bounded by their total size.
+type ResponseCache struct {
+	maxBytes int64
+
+	mu      sync.Mutex
+	size    int64
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+// NewResponseCache creates a ResponseCache which holds up to maxBytes of responses.
+func NewResponseCache(maxBytes int64) *ResponseCache {
+	return &ResponseCache{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+func (c *ResponseCache) get(key string) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(element)
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return entry, true
+}
+
+func (c *ResponseCache) put(entry *cacheEntry) {
+	size := entry.size()
+	if size > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[entry.key]; ok {
+		c.remove(element)
+	}
+	c.entries[entry.key] = c.order.PushFront(entry)
+	c.size += size
+
+	for c.size > c.maxBytes {
+		c.remove(c.order.Back())
+	}
+}
+
+// Purge drops the cached responses of a function and returns how many there were.
+func (c *ResponseCache) Purge(function string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	purged := 0
+	for element := c.order.Front(); element != nil; {
+		next := element.Next()
+		if element.Value.(*cacheEntry).function == function {
+			c.remove(element)
+			purged++
+		}
+		element = next
+	}
+	return purged
+}
+
+func (c *ResponseCache) remove(element *list.Element) {
+	entry := c.order.Remove(element).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= entry.size()
+}
+
+// cacheRecorder passes a response through to the client while keeping a copy of it.
+type cacheRecorder struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	overflow bool
+	limit    int64
+}
+
+func (rec *cacheRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *cacheRecorder) Write(data []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	if !rec.overflow {
+		if int64(rec.body.Len()+len(data)) > rec.limit {
+			rec.overflow = true
+			rec.body.Reset()
+		} else {
+			rec.body.Write(data)
+		}
+	}
+	return rec.ResponseWriter.Write(data)
+}
+
+func (rec *cacheRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+func (rec *cacheRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// MakeCacheHandler serves repeated calls to functions with the cache label from cache, other
+// calls go on to next. Keys cover the method, path, query, the headers named by the function,
+// a hash of the body, the version picked by splitter and the caller unless the function's
+// responses are public.
+func MakeCacheHandler(next http.HandlerFunc, lookup FunctionLabelLookup, cache *ResponseCache, splitter *TrafficSplitter, metricsOptions metrics.MetricOptions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+		if len(name) == 0 {
+			name = r.Header.Get("X-Function")
+		}
+		if len(name) == 0 || !cacheableMethod(r.Method) || isUpgrade(r) || r.ContentLength < 0 || r.ContentLength > maxCachedBodyBytes {
+			next(w, r)
+			return
+		}
+
+		labels, err := lookup(name)
+		if err != nil || labels[CacheLabel] != "true" {
+			next(w, r)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Unable to read request body: " + err.Error()))
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		// The version is picked once so that the proxy calls the version the key is for.
+		version := splitter.pick(name, r)
+		r = withVersion(r, name, version)
+
+		var caller string
+		if labels[CachePublicLabel] != "true" {
+			caller = callerIdentity(r)
+		}
+		key := cacheKey(r, versionedName(name, version), caller, labels[CacheVaryLabel], body)
+
+		if !strings.Contains(r.Header.Get("Cache-Control"), "no-cache") {
+			if entry, ok := cache.get(key); ok {
+				metricsOptions.GatewayCacheHits.WithLabelValues(name).Inc()
+
+				header := w.Header()
+				copyHeaders(&header, &entry.header)
+				header.Set("Age", strconv.Itoa(int(time.Since(entry.stored).Seconds())))
+				header.Set("X-Cache", "HIT")
+				w.WriteHeader(entry.status)
+				if r.Method != http.MethodHead {
+					w.Write(entry.body)
+				}
+				return
+			}
+		}
+
+		metricsOptions.GatewayCacheMisses.WithLabelValues(name).Inc()
+		w.Header().Set("X-Cache", "MISS")
+
+		limit := int64(maxCachedResponseBytes)
+		if cache.maxBytes < limit {
+			limit = cache.maxBytes
+		}
+		recorder := &cacheRecorder{ResponseWriter: w, limit: limit}
+		next(recorder, r)
+
+		if recorder.status != http.StatusOK || recorder.overflow || isEventStream(w.Header()) || len(w.Header().Get("Set-Cookie")) > 0 {
+			return
+		}
+
+		ttl, cacheable := responseTTL(w.Header(), labelDuration(labels, CacheTTLLabel, 60*time.Second))
+		if !cacheable || ttl <= 0 {
+			return
+		}
+
+		header := make(http.Header)
+		for k, vv := range w.Header() {
+			if !perCallHeader(k) {
+				header[k] = append([]string(nil), vv...)
+			}
+		}
+
+		now := time.Now()
+		cache.put(&cacheEntry{
+			key:      key,
+			function: name,
+			status:   recorder.status,
+			header:   header,
+			body:     recorder.body.Bytes(),
+			stored:   now,
+			expires:  now.Add(ttl),
+		})
+	}
+}
+
+// perCallHeader reports whether a response header is set by the gateway for each call, so it
+// isn't kept with a cached response.
+func perCallHeader(name string) bool {
+	return name == "X-Cache" || name == CallIDHeader || name == DurationHeader ||
+		strings.HasPrefix(name, "Ratelimit-") || strings.HasPrefix(name, "Access-Control-")
+}
+
+// MakeCachePurgeHandler drops the cached responses of a function.
+func MakeCachePurgeHandler(cache *ResponseCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+		purged := cache.Purge(name)
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(fmt.Sprintf("Purged %d cached responses for function: %s.", purged, name)))
+	}
+}
+
+func cacheableMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodPost
+}
+
+func cacheKey(r *http.Request, name string, caller string, vary string, body []byte) string {
+	var key strings.Builder
+	key.WriteString(r.Method + " " + name + " " + r.URL.EscapedPath() + "?" + r.URL.RawQuery + "\n")
+	key.WriteString("Caller: " + caller + "\n")
+	for _, header := range strings.Split(vary, ",") {
+		if header = strings.TrimSpace(header); len(header) > 0 {
+			key.WriteString(http.CanonicalHeaderKey(header) + ": " + strings.Join(r.Header[http.CanonicalHeaderKey(header)], ",") + "\n")
+		}
+	}
+	sum := sha256.Sum256(body)
+	key.WriteString(hex.EncodeToString(sum[:]))
+	return key.String()
+}
+
+// responseTTL reads how long a response may be cached from Cache-Control or Expires, falling back
+// to fallback. It returns false when the function asked for the response not to be stored.
+func responseTTL(header http.Header, fallback time.Duration) (time.Duration, bool) {
+	var maxAge, sharedMaxAge time.Duration
+	hasMaxAge, hasSharedMaxAge := false, false
+
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "no-store" || directive == "private" || directive == "no-cache":
+			return 0, false
+		case strings.HasPrefix(directive, "s-maxage="):
+			if seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "s-maxage=")); err == nil {
+				sharedMaxAge, hasSharedMaxAge = time.Duration(seconds)*time.Second, true
+			}
+		case strings.HasPrefix(directive, "max-age="):
+			if seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age=")); err == nil {
+				maxAge, hasMaxAge = time.Duration(seconds)*time.Second, true
+			}
+		}
+	}
+
+	if hasSharedMaxAge {
+		return sharedMaxAge, true
+	}
+	if hasMaxAge {
+		return maxAge, true
+	}
+	if expires := header.Get("Expires"); len(expires) > 0 {
+		when, err := http.ParseTime(expires)
+		if err != nil {
+			return 0, false
+		}
+		return time.Until(when), true
+	}
+	return fallback, true
+}
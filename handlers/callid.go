@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// CallIDHeader identifies one invocation across the gateway, queue and function.
+	CallIDHeader = "X-Call-Id"
+	// StartTimeHeader is when the gateway received the call, in Unix nanoseconds.
+	StartTimeHeader = "X-Start-Time"
+	// DurationHeader is how long the gateway took to start the response, in seconds.
+	DurationHeader = "X-Duration-Seconds"
+)
+
+// MakeCallIDHandler gives every call an X-Call-Id, keeping a valid one sent by the client, and
+// stamps its start time. The call ID and duration are returned on the response.
+func MakeCallIDHandler(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		callID := r.Header.Get(CallIDHeader)
+		if !validCallID(callID) {
+			callID = newCallID()
+			r.Header.Set(CallIDHeader, callID)
+		}
+		if len(r.Header.Get(StartTimeHeader)) == 0 {
+			r.Header.Set(StartTimeHeader, strconv.FormatInt(start.UnixNano(), 10))
+		}
+
+		w.Header().Set(CallIDHeader, callID)
+		next(&timedResponseWriter{ResponseWriter: w, start: start}, r)
+	}
+}
+
+// newCallID returns a random (version 4) UUID.
+func newCallID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// validCallID accepts IDs from clients which are short and safe to log.
+func validCallID(callID string) bool {
+	if len(callID) == 0 || len(callID) > 128 {
+		return false
+	}
+	for _, c := range callID {
+		valid := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.' || c == ':'
+		if !valid {
+			return false
+		}
+	}
+	return true
+}
+
+// addForwardedHeaders records the client and the address it called on a request sent upstream.
+// X-Forwarded-For is appended to as the gorouter will already have added the client.
+func addForwardedHeaders(header http.Header, r *http.Request) {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := header.Get("X-Forwarded-For"); len(prior) > 0 {
+			host = prior + ", " + host
+		}
+		header.Set("X-Forwarded-For", host)
+	}
+
+	if len(header.Get("X-Forwarded-Proto")) == 0 {
+		proto := "http"
+		if r.TLS != nil {
+			proto = "https"
+		}
+		header.Set("X-Forwarded-Proto", proto)
+	}
+
+	if len(header.Get("X-Forwarded-Host")) == 0 && len(r.Host) > 0 {
+		header.Set("X-Forwarded-Host", r.Host)
+	}
+}
+
+// timedResponseWriter sets the duration header as the response starts.
+type timedResponseWriter struct {
+	http.ResponseWriter
+	start       time.Time
+	wroteHeader bool
+}
+
+func (tw *timedResponseWriter) WriteHeader(status int) {
+	if !tw.wroteHeader {
+		tw.wroteHeader = true
+		tw.Header().Set(DurationHeader, fmt.Sprintf("%f", time.Since(tw.start).Seconds()))
+	}
+	tw.ResponseWriter.WriteHeader(status)
+}
+
+func (tw *timedResponseWriter) Write(data []byte) (int, error) {
+	if !tw.wroteHeader {
+		tw.WriteHeader(http.StatusOK)
+	}
+	return tw.ResponseWriter.Write(data)
+}
+
+// Unwrap lets http.ResponseController reach the connection for hijacking and deadlines.
+func (tw *timedResponseWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+func (tw *timedResponseWriter) Flush() {
+	if flusher, ok := tw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,347 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+
+	cfclient "github.com/nwright-nz/go-cfclient"
+)
+
+// Cloud Controller calls which go-cfclient doesn't provide.
+
+// updateAppEnvironment merges changes into the app's environment, an empty value removes the key.
+// Running instances only see the new values after a restart, the gateway reads them straight away.
+func updateAppEnvironment(c *cfclient.Client, app cfclient.App, changes map[string]string) error {
+	env := make(map[string]interface{})
+	for k, v := range app.Environment {
+		env[k] = v
+	}
+	for k, v := range changes {
+		if len(v) == 0 {
+			delete(env, k)
+		} else {
+			env[k] = v
+		}
+	}
+
+	body, err := json.Marshal(map[string]interface{}{"environment_json": env})
+	if err != nil {
+		return err
+	}
+
+	res, err := c.DoRequest(c.NewRequestWithBody("PUT", "/v2/apps/"+app.Guid, bytes.NewReader(body)))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// Droplet is a staged revision of an app, for docker apps it records the image.
+type Droplet struct {
+	GUID      string `json:"guid"`
+	State     string `json:"state"`
+	Image     string `json:"image"`
+	CreatedAt string `json:"created_at"`
+	Metadata  struct {
+		Annotations map[string]string `json:"annotations"`
+	} `json:"metadata"`
+}
+
+// listAppDroplets returns the droplets of an app, newest first.
+func listAppDroplets(c *cfclient.Client, appGUID string) ([]Droplet, error) {
+	res, err := c.DoRequest(c.NewRequest("GET", "/v3/apps/"+appGUID+"/droplets?order_by=-created_at&per_page=5000"))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	page := struct {
+		Resources []Droplet `json:"resources"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&page); err != nil {
+		return nil, err
+	}
+	return page.Resources, nil
+}
+
+// currentDropletGUID returns the droplet the app is running.
+func currentDropletGUID(c *cfclient.Client, appGUID string) (string, error) {
+	res, err := c.DoRequest(c.NewRequest("GET", "/v3/apps/"+appGUID+"/relationships/current_droplet"))
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	relationship := struct {
+		Data struct {
+			GUID string `json:"guid"`
+		} `json:"data"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&relationship); err != nil {
+		return "", err
+	}
+	return relationship.Data.GUID, nil
+}
+
+// annotateDroplet adds annotations to a droplet's metadata.
+func annotateDroplet(c *cfclient.Client, dropletGUID string, annotations map[string]string) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": annotations},
+	})
+	if err != nil {
+		return err
+	}
+
+	res, err := c.DoRequest(c.NewRequestWithBody("PATCH", "/v3/droplets/"+dropletGUID, bytes.NewReader(body)))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// restartApp stops and starts the app's instances with its current droplet and environment.
+func restartApp(c *cfclient.Client, appGUID string) error {
+	res, err := c.DoRequest(c.NewRequest("POST", "/v3/apps/"+appGUID+"/actions/restart"))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// appAnnotations returns the annotations in an app's metadata.
+func appAnnotations(c *cfclient.Client, appGUID string) (map[string]string, error) {
+	res, err := c.DoRequest(c.NewRequest("GET", "/v3/apps/"+appGUID))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	app := struct {
+		Metadata struct {
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&app); err != nil {
+		return nil, err
+	}
+	return app.Metadata.Annotations, nil
+}
+
+// annotateApp sets annotations on an app, a nil value removes the annotation.
+func annotateApp(c *cfclient.Client, appGUID string, annotations map[string]*string) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": annotations},
+	})
+	if err != nil {
+		return err
+	}
+
+	res, err := c.DoRequest(c.NewRequestWithBody("PATCH", "/v3/apps/"+appGUID, bytes.NewReader(body)))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// listAppAnnotation returns the value of an annotation for each app which has it, keyed by app GUID.
+func listAppAnnotation(c *cfclient.Client, key string) (map[string]string, error) {
+	res, err := c.DoRequest(c.NewRequest("GET", "/v3/apps?per_page=5000"))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	page := struct {
+		Resources []struct {
+			GUID     string `json:"guid"`
+			Metadata struct {
+				Annotations map[string]string `json:"annotations"`
+			} `json:"metadata"`
+		} `json:"resources"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&page); err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string)
+	for _, app := range page.Resources {
+		if value, ok := app.Metadata.Annotations[key]; ok {
+			values[app.GUID] = value
+		}
+	}
+	return values, nil
+}
+
+// saveUserProvidedCredentials stores credentials in a user-provided service instance, reusing the
+// instance when one of that name is already in the space, and returns its GUID.
+func saveUserProvidedCredentials(c *cfclient.Client, spaceGUID string, name string, credentials map[string]string) (string, error) {
+	query := url.Values{}
+	query.Add("q", fmt.Sprintf("name:%s", name))
+	query.Add("q", fmt.Sprintf("space_guid:%s", spaceGUID))
+	res, err := c.DoRequest(c.NewRequest("GET", "/v2/user_provided_service_instances?"+query.Encode()))
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	page := struct {
+		Resources []struct {
+			Metadata struct {
+				GUID string `json:"guid"`
+			} `json:"metadata"`
+		} `json:"resources"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&page); err != nil {
+		return "", err
+	}
+	if len(page.Resources) > 0 {
+		return page.Resources[0].Metadata.GUID, nil
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"name":        name,
+		"space_guid":  spaceGUID,
+		"credentials": credentials,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	created, err := c.DoRequest(c.NewRequestWithBody("POST", "/v2/user_provided_service_instances", bytes.NewReader(body)))
+	if err != nil {
+		return "", err
+	}
+	defer created.Body.Close()
+
+	instance := struct {
+		Metadata struct {
+			GUID string `json:"guid"`
+		} `json:"metadata"`
+	}{}
+	if err := json.NewDecoder(created.Body).Decode(&instance); err != nil {
+		return "", err
+	}
+	return instance.Metadata.GUID, nil
+}
+
+// userProvidedCredentials returns the credentials of a user-provided service instance.
+func userProvidedCredentials(c *cfclient.Client, instanceGUID string) (map[string]string, error) {
+	res, err := c.DoRequest(c.NewRequest("GET", "/v2/user_provided_service_instances/"+instanceGUID))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	instance := struct {
+		Entity struct {
+			Credentials map[string]string `json:"credentials"`
+		} `json:"entity"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&instance); err != nil {
+		return nil, err
+	}
+	return instance.Entity.Credentials, nil
+}
+
+// functionVersionApp is an app deployed as a version of a function.
+type functionVersionApp struct {
+	GUID    string
+	Name    string
+	Version string
+	// Traffic is the function's traffic policy as JSON.
+	Traffic string
+}
+
+// listFunctionVersions returns the apps labelled as versions of a function.
+func listFunctionVersions(c *cfclient.Client, name string) ([]functionVersionApp, error) {
+	query := url.Values{}
+	query.Set("label_selector", functionLabel+"="+name)
+	query.Set("per_page", "5000")
+	res, err := c.DoRequest(c.NewRequest("GET", "/v3/apps?"+query.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	page := struct {
+		Resources []struct {
+			GUID     string `json:"guid"`
+			Name     string `json:"name"`
+			Metadata struct {
+				Labels      map[string]string `json:"labels"`
+				Annotations map[string]string `json:"annotations"`
+			} `json:"metadata"`
+		} `json:"resources"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&page); err != nil {
+		return nil, err
+	}
+
+	var versions []functionVersionApp
+	for _, app := range page.Resources {
+		if version := app.Metadata.Labels[versionLabel]; len(version) > 0 {
+			versions = append(versions, functionVersionApp{
+				GUID:    app.GUID,
+				Name:    app.Name,
+				Version: version,
+				Traffic: app.Metadata.Annotations[trafficAnnotation],
+			})
+		}
+	}
+	return versions, nil
+}
+
+// listAppLabel returns the value of a label for each app which has it, keyed by app GUID.
+func listAppLabel(c *cfclient.Client, key string) (map[string]string, error) {
+	query := url.Values{}
+	query.Set("label_selector", key)
+	query.Set("per_page", "5000")
+	res, err := c.DoRequest(c.NewRequest("GET", "/v3/apps?"+query.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	page := struct {
+		Resources []struct {
+			GUID     string `json:"guid"`
+			Metadata struct {
+				Labels map[string]string `json:"labels"`
+			} `json:"metadata"`
+		} `json:"resources"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&page); err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string)
+	for _, app := range page.Resources {
+		if value, ok := app.Metadata.Labels[key]; ok {
+			values[app.GUID] = value
+		}
+	}
+	return values, nil
+}
+
+// labelApp sets labels on an app, a nil value removes the label.
+func labelApp(c *cfclient.Client, appGUID string, labels map[string]*string) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"labels": labels},
+	})
+	if err != nil {
+		return err
+	}
+
+	res, err := c.DoRequest(c.NewRequestWithBody("PATCH", "/v3/apps/"+appGUID, bytes.NewReader(body)))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// clientIPKey holds the caller's address once MakeClientIPHandler has found it.
+type clientIPKey struct{}
+
+// TrustedProxies are the addresses allowed to report the caller's address in X-Forwarded-For.
+type TrustedProxies []*net.IPNet
+
+// ParseTrustedProxies reads a comma-separated list of IPs and CIDRs i.e. 10.0.0.0/8,192.168.1.5.
+func ParseTrustedProxies(list string) (TrustedProxies, error) {
+	var proxies TrustedProxies
+	for _, entry := range splitList(list) {
+		if ip := net.ParseIP(entry); ip != nil {
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %s is not an IP or CIDR", entry)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+func (p TrustedProxies) contains(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, network := range p {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// MakeClientIPHandler finds the caller's address for rate limits and caller scoped caches. Calls
+// from a trusted proxy are from the rightmost X-Forwarded-For entry which isn't a trusted proxy,
+// the entries before it are sent by the client. Other calls are from their remote address.
+func MakeClientIPHandler(next http.HandlerFunc, trusted TrustedProxies) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := remoteHost(r)
+		if trusted.contains(ip) {
+			var entries []string
+			for _, forwarded := range r.Header.Values("X-Forwarded-For") {
+				entries = append(entries, strings.Split(forwarded, ",")...)
+			}
+			for i := len(entries) - 1; i >= 0; i-- {
+				entry := strings.TrimSpace(entries[i])
+				if len(entry) == 0 {
+					break
+				}
+				ip = entry
+				if !trusted.contains(entry) {
+					break
+				}
+			}
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), clientIPKey{}, ip)))
+	}
+}
+
+// clientIP is the caller's address found by MakeClientIPHandler, or the remote address.
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	return remoteHost(r)
+}
+
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
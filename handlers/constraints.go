@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	cfclient "github.com/nwright-nz/go-cfclient"
+)
+
+// constraintsAnnotation holds the constraints a function was deployed with, on its app.
+const constraintsAnnotation = "openfaas.com/constraints"
+
+// Placement is where a function's app runs, derived from its constraints.
+type Placement struct {
+	Org              string
+	Space            string
+	IsolationSegment string
+}
+
+// ParsePlacement interprets constraint expressions such as "isolation_segment == gpu-free"
+// or "space == regulated", fields without a constraint are left empty. Constraints meant for
+// other providers, such as "node.platform.os == linux", are ignored.
+func ParsePlacement(constraints []string) (Placement, error) {
+	placement := Placement{}
+
+	for _, constraint := range constraints {
+		parts := strings.SplitN(constraint, "==", 2)
+		if len(parts) != 2 {
+			// Other providers also have != constraints.
+			if parts = strings.SplitN(constraint, "!=", 2); len(parts) == 2 && !placementKey(strings.TrimSpace(parts[0])) {
+				log.Printf("Ignoring constraint %q, supported: org, space, isolation_segment", constraint)
+				continue
+			}
+			return placement, fmt.Errorf("constraint %q should be in the form key == value", constraint)
+		}
+
+		key := strings.TrimSpace(parts[0])
+		value := strings.TrimSpace(parts[1])
+		if !placementKey(key) {
+			log.Printf("Ignoring constraint %q, supported: org, space, isolation_segment", constraint)
+			continue
+		}
+		if len(value) == 0 {
+			return placement, fmt.Errorf("constraint %q has no value", constraint)
+		}
+
+		switch key {
+		case "org":
+			placement.Org = value
+		case "space":
+			placement.Space = value
+		case "isolation_segment":
+			placement.IsolationSegment = value
+		}
+	}
+
+	return placement, nil
+}
+
+func placementKey(key string) bool {
+	return key == "org" || key == "space" || key == "isolation_segment"
+}
+
+// resolvePlacement validates a placement against the Cloud Controller and returns the space to
+// deploy into. With an isolation segment but no space constraint the first space in the org
+// assigned to the segment is used.
+func resolvePlacement(c *cfclient.Client, placement Placement, defaultOrg string, defaultSpace string) (cfclient.Space, error) {
+	if len(placement.Org) == 0 {
+		placement.Org = defaultOrg
+	}
+	org, err := c.GetOrgByName(placement.Org)
+	if err != nil {
+		return cfclient.Space{}, fmt.Errorf("unknown org: %s", placement.Org)
+	}
+
+	if len(placement.IsolationSegment) == 0 {
+		if len(placement.Space) == 0 {
+			placement.Space = defaultSpace
+		}
+		space, err := c.GetSpaceByName(placement.Space, org.Guid)
+		if err != nil {
+			return cfclient.Space{}, fmt.Errorf("unknown space: %s", placement.Space)
+		}
+		return space, nil
+	}
+
+	segments, err := c.ListIsolationSegments()
+	if err != nil {
+		return cfclient.Space{}, err
+	}
+
+	var segmentGUID string
+	for _, segment := range segments {
+		if segment.Name == placement.IsolationSegment {
+			segmentGUID = segment.GUID
+		}
+	}
+	if len(segmentGUID) == 0 {
+		return cfclient.Space{}, fmt.Errorf("unknown isolation segment: %s", placement.IsolationSegment)
+	}
+
+	spaceConstrained := len(placement.Space) > 0
+
+	var candidates []cfclient.Space
+	if spaceConstrained {
+		space, err := c.GetSpaceByName(placement.Space, org.Guid)
+		if err != nil {
+			return cfclient.Space{}, fmt.Errorf("unknown space: %s", placement.Space)
+		}
+		candidates = append(candidates, space)
+	} else {
+		candidates, err = c.OrgSpaces(org.Guid)
+		if err != nil {
+			return cfclient.Space{}, err
+		}
+	}
+
+	for _, space := range candidates {
+		assigned, err := spaceIsolationSegment(c, space.Guid)
+		if err != nil {
+			return cfclient.Space{}, err
+		}
+		if assigned == segmentGUID {
+			return space, nil
+		}
+	}
+
+	if spaceConstrained {
+		return cfclient.Space{}, fmt.Errorf("space %s is not assigned to isolation segment %s", placement.Space, placement.IsolationSegment)
+	}
+	return cfclient.Space{}, fmt.Errorf("no space in org %s is assigned to isolation segment %s", placement.Org, placement.IsolationSegment)
+}
+
+// spaceIsolationSegment returns the GUID of the isolation segment a space runs its apps on,
+// empty when the space uses the shared segment.
+func spaceIsolationSegment(c *cfclient.Client, spaceGUID string) (string, error) {
+	res, err := c.DoRequest(c.NewRequest("GET", "/v3/spaces/"+spaceGUID+"/relationships/isolation_segment"))
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	relationship := struct {
+		Data *struct {
+			GUID string `json:"guid"`
+		} `json:"data"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&relationship); err != nil {
+		return "", err
+	}
+	if relationship.Data == nil {
+		return "", nil
+	}
+	return relationship.Data.GUID, nil
+}
+
+// readConstraints returns the constraints stored in a function's annotation.
+func readConstraints(value string) []string {
+	var constraints []string
+	if len(value) > 0 {
+		json.Unmarshal([]byte(value), &constraints)
+	}
+	return constraints
+}
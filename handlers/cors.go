@@ -0,0 +1,183 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nwright-nz/openfaas-cf-backend/types"
+)
+
+// Labels which set the CORS policy of a function, each overrides the gateway's default.
+const (
+	// CORSOriginsLabel lists allowed origins i.e. https://app.example.com,https://admin.example.com or *.
+	CORSOriginsLabel = "com.openfaas.cors.origins"
+	// CORSMethodsLabel lists the methods browsers may use.
+	CORSMethodsLabel = "com.openfaas.cors.methods"
+	// CORSHeadersLabel lists the request headers browsers may send, * allows any.
+	CORSHeadersLabel = "com.openfaas.cors.headers"
+	// CORSExposeHeadersLabel lists response headers scripts may read besides the gateway's own.
+	CORSExposeHeadersLabel = "com.openfaas.cors.expose_headers"
+	// CORSCredentialsLabel allows cookies and auth headers when "true", for listed origins but not *.
+	CORSCredentialsLabel = "com.openfaas.cors.credentials"
+	// CORSMaxAgeLabel is how long browsers may cache a preflight, in seconds.
+	CORSMaxAgeLabel = "com.openfaas.cors.max_age"
+)
+
+// CORSPolicy decides which browser origins may call a function.
+type CORSPolicy struct {
+	Origins       []string
+	Methods       []string
+	Headers       []string
+	ExposeHeaders []string
+	Credentials   bool
+	MaxAge        time.Duration
+}
+
+// DefaultCORSPolicy is the policy of functions without CORS labels.
+func DefaultCORSPolicy(config types.GatewayConfig) CORSPolicy {
+	if config.CORSCredentials && strings.Contains(config.CORSOrigins, "*") {
+		log.Println("cors_allow_credentials is ignored while cors_allowed_origins is *, list the origins instead")
+	}
+	return CORSPolicy{
+		Origins:     splitList(config.CORSOrigins),
+		Methods:     splitList(config.CORSMethods),
+		Headers:     splitList(config.CORSHeaders),
+		Credentials: config.CORSCredentials,
+		MaxAge:      config.CORSMaxAge,
+	}
+}
+
+// withLabels returns the policy with a function's labels applied.
+func (p CORSPolicy) withLabels(labels map[string]string) CORSPolicy {
+	if origins, ok := labels[CORSOriginsLabel]; ok {
+		p.Origins = splitList(origins)
+	}
+	if methods, ok := labels[CORSMethodsLabel]; ok {
+		p.Methods = splitList(methods)
+	}
+	if headers, ok := labels[CORSHeadersLabel]; ok {
+		p.Headers = splitList(headers)
+	}
+	if expose, ok := labels[CORSExposeHeadersLabel]; ok {
+		p.ExposeHeaders = splitList(expose)
+	}
+	if credentials, ok := labels[CORSCredentialsLabel]; ok {
+		p.Credentials = credentials == "true"
+	}
+	p.MaxAge = labelDuration(labels, CORSMaxAgeLabel, p.MaxAge)
+	return p
+}
+
+// allowOrigin returns the Access-Control-Allow-Origin for origin, empty when it isn't allowed.
+func (p CORSPolicy) allowOrigin(origin string) string {
+	for _, allowed := range p.Origins {
+		if allowed == "*" {
+			return "*"
+		}
+		if strings.EqualFold(allowed, origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// allowsCredentials reports whether credentials may be sent from allowOrigin. They need explicit
+// origins, otherwise any site could make calls with a user's cookies or auth and read the response.
+func (p CORSPolicy) allowsCredentials(allowOrigin string) bool {
+	return p.Credentials && allowOrigin != "*"
+}
+
+func (p CORSPolicy) allowsMethod(method string) bool {
+	for _, allowed := range p.Methods {
+		if strings.EqualFold(allowed, method) {
+			return true
+		}
+	}
+	return false
+}
+
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// MakeCORSHandler answers CORS preflights for functions and adds CORS headers to calls from
+// allowed origins before calling next. Preflights are answered before auth, as browsers don't
+// send credentials with them.
+func MakeCORSHandler(next http.HandlerFunc, lookup FunctionLabelLookup, defaults CORSPolicy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		name := mux.Vars(r)["name"]
+		if len(name) == 0 {
+			name = r.Header.Get("X-Function")
+		}
+		if len(origin) == 0 || len(name) == 0 {
+			next(w, r)
+			return
+		}
+
+		policy := defaults
+		labels, err := lookup(name)
+		if err != nil {
+			log.Printf("Unable to read CORS policy of %s, using the default: %s", name, err)
+		} else {
+			policy = defaults.withLabels(labels)
+		}
+
+		allowOrigin := policy.allowOrigin(origin)
+		preflight := r.Method == http.MethodOptions && len(r.Header.Get("Access-Control-Request-Method")) > 0
+
+		header := w.Header()
+		header.Add("Vary", "Origin")
+
+		if preflight {
+			header.Add("Vary", "Access-Control-Request-Method")
+			header.Add("Vary", "Access-Control-Request-Headers")
+
+			requestMethod := r.Header.Get("Access-Control-Request-Method")
+			if len(allowOrigin) == 0 || !policy.allowsMethod(requestMethod) {
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte(fmt.Sprintf("CORS request from %s not allowed for function: %s.", origin, name)))
+				return
+			}
+
+			header.Set("Access-Control-Allow-Origin", allowOrigin)
+			header.Set("Access-Control-Allow-Methods", strings.Join(policy.Methods, ", "))
+			if len(policy.Headers) == 1 && policy.Headers[0] == "*" {
+				if requested := r.Header.Get("Access-Control-Request-Headers"); len(requested) > 0 {
+					header.Set("Access-Control-Allow-Headers", requested)
+				}
+			} else if len(policy.Headers) > 0 {
+				header.Set("Access-Control-Allow-Headers", strings.Join(policy.Headers, ", "))
+			}
+			if policy.allowsCredentials(allowOrigin) {
+				header.Set("Access-Control-Allow-Credentials", "true")
+			}
+			if policy.MaxAge > 0 {
+				header.Set("Access-Control-Max-Age", strconv.Itoa(int(policy.MaxAge.Seconds())))
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if len(allowOrigin) > 0 {
+			header.Set("Access-Control-Allow-Origin", allowOrigin)
+			if policy.allowsCredentials(allowOrigin) {
+				header.Set("Access-Control-Allow-Credentials", "true")
+			}
+			expose := append([]string{CallIDHeader, DurationHeader, "X-Cache"}, policy.ExposeHeaders...)
+			header.Set("Access-Control-Expose-Headers", strings.Join(expose, ", "))
+		}
+		next(w, r)
+	}
+}
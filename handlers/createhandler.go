@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -17,7 +18,7 @@ import (
 )
 
 // MakeNewFunctionHandler creates a new function (service) inside the swarm network.
-func MakeNewFunctionHandler(metricsOptions metrics.MetricOptions, c *cfclient.Client, maxRestarts uint64) http.HandlerFunc {
+func MakeNewFunctionHandler(metricsOptions metrics.MetricOptions, c *cfclient.Client, config types.GatewayConfig, splitter *TrafficSplitter, maxRestarts uint64) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
 		body, _ := ioutil.ReadAll(r.Body)
@@ -53,8 +54,19 @@ func MakeNewFunctionHandler(metricsOptions metrics.MetricOptions, c *cfclient.Cl
 		// fmt.Println(b)
 		// fmt.Println("The spec is : " + spec.Command + spec.Dockerimage)
 
-		org, _ := c.GetOrgByName("system")
-		space, _ := c.GetSpaceByName("dev", org.Guid)
+		placement, err := ParsePlacement(request.Constraints)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		space, err := resolvePlacement(c, placement, config.CFOrg, config.CFSpace)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
 
 		var env = make(map[string]string)
 		env["function"] = "true"
@@ -65,21 +77,119 @@ func MakeNewFunctionHandler(metricsOptions metrics.MetricOptions, c *cfclient.Cl
 			env[k] = v
 		}
 
-		app, err := c.CreateV3DockerAppWithEnv(request.Service, space.Guid, env)
-		if err != nil {
-			fmt.Println(err)
+		if len(request.Labels) > 0 {
+			labels, _ := json.Marshal(request.Labels)
+			env[labelsEnvKey] = string(labels)
+		}
+
+		// The gateway's bookkeeping is kept in the app's metadata rather than its environment, which
+		// the function sees.
+		annotations := make(map[string]*string)
+		if len(request.Constraints) > 0 {
+			constraints, _ := json.Marshal(request.Constraints)
+			encoded := string(constraints)
+			annotations[constraintsAnnotation] = &encoded
+		}
 
+		appName := versionedName(request.Service, request.Version)
+		if len(request.Version) > 0 {
+			if !validFunctionName.MatchString(request.Version) || len(request.Service) > 63 || len(request.Version) > 63 {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("Function names and versions should be letters, numbers, - or _ and at most 63 characters."))
+				return
+			}
+
+			// Every version carries the policy, the first version deployed takes all of the traffic.
+			policy, err := splitter.Policy(request.Service)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(err.Error()))
+				return
+			}
+			if policy == nil {
+				policy = &requests.TrafficPolicy{Weights: map[string]int{request.Version: 100}}
+			}
+			policyBytes, _ := json.Marshal(policy)
+			encoded := string(policyBytes)
+			annotations[trafficAnnotation] = &encoded
 		}
 
-		pkg, err := c.CreateV3DockerPackage(app.GUID, request.Image)
+		existing, redeploy, err := findFunctionApp(appName, c)
 		if err != nil {
-			fmt.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		// A redeploy stages a new droplet for the existing app, its earlier droplets are kept
+		// as revisions to roll back to. Apps can't move between spaces, so a redeploy has to
+		// keep the function where it runs.
+		if redeploy && existing.SpaceGuid != space.Guid {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(fmt.Sprintf("Function %s runs in another space, remove it before changing its placement.", appName)))
+			return
+		}
+
+		var appGUID, appSpaceGUID string
+		if redeploy {
+			changes := make(map[string]string)
+			for k := range existing.Environment {
+				changes[k] = ""
+			}
+			for k, v := range env {
+				changes[k] = v
+			}
+			if err := updateAppEnvironment(c, existing, changes); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte("Unable to update environment: " + err.Error()))
+				return
+			}
+			appGUID = existing.Guid
+			appSpaceGUID = existing.SpaceGuid
+		} else {
+			app, err := c.CreateV3DockerAppWithEnv(appName, space.Guid, env)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte("Unable to create function: " + err.Error()))
+				return
+			}
+			appGUID = app.GUID
+			appSpaceGUID = space.Guid
+		}
+
+		if len(request.Version) > 0 {
+			labels := map[string]*string{functionLabel: &request.Service, versionLabel: &request.Version}
+			if err := labelApp(c, appGUID, labels); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte("Unable to label function version: " + err.Error()))
+				return
+			}
+		}
+		if redeploy {
+			if _, ok := annotations[constraintsAnnotation]; !ok {
+				annotations[constraintsAnnotation] = nil
+			}
+		}
+		if len(annotations) > 0 {
+			if err := annotateApp(c, appGUID, annotations); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte("Unable to annotate function: " + err.Error()))
+				return
+			}
+		}
 
+		pkg, err := c.CreateV3DockerPackage(appGUID, request.Image)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Unable to create package: " + err.Error()))
+			return
 		}
 
 		bld, err := c.CreateV3DockerBuild(pkg.GUID)
 		if err != nil {
-			fmt.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Unable to stage function: " + err.Error()))
+			return
 		}
 
 		dropletGUID := bld.Droplet.GUID
@@ -92,44 +202,112 @@ func MakeNewFunctionHandler(metricsOptions metrics.MetricOptions, c *cfclient.Cl
 			time.Sleep(2 * time.Second)
 		}
 
-		_, err = c.AssignDropletToApp(app.GUID, dropletGUID)
-		if err != nil {
-			fmt.Println("Error assigning droplet" + err.Error())
+		if err := snapshotEnvironment(c, appName, appSpaceGUID, dropletGUID, env); err != nil {
+			fmt.Println("Error recording environment on droplet " + err.Error())
 		}
 
-		routeReq := cfclient.RouteRequest{Host: request.Service, DomainGuid: "5aca508e-e623-44d2-8b3e-8279788e1bcb", SpaceGuid: space.Guid}
-		route, err := c.CreateHttpRoute(routeReq)
+		_, err = c.AssignDropletToApp(appGUID, dropletGUID)
 		if err != nil {
-			fmt.Println(err)
+			fmt.Println("Error assigning droplet" + err.Error())
 		}
 
-		routeMap := cfclient.RouteMap{AppGUID: app.GUID, RouteGUID: route.Meta.GUID}
-		mr, err := c.MapRoute(routeMap)
+		if redeploy {
+			// The app keeps its routes, restarting picks up the new droplet and environment.
+			if err := restartApp(c, appGUID); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte("Unable to restart function: " + err.Error()))
+				return
+			}
+		} else {
+			// Direct functions are called on their instances by the gateway so don't need a public route.
+			if config.DirectFunctions {
+				if len(config.InternalDomain) > 0 {
+					err = mapInternalRoute(c, config, appName, space.Guid, appGUID)
+					if err != nil {
+						fmt.Println("Error mapping internal route " + err.Error())
+					}
+				}
+			} else {
+				routeReq := cfclient.RouteRequest{Host: appName, DomainGuid: "5aca508e-e623-44d2-8b3e-8279788e1bcb", SpaceGuid: space.Guid}
+				route, err := c.CreateHttpRoute(routeReq)
+				if err != nil {
+					fmt.Println(err)
+				}
+
+				routeMap := cfclient.RouteMap{AppGUID: appGUID, RouteGUID: route.Meta.GUID}
+				mr, err := c.MapRoute(routeMap)
+
+				if err != nil {
+					fmt.Println(err)
+				}
+
+				fmt.Println(mr)
+			}
+
+			_, err = c.StartApp(appGUID)
+
+			if err != nil {
+				fmt.Println("Error starting app " + err.Error())
+			}
+		}
 
-		if err != nil {
-			fmt.Println(err)
+		if len(request.Version) > 0 {
+			splitter.Forget(request.Service)
 		}
 
-		fmt.Println(mr)
+	}
+}
 
-		_, err = c.StartApp(app.GUID)
+// mapInternalRoute maps <service>.<internal domain> to the app and allows the gateway
+// to reach it over the container network.
+func mapInternalRoute(c *cfclient.Client, config types.GatewayConfig, service string, spaceGUID string, appGUID string) error {
+	domain, err := c.GetSharedDomainByName(config.InternalDomain)
+	if err != nil {
+		return err
+	}
 
-		if err != nil {
-			fmt.Println("Error starting app " + err.Error())
-		}
+	routeReq := cfclient.RouteRequest{Host: service, DomainGuid: domain.Guid, SpaceGuid: spaceGUID}
+	route, err := c.CreateHttpRoute(routeReq)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.MapRoute(cfclient.RouteMap{AppGUID: appGUID, RouteGUID: route.Meta.GUID})
+	if err != nil {
+		return err
+	}
+
+	if len(config.GatewayAppGUID) == 0 {
+		return errors.New("gateway app GUID unknown, can't add network policy")
+	}
+
+	policy := map[string]interface{}{
+		"policies": []interface{}{
+			map[string]interface{}{
+				"source": map[string]interface{}{"id": config.GatewayAppGUID},
+				"destination": map[string]interface{}{
+					"id":       appGUID,
+					"protocol": "tcp",
+					"ports":    map[string]int{"start": config.InternalPort, "end": config.InternalPort},
+				},
+			},
+		},
+	}
+	body, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
 
+	res, err := c.DoRequest(c.NewRequestWithBody("POST", "/networking/v1/external/policies", bytes.NewReader(body)))
+	if err != nil {
+		return err
 	}
+	res.Body.Close()
+	return nil
 }
 
 func makeSpec(request *requests.CreateFunctionRequest, maxRestarts uint64) types.AppSpec {
-	//Guardian doesnt do 'constraints' as such. Need to figure out the options here.
-	// linuxOnlyConstraints := []string{"node.platform.os == linux"}
-	// constraints := []string{}
-	// if request.Constraints != nil && len(request.Constraints) > 0 {
-	// 	constraints = request.Constraints
-	// } else {
-	// 	constraints = linuxOnlyConstraints
-	// }
+	// Constraints map to the org, space and isolation segment of the app, see ParsePlacement.
 
 	spec := types.AppSpec{
 		Dockerimage: request.Image,
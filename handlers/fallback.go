@@ -0,0 +1,292 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nwright-nz/openfaas-cf-backend/requests"
+)
+
+const (
+	// AsyncAfterLabel opts a function into answering 202 once a call takes longer than its value
+	// i.e. 20s, the X-Async-After request header does the same for a single call.
+	AsyncAfterLabel  = "com.openfaas.async_after"
+	asyncAfterHeader = "X-Async-After"
+
+	// maxResultBytes bounds the responses kept for calls which carry on in the background.
+	maxResultBytes = 4 * 1024 * 1024
+)
+
+// ResultStore keeps the results of calls which carried on in the background.
+type ResultStore interface {
+	Put(id string, result requests.CallResult) error
+	// Get returns nil when there's no result with the id.
+	Get(id string) (*requests.CallResult, error)
+}
+
+type storedResult struct {
+	result  requests.CallResult
+	expires time.Time
+}
+
+// MemoryResultStore keeps results in the gateway's memory until they expire.
+type MemoryResultStore struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	results map[string]storedResult
+	puts    int
+}
+
+// NewMemoryResultStore keeps each result for ttl after it was last written.
+func NewMemoryResultStore(ttl time.Duration) *MemoryResultStore {
+	return &MemoryResultStore{ttl: ttl, results: make(map[string]storedResult)}
+}
+
+// Put implements ResultStore.
+func (s *MemoryResultStore) Put(id string, result requests.CallResult) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.results[id] = storedResult{result: result, expires: now.Add(s.ttl)}
+
+	s.puts++
+	if s.puts%256 == 0 {
+		for key, stored := range s.results {
+			if now.After(stored.expires) {
+				delete(s.results, key)
+			}
+		}
+	}
+	return nil
+}
+
+// Get implements ResultStore.
+func (s *MemoryResultStore) Get(id string) (*requests.CallResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.results[id]
+	if !ok || time.Now().After(stored.expires) {
+		return nil, nil
+	}
+	return &stored.result, nil
+}
+
+// resultRecorder buffers a function's response so it can be sent to the client or stored.
+type resultRecorder struct {
+	header   http.Header
+	status   int
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (rr *resultRecorder) Header() http.Header {
+	return rr.header
+}
+
+func (rr *resultRecorder) WriteHeader(status int) {
+	if rr.status == 0 {
+		rr.status = status
+	}
+}
+
+func (rr *resultRecorder) Write(data []byte) (int, error) {
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+	if rr.body.Len()+len(data) > maxResultBytes {
+		rr.overflow = true
+		return 0, errResponseTooLarge
+	}
+	return rr.body.Write(data)
+}
+
+func (rr *resultRecorder) Flush() {}
+
+// MakeAsyncFallbackHandler lets calls which opt in by label or header carry on in the background
+// once they take longer than asked. The client then gets a 202 with a status URL to fetch the
+// result from, which is also posted to the X-Callback-Url when given. Responses of calls which
+// opt in are buffered, so they aren't streamed.
+func MakeAsyncFallbackHandler(next http.HandlerFunc, lookup FunctionLabelLookup, results ResultStore, client *http.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+		if len(name) == 0 {
+			name = r.Header.Get("X-Function")
+		}
+		// The queue worker already runs in the background and delivers the result itself.
+		if len(name) == 0 || isUpgrade(r) || isQueuedCall(r) {
+			next(w, r)
+			return
+		}
+
+		var after time.Duration
+		if header := r.Header.Get(asyncAfterHeader); len(header) > 0 {
+			after = parseDuration(header, 0)
+		} else if labels, err := lookup(name); err == nil {
+			after = labelDuration(labels, AsyncAfterLabel, 0)
+		}
+		if after <= 0 {
+			next(w, r)
+			return
+		}
+
+		callback := r.Header.Get("X-Callback-Url")
+		if len(callback) > 0 {
+			if parsed, err := url.Parse(callback); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("X-Callback-Url should be an http or https URL."))
+				return
+			}
+		}
+		r.Header.Del(asyncAfterHeader)
+
+		// The call keeps the request's values, such as the route and trace, but isn't cancelled
+		// when the client goes away.
+		background := r.WithContext(context.WithoutCancel(r.Context()))
+		recorder := &resultRecorder{header: make(http.Header)}
+		done := make(chan struct{})
+		start := time.Now()
+
+		go func() {
+			defer close(done)
+			defer func() {
+				// The proxy aborts calls it can't finish by panicking, which net/http would
+				// otherwise recover from.
+				if err := recover(); err != nil && err != http.ErrAbortHandler {
+					log.Printf("[%s] Call to %s failed: %v", r.Header.Get(CallIDHeader), name, err)
+				}
+				if recorder.overflow || recorder.status == 0 {
+					recorder.header = make(http.Header)
+					recorder.status = http.StatusBadGateway
+					recorder.body.Reset()
+					recorder.body.WriteString(fmt.Sprintf("Function %s didn't return a complete response.", name))
+				}
+			}()
+			next(recorder, background)
+		}()
+
+		timer := time.NewTimer(after)
+		defer timer.Stop()
+
+		select {
+		case <-done:
+			header := w.Header()
+			copyHeaders(&header, &recorder.header)
+			w.WriteHeader(recorder.status)
+			w.Write(recorder.body.Bytes())
+			return
+		case <-timer.C:
+		}
+
+		callID := r.Header.Get(CallIDHeader)
+		id := newResultID()
+		pending := requests.CallResult{CallID: callID, Function: name, Status: "pending"}
+		if err := results.Put(id, pending); err != nil {
+			log.Printf("[%s] Unable to store pending result: %s", callID, err)
+		}
+
+		go func() {
+			<-done
+			result := pending
+			result.Status = "done"
+			result.StatusCode = recorder.status
+			result.Header = recorder.header
+			result.Body = recorder.body.Bytes()
+			result.Duration = time.Since(start).Seconds()
+			if err := results.Put(id, result); err != nil {
+				log.Printf("[%s] Unable to store result: %s", callID, err)
+			}
+			if len(callback) > 0 {
+				deliverResult(client, callback, result)
+			}
+		}()
+
+		statusURL := "/system/results/" + id
+		accepted, _ := json.Marshal(map[string]string{"callId": callID, "status": "pending", "statusUrl": statusURL})
+		w.Header().Set("Location", statusURL)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write(accepted)
+	}
+}
+
+// newResultID is unguessable, unlike call IDs which clients may choose.
+func newResultID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// deliverResult posts a result to the client's callback.
+func deliverResult(client *http.Client, callback string, result requests.CallResult) {
+	req, err := http.NewRequest(http.MethodPost, callback, bytes.NewReader(result.Body))
+	if err != nil {
+		log.Printf("[%s] Invalid callback: %s", result.CallID, err)
+		return
+	}
+	if contentType := http.Header(result.Header).Get("Content-Type"); len(contentType) > 0 {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set(CallIDHeader, result.CallID)
+	req.Header.Set("X-Function-Status", strconv.Itoa(result.StatusCode))
+	req.Header.Set(DurationHeader, fmt.Sprintf("%f", result.Duration))
+
+	res, err := client.Do(req)
+	if err != nil {
+		log.Printf("[%s] Unable to deliver result to callback: %s", result.CallID, err)
+		return
+	}
+	res.Body.Close()
+}
+
+// MakeResultHandler returns a stored result: 202 while the call is pending, then the function's
+// own status, headers and body.
+func MakeResultHandler(results ResultStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		result, err := results.Get(id)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if result == nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(fmt.Sprintf("Cannot find result: %s.", id)))
+			return
+		}
+
+		w.Header().Set(CallIDHeader, result.CallID)
+		w.Header().Set("X-Call-Status", result.Status)
+		if result.Status != "done" {
+			pending, _ := json.Marshal(map[string]string{"callId": result.CallID, "status": result.Status})
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			w.Write(pending)
+			return
+		}
+
+		header := w.Header()
+		for k, vv := range result.Header {
+			if !strings.EqualFold(k, "Content-Length") {
+				header[k] = append([]string(nil), vv...)
+			}
+		}
+		w.WriteHeader(result.StatusCode)
+		w.Write(result.Body)
+	}
+}
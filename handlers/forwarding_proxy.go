@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/nwright-nz/openfaas-cf-backend/metrics"
+	"github.com/nwright-nz/openfaas-cf-backend/tracing"
 	"github.com/nwright-nz/openfaas-cf-backend/types"
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -21,25 +22,35 @@ func MakeForwardingProxyHandler(proxy *httputil.ReverseProxy, metrics *metrics.M
 		log.Printf("> Forwarding [%s] to %s", r.Method, r.URL.String())
 		start := time.Now()
 
+		ctx, span := tracing.StartSpan(r.Context(), "forward "+r.URL.Path, tracing.Client)
+		span.Inject(r.Header)
+		r = r.WithContext(ctx)
+
 		writeAdapter := types.NewWriteAdapter(w)
 		proxy.ServeHTTP(writeAdapter, r)
 
+		span.SetAttribute("http.status_code", strconv.Itoa(writeAdapter.GetHeaderCode()))
+		span.Finish()
+
 		seconds := time.Since(start).Seconds()
 		log.Printf("< [%s] - %d took %f seconds\n", r.URL.String(), writeAdapter.GetHeaderCode(), seconds)
 
 		forward := "/function/"
 		if startsWith(uri, forward) {
-			log.Printf("function=%s", uri[len(forward):])
-
 			service := uri[len(forward):]
+			if end := strings.IndexAny(service, "/?"); end >= 0 {
+				service = service[:end]
+			}
+
+			log.Printf("function=%s", service)
 
 			metrics.GatewayFunctionsHistogram.
-				WithLabelValues(service).
+				WithLabelValues(service, "").
 				Observe(seconds)
 
 			code := strconv.Itoa(writeAdapter.GetHeaderCode())
 
-			metrics.GatewayFunctionInvocation.With(prometheus.Labels{"function_name": service, "code": code}).Inc()
+			metrics.GatewayFunctionInvocation.With(prometheus.Labels{"function_name": service, "code": code, "version": ""}).Inc()
 		}
 	}
 }
@@ -0,0 +1,249 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// IdempotencyKeyHeader lets clients retry a call without it running twice.
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// maxIdempotentBodyBytes bounds the request bodies buffered to compare repeats.
+	maxIdempotentBodyBytes = 1024 * 1024
+)
+
+// IdempotencyRecord is the first response to a call with an idempotency key. Until the response
+// is complete Done is false.
+type IdempotencyRecord struct {
+	// Fingerprint is a hash of the method, path, query and body of the call.
+	Fingerprint string
+	Done        bool
+	StatusCode  int
+	Header      http.Header
+	Body        []byte
+}
+
+// IdempotencyStore keeps a record for each idempotency key until its TTL passes.
+type IdempotencyStore interface {
+	// Begin records that a call with key has started, unless there's already a record for key
+	// in which case that's returned instead.
+	Begin(key string, fingerprint string, ttl time.Duration) (existing *IdempotencyRecord, err error)
+	// Complete stores the response for key.
+	Complete(key string, record IdempotencyRecord, ttl time.Duration) error
+	// Abandon forgets key so the call can be tried again.
+	Abandon(key string) error
+}
+
+type idempotencyEntry struct {
+	record  IdempotencyRecord
+	expires time.Time
+}
+
+// MemoryIdempotencyStore keeps records in the gateway's memory.
+type MemoryIdempotencyStore struct {
+	mu      sync.Mutex
+	entries map[string]idempotencyEntry
+	begins  int
+}
+
+// NewMemoryIdempotencyStore creates an empty MemoryIdempotencyStore.
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{entries: make(map[string]idempotencyEntry)}
+}
+
+// Begin implements IdempotencyStore.
+func (s *MemoryIdempotencyStore) Begin(key string, fingerprint string, ttl time.Duration) (*IdempotencyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if entry, ok := s.entries[key]; ok && now.Before(entry.expires) {
+		return &entry.record, nil
+	}
+	s.entries[key] = idempotencyEntry{record: IdempotencyRecord{Fingerprint: fingerprint}, expires: now.Add(ttl)}
+
+	s.begins++
+	if s.begins%256 == 0 {
+		for k, entry := range s.entries {
+			if now.After(entry.expires) {
+				delete(s.entries, k)
+			}
+		}
+	}
+	return nil, nil
+}
+
+// Complete implements IdempotencyStore.
+func (s *MemoryIdempotencyStore) Complete(key string, record IdempotencyRecord, ttl time.Duration) error {
+	s.mu.Lock()
+	s.entries[key] = idempotencyEntry{record: record, expires: time.Now().Add(ttl)}
+	s.mu.Unlock()
+	return nil
+}
+
+// Abandon implements IdempotencyStore.
+func (s *MemoryIdempotencyStore) Abandon(key string) error {
+	s.mu.Lock()
+	delete(s.entries, key)
+	s.mu.Unlock()
+	return nil
+}
+
+// idempotencyRecorder passes the response to the client and keeps a copy to store.
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status   int
+	header   http.Header
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (ir *idempotencyRecorder) WriteHeader(status int) {
+	if ir.status == 0 {
+		ir.status = status
+		ir.header = make(http.Header)
+		for k, vv := range ir.ResponseWriter.Header() {
+			if k == CallIDHeader || !perCallHeader(k) {
+				ir.header[k] = append([]string(nil), vv...)
+			}
+		}
+	}
+	ir.ResponseWriter.WriteHeader(status)
+}
+
+func (ir *idempotencyRecorder) Write(data []byte) (int, error) {
+	if ir.status == 0 {
+		ir.WriteHeader(http.StatusOK)
+	}
+	if !ir.overflow {
+		if ir.body.Len()+len(data) > maxResultBytes {
+			ir.overflow = true
+			ir.body.Reset()
+		} else {
+			ir.body.Write(data)
+		}
+	}
+	return ir.ResponseWriter.Write(data)
+}
+
+// Unwrap lets http.ResponseController reach the connection for deadlines.
+func (ir *idempotencyRecorder) Unwrap() http.ResponseWriter {
+	return ir.ResponseWriter
+}
+
+func (ir *idempotencyRecorder) Flush() {
+	if flusher, ok := ir.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// callFingerprint identifies a call by its method, path, query and body.
+func callFingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s?%s\n", r.Method, r.URL.Path, r.URL.RawQuery)
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// retryableStatus is a failure which didn't reach or finish in the function, so isn't kept.
+func retryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusBadGateway ||
+		status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+// MakeIdempotencyHandler answers repeats of a call with the same Idempotency-Key and body with
+// the first response, or for queued calls the first 202 and its X-Call-Id. A repeat with a
+// different body gets a 422 and one which arrives while the first is running gets a 409.
+// Responses the client may retry, such as 503 or 429, aren't kept.
+func MakeIdempotencyHandler(next http.HandlerFunc, store IdempotencyStore, ttl time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		idempotencyKey := r.Header.Get(IdempotencyKeyHeader)
+		name := mux.Vars(r)["name"]
+		if len(name) == 0 {
+			name = r.Header.Get("X-Function")
+		}
+		if len(idempotencyKey) == 0 || len(name) == 0 || isUpgrade(r) {
+			next(w, r)
+			return
+		}
+
+		if len(idempotencyKey) > 255 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Idempotency-Key should be at most 255 characters."))
+			return
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentBodyBytes))
+		r.Body.Close()
+		if err != nil {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			w.Write([]byte(fmt.Sprintf("Calls with an Idempotency-Key can send at most %d bytes.", maxIdempotentBodyBytes)))
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		// Keys are per function and caller, and async calls are kept apart from sync calls.
+		kind := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)[0]
+		key := strings.Join([]string{name, kind, callerIdentity(r), idempotencyKey}, "\x00")
+		fingerprint := callFingerprint(r, body)
+
+		existing, err := store.Begin(key, fingerprint, ttl)
+		if err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(fmt.Sprintf("Idempotency store unavailable: %s", err)))
+			return
+		}
+
+		if existing != nil {
+			switch {
+			case existing.Fingerprint != fingerprint:
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				w.Write([]byte("Idempotency-Key has already been used with a different request."))
+			case !existing.Done:
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusConflict)
+				w.Write([]byte("A call with this Idempotency-Key is in progress."))
+			default:
+				header := w.Header()
+				copyHeaders(&header, &existing.Header)
+				header.Set("Idempotent-Replayed", "true")
+				w.WriteHeader(existing.StatusCode)
+				w.Write(existing.Body)
+			}
+			return
+		}
+
+		recorder := &idempotencyRecorder{ResponseWriter: w}
+		completed := false
+		defer func() {
+			if !completed {
+				store.Abandon(key)
+			}
+		}()
+
+		next(recorder, r)
+
+		if recorder.status == 0 || recorder.overflow || retryableStatus(recorder.status) {
+			return
+		}
+		record := IdempotencyRecord{
+			Fingerprint: fingerprint,
+			Done:        true,
+			StatusCode:  recorder.status,
+			Header:      recorder.header,
+			Body:        recorder.body.Bytes(),
+		}
+		if err := store.Complete(key, record, ttl); err == nil {
+			completed = true
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package handlers
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jwtLeeway allows for clock skew between the issuer and the gateway.
+const jwtLeeway = time.Minute
+
+// JWTClaims are the claims of a verified token.
+type JWTClaims map[string]interface{}
+
+// jsonWebKey is a public key from a JWKS, RFC 7517.
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// JWTVerifier checks the signature, expiry, issuer and audience of JWTs against the keys in a
+// JWKS file or URL. RS256/384/512 and ES256/384/512 tokens are supported.
+type JWTVerifier struct {
+	source   string
+	issuer   string
+	audience string
+	refresh  time.Duration
+	client   *http.Client
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+// NewJWTVerifier reads keys from source, an http(s) URL or a file, every refresh. The issuer and
+// audience are checked when set, functions can override them with labels.
+func NewJWTVerifier(source string, issuer string, audience string, refresh time.Duration, client *http.Client) *JWTVerifier {
+	return &JWTVerifier{
+		source:   source,
+		issuer:   issuer,
+		audience: audience,
+		refresh:  refresh,
+		client:   client,
+	}
+}
+
+// key returns the key with kid, keys are fetched again when they're stale or kid is unknown.
+func (v *JWTVerifier) key(kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	key, ok := v.keys[kid]
+	stale := time.Since(v.fetched) > v.refresh
+	// Unknown keys are looked for at most every 30 seconds so bad tokens can't flood the issuer.
+	if !stale && (ok || time.Since(v.fetched) < 30*time.Second) {
+		if !ok {
+			return nil, fmt.Errorf("unknown key %q", kid)
+		}
+		return key, nil
+	}
+
+	keys, err := v.fetchKeys()
+	if err != nil {
+		if ok {
+			return key, nil
+		}
+		return nil, err
+	}
+	v.keys = keys
+	v.fetched = time.Now()
+
+	if key, ok = keys[kid]; !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	return key, nil
+}
+
+func (v *JWTVerifier) fetchKeys() (map[string]crypto.PublicKey, error) {
+	var body []byte
+	if strings.HasPrefix(v.source, "http://") || strings.HasPrefix(v.source, "https://") {
+		res, err := v.client.Get(v.source)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("JWKS returned %d", res.StatusCode)
+		}
+		if body, err = ioutil.ReadAll(res.Body); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if body, err = ioutil.ReadFile(v.source); err != nil {
+			return nil, err
+		}
+	}
+
+	jwks := struct {
+		Keys []jsonWebKey `json:"keys"`
+	}{}
+	if err := json.Unmarshal(body, &jwks); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range jwks.Keys {
+		if jwk.Use == "enc" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	return keys, nil
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
+
+// Verify checks token and returns its claims, issuer and audience override the verifier's own
+// when set.
+func (v *JWTVerifier) Verify(token string, issuer string, audience string) (JWTClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	headerBytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("malformed token header")
+	}
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	if err := json.Unmarshal(headerBytes, &header); err != nil {
+		return nil, errors.New("malformed token header")
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+
+	key, err := v.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("malformed token claims")
+	}
+	claims := JWTClaims{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errors.New("malformed token claims")
+	}
+
+	now := time.Now()
+	if exp, ok := claims["exp"].(float64); !ok || now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return nil, errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("token not valid yet")
+	}
+
+	if len(issuer) == 0 {
+		issuer = v.issuer
+	}
+	if len(issuer) > 0 && claims["iss"] != issuer {
+		return nil, errors.New("wrong issuer")
+	}
+
+	if len(audience) == 0 {
+		audience = v.audience
+	}
+	if len(audience) > 0 && !claims.hasAudience(audience) {
+		return nil, errors.New("wrong audience")
+	}
+	return claims, nil
+}
+
+// hasAudience checks aud, which may be a string or a list.
+func (c JWTClaims) hasAudience(audience string) bool {
+	switch aud := c["aud"].(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func verifySignature(alg string, key crypto.PublicKey, signed []byte, signature []byte) error {
+	var hash crypto.Hash
+	if len(alg) == 5 {
+		switch alg[2:] {
+		case "256":
+			hash = crypto.SHA256
+		case "384":
+			hash = crypto.SHA384
+		case "512":
+			hash = crypto.SHA512
+		}
+	}
+	if hash == 0 {
+		return fmt.Errorf("unsupported algorithm %s", alg)
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch {
+	case strings.HasPrefix(alg, "RS"):
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("key doesn't match algorithm")
+		}
+		if err := rsa.VerifyPKCS1v15(rsaKey, hash, digest, signature); err != nil {
+			return errors.New("invalid signature")
+		}
+		return nil
+	case strings.HasPrefix(alg, "ES"):
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("key doesn't match algorithm")
+		}
+		size := (ecKey.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("invalid signature")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(ecKey, digest, r, s) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported algorithm %s", alg)
+}
@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	cfclient "github.com/nwright-nz/go-cfclient"
+)
+
+// labelsEnvKey holds the labels a function was deployed with as JSON.
+const labelsEnvKey = "function_labels"
+
+// ExecTimeoutLabel bounds how long a call to the function may take i.e. 30s, no limit when unset.
+const ExecTimeoutLabel = "com.openfaas.exec_timeout"
+
+// ExecTimeoutHeader sets the exec timeout of a single call, it can shorten the function's exec
+// timeout but not extend it.
+const ExecTimeoutHeader = "X-Exec-Timeout"
+
+// readLabels returns the labels stored in a function's environment.
+func readLabels(env map[string]interface{}) map[string]string {
+	labels := make(map[string]string)
+	if value, ok := env[labelsEnvKey].(string); ok && len(value) > 0 {
+		json.Unmarshal([]byte(value), &labels)
+	}
+	return labels
+}
+
+func labelInt(labels map[string]string, key string, fallback int) int {
+	if value, ok := labels[key]; ok {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed >= 0 {
+			return parsed
+		}
+	}
+	return fallback
+}
+
+// labelDuration reads a Go duration such as 250ms, a plain number is taken as seconds.
+func labelDuration(labels map[string]string, key string, fallback time.Duration) time.Duration {
+	value, ok := labels[key]
+	if !ok {
+		return fallback
+	}
+	return parseDuration(value, fallback)
+}
+
+// parseDuration reads a plain number as seconds, otherwise as a Go duration i.e. 1m30s.
+func parseDuration(value string, fallback time.Duration) time.Duration {
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if parsed, err := time.ParseDuration(value); err == nil && parsed >= 0 {
+		return parsed
+	}
+	return fallback
+}
+
+// callTimeout is the exec timeout of a call, the shorter of ExecTimeoutHeader and
+// ExecTimeoutLabel. 0 is no limit.
+func callTimeout(r *http.Request, labels map[string]string) time.Duration {
+	timeout := labelDuration(labels, ExecTimeoutLabel, 0)
+	if header := r.Header.Get(ExecTimeoutHeader); len(header) > 0 {
+		if requested := parseDuration(header, 0); requested > 0 && (timeout == 0 || requested < timeout) {
+			return requested
+		}
+	}
+	return timeout
+}
+
+func labelFloat(labels map[string]string, key string, fallback float64) float64 {
+	if value, ok := labels[key]; ok {
+		if parsed, err := strconv.ParseFloat(value, 64); err == nil && parsed >= 0 {
+			return parsed
+		}
+	}
+	return fallback
+}
+
+type cachedLabels struct {
+	labels  map[string]string
+	fetched time.Time
+}
+
+// LabelCache looks up the labels of functions for middleware which runs before the proxy,
+// lookups are cached so that each call doesn't reach the Cloud Controller.
+type LabelCache struct {
+	client  *cfclient.Client
+	refresh time.Duration
+
+	mu     sync.Mutex
+	labels map[string]cachedLabels
+}
+
+// NewLabelCache creates a LabelCache which re-reads labels after refresh.
+func NewLabelCache(client *cfclient.Client, refresh time.Duration) *LabelCache {
+	return &LabelCache{
+		client:  client,
+		refresh: refresh,
+		labels:  make(map[string]cachedLabels),
+	}
+}
+
+// Lookup returns the labels of a function, for a function with versions the labels of any version.
+func (l *LabelCache) Lookup(name string) (map[string]string, error) {
+	l.mu.Lock()
+	cached, ok := l.labels[name]
+	l.mu.Unlock()
+
+	if ok && time.Since(cached.fetched) < l.refresh {
+		return cached.labels, nil
+	}
+
+	app, exists, err := findFunctionApp(name, l.client)
+	if err != nil {
+		return nil, err
+	}
+
+	labels := make(map[string]string)
+	if exists {
+		labels = readLabels(app.Environment)
+	} else {
+		// Versions of a function are deployed with the same labels.
+		versions, err := listFunctionVersions(l.client, name)
+		if err != nil {
+			return nil, err
+		}
+		if len(versions) > 0 {
+			app, found, err := findFunctionApp(versions[0].Name, l.client)
+			if err != nil {
+				return nil, err
+			}
+			if found {
+				labels = readLabels(app.Environment)
+			}
+		}
+	}
+
+	l.mu.Lock()
+	l.labels[name] = cachedLabels{labels: labels, fetched: time.Now()}
+	l.mu.Unlock()
+
+	return labels, nil
+}
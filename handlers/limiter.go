@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// ErrQueueFull is returned when a function has no free slot and its wait queue is full.
+	ErrQueueFull = errors.New("too many calls in progress and queued")
+	// ErrQueueTimeout is returned when a queued call waited too long for a slot.
+	ErrQueueTimeout = errors.New("timed out waiting for a call to finish")
+)
+
+// ConcurrencyLimiter caps the calls in progress to a function, extra calls wait in a bounded
+// queue and are admitted in arrival order as calls finish.
+type ConcurrencyLimiter struct {
+	mu       sync.Mutex
+	inflight int
+	waiters  []chan struct{}
+
+	inflightGauge prometheus.Gauge
+	queuedGauge   prometheus.Gauge
+}
+
+// NewConcurrencyLimiter creates a limiter, the gauges may be nil.
+func NewConcurrencyLimiter(inflightGauge prometheus.Gauge, queuedGauge prometheus.Gauge) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{
+		inflightGauge: inflightGauge,
+		queuedGauge:   queuedGauge,
+	}
+}
+
+// Acquire takes a slot, waiting up to wait when maxInflight calls are in progress. A maxInflight
+// of 0 means no limit. Every successful Acquire must be followed by Release.
+func (l *ConcurrencyLimiter) Acquire(ctx context.Context, maxInflight int, maxQueue int, wait time.Duration) error {
+	l.mu.Lock()
+	if maxInflight == 0 || l.inflight < maxInflight {
+		l.inflight++
+		l.report()
+		l.mu.Unlock()
+		return nil
+	}
+	if len(l.waiters) >= maxQueue {
+		l.mu.Unlock()
+		return ErrQueueFull
+	}
+
+	ready := make(chan struct{})
+	l.waiters = append(l.waiters, ready)
+	l.report()
+	l.mu.Unlock()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-ready:
+		return nil
+	case <-timer.C:
+		err = ErrQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, waiter := range l.waiters {
+		if waiter == ready {
+			l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+			l.report()
+			return err
+		}
+	}
+	// Release handed over a slot as the wait ended.
+	return nil
+}
+
+// Release frees a slot, passing it to the longest waiting call.
+func (l *ConcurrencyLimiter) Release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.waiters) > 0 {
+		close(l.waiters[0])
+		l.waiters = l.waiters[1:]
+	} else {
+		l.inflight--
+	}
+	l.report()
+}
+
+// Inflight returns the calls in progress and waiting.
+func (l *ConcurrencyLimiter) Inflight() (int, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.inflight, len(l.waiters)
+}
+
+func (l *ConcurrencyLimiter) report() {
+	if l.inflightGauge != nil {
+		l.inflightGauge.Set(float64(l.inflight))
+	}
+	if l.queuedGauge != nil {
+		l.queuedGauge.Set(float64(len(l.waiters)))
+	}
+}
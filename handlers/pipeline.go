@@ -0,0 +1,682 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	cfclient "github.com/nwright-nz/go-cfclient"
+	"github.com/nwright-nz/openfaas-cf-backend/queue"
+	"github.com/nwright-nz/openfaas-cf-backend/requests"
+)
+
+const (
+	// PipelineDurationsHeader reports how long each step took i.e. fetch=0.120000, resize=0.480000
+	PipelineDurationsHeader = "X-Pipeline-Durations"
+	// PipelineFailedStepHeader names the step which stopped a pipeline i.e. 2:resize
+	PipelineFailedStepHeader = "X-Pipeline-Failed-Step"
+	// pipelineAnnotationPrefix prefixes the annotations on the gateway app which hold pipelines.
+	pipelineAnnotationPrefix = "pipelines.openfaas.com/"
+)
+
+var (
+	pipelineName      = regexp.MustCompile("^[a-zA-Z0-9][-a-zA-Z0-9_.]{0,62}$")
+	validFunctionName = regexp.MustCompile("^[-a-zA-Z_0-9]+$")
+)
+
+// PipelineStore keeps named pipelines.
+type PipelineStore interface {
+	List() ([]requests.Pipeline, error)
+	// Get returns nil when there's no pipeline with the name.
+	Get(name string) (*requests.Pipeline, error)
+	Save(pipeline requests.Pipeline) error
+	Delete(name string) error
+}
+
+// MemoryPipelineStore keeps pipelines in the gateway's memory.
+type MemoryPipelineStore struct {
+	mu        sync.Mutex
+	pipelines map[string]requests.Pipeline
+}
+
+// NewMemoryPipelineStore creates an empty MemoryPipelineStore.
+func NewMemoryPipelineStore() *MemoryPipelineStore {
+	return &MemoryPipelineStore{pipelines: make(map[string]requests.Pipeline)}
+}
+
+// List implements PipelineStore.
+func (s *MemoryPipelineStore) List() ([]requests.Pipeline, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pipelines := []requests.Pipeline{}
+	for _, pipeline := range s.pipelines {
+		pipelines = append(pipelines, pipeline)
+	}
+	sort.Slice(pipelines, func(i, j int) bool { return pipelines[i].Name < pipelines[j].Name })
+	return pipelines, nil
+}
+
+// Get implements PipelineStore.
+func (s *MemoryPipelineStore) Get(name string) (*requests.Pipeline, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if pipeline, ok := s.pipelines[name]; ok {
+		return &pipeline, nil
+	}
+	return nil, nil
+}
+
+// Save implements PipelineStore.
+func (s *MemoryPipelineStore) Save(pipeline requests.Pipeline) error {
+	s.mu.Lock()
+	s.pipelines[pipeline.Name] = pipeline
+	s.mu.Unlock()
+	return nil
+}
+
+// Delete implements PipelineStore.
+func (s *MemoryPipelineStore) Delete(name string) error {
+	s.mu.Lock()
+	delete(s.pipelines, name)
+	s.mu.Unlock()
+	return nil
+}
+
+// AppPipelineStore keeps pipelines as annotations on the gateway's own app, so that they
+// survive restarts and are shared by every gateway instance.
+type AppPipelineStore struct {
+	client  *cfclient.Client
+	appGUID string
+}
+
+// NewAppPipelineStore creates a store on the app with appGUID.
+func NewAppPipelineStore(client *cfclient.Client, appGUID string) *AppPipelineStore {
+	return &AppPipelineStore{client: client, appGUID: appGUID}
+}
+
+// List implements PipelineStore.
+func (s *AppPipelineStore) List() ([]requests.Pipeline, error) {
+	annotations, err := appAnnotations(s.client, s.appGUID)
+	if err != nil {
+		return nil, err
+	}
+
+	pipelines := []requests.Pipeline{}
+	for key, value := range annotations {
+		if !strings.HasPrefix(key, pipelineAnnotationPrefix) {
+			continue
+		}
+		pipeline := requests.Pipeline{}
+		if err := json.Unmarshal([]byte(value), &pipeline); err != nil {
+			log.Printf("Ignoring unreadable pipeline %s: %s", key, err)
+			continue
+		}
+		pipelines = append(pipelines, pipeline)
+	}
+	sort.Slice(pipelines, func(i, j int) bool { return pipelines[i].Name < pipelines[j].Name })
+	return pipelines, nil
+}
+
+// Get implements PipelineStore.
+func (s *AppPipelineStore) Get(name string) (*requests.Pipeline, error) {
+	annotations, err := appAnnotations(s.client, s.appGUID)
+	if err != nil {
+		return nil, err
+	}
+
+	value, ok := annotations[pipelineAnnotationPrefix+name]
+	if !ok {
+		return nil, nil
+	}
+	pipeline := requests.Pipeline{}
+	if err := json.Unmarshal([]byte(value), &pipeline); err != nil {
+		return nil, err
+	}
+	return &pipeline, nil
+}
+
+// Save implements PipelineStore.
+func (s *AppPipelineStore) Save(pipeline requests.Pipeline) error {
+	value, err := json.Marshal(pipeline)
+	if err != nil {
+		return err
+	}
+	encoded := string(value)
+	return annotateApp(s.client, s.appGUID, map[string]*string{pipelineAnnotationPrefix + pipeline.Name: &encoded})
+}
+
+// Delete implements PipelineStore.
+func (s *AppPipelineStore) Delete(name string) error {
+	return annotateApp(s.client, s.appGUID, map[string]*string{pipelineAnnotationPrefix + name: nil})
+}
+
+// validatePipeline checks a pipeline can be stored and run.
+func validatePipeline(pipeline requests.Pipeline) error {
+	if !pipelineName.MatchString(pipeline.Name) {
+		return fmt.Errorf("pipeline name %q should be up to 63 letters, digits, '-', '_' or '.'", pipeline.Name)
+	}
+	return validateSteps(pipeline.Steps)
+}
+
+func validateSteps(steps []requests.PipelineStep) error {
+	if len(steps) == 0 {
+		return fmt.Errorf("a pipeline needs at least one step")
+	}
+	for i, step := range steps {
+		if !validFunctionName.MatchString(step.Function) {
+			return fmt.Errorf("step %d has an invalid function name: %q", i+1, step.Function)
+		}
+		if len(step.Timeout) > 0 {
+			if _, err := time.ParseDuration(step.Timeout); err != nil {
+				return fmt.Errorf("step %d has an invalid timeout: %s", i+1, step.Timeout)
+			}
+		}
+	}
+	return nil
+}
+
+// bufferedResponse keeps the response of a step for the next one.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{header: make(http.Header)}
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *bufferedResponse) Write(data []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(data)
+}
+
+// runPipeline calls each step through invoke, the gateway's router, so that steps get the same
+// routing, limits and metrics as other calls. It stops at the first step without a 2xx status
+// and returns the response of the last step run and its index.
+func runPipeline(invoke http.Handler, r *http.Request, steps []requests.PipelineStep, body []byte) (*bufferedResponse, int, []string) {
+	contentType := r.Header.Get("Content-Type")
+	method := r.Method
+
+	var response *bufferedResponse
+	var durations []string
+
+	for i, step := range steps {
+		ctx := r.Context()
+		var cancel context.CancelFunc = func() {}
+		if timeout, err := time.ParseDuration(step.Timeout); err == nil && len(step.Timeout) > 0 {
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+		}
+
+		stepRequest, _ := http.NewRequestWithContext(ctx, method, "/function/"+step.Function, bytes.NewReader(body))
+		copyHeaders(&stepRequest.Header, &r.Header)
+		removeHopHeaders(stepRequest.Header)
+		stepRequest.Header.Del("Content-Length")
+		stepRequest.Header.Del(StartTimeHeader)
+		if len(contentType) > 0 {
+			stepRequest.Header.Set("Content-Type", contentType)
+		}
+		stepRequest.RemoteAddr = r.RemoteAddr
+		stepRequest.Host = r.Host
+
+		start := time.Now()
+		response = newBufferedResponse()
+		invoke.ServeHTTP(response, stepRequest)
+		durations = append(durations, fmt.Sprintf("%s=%f", step.Function, time.Since(start).Seconds()))
+
+		if ctx.Err() == context.DeadlineExceeded && r.Context().Err() == nil {
+			response = newBufferedResponse()
+			response.WriteHeader(http.StatusGatewayTimeout)
+			response.Write([]byte(fmt.Sprintf("Step %d (%s) timed out after %s.", i+1, step.Function, step.Timeout)))
+		}
+		cancel()
+
+		if response.status < 200 || response.status > 299 {
+			return response, i, durations
+		}
+
+		body = response.body.Bytes()
+		contentType = response.header.Get("Content-Type")
+		method = http.MethodPost
+	}
+	return response, len(steps) - 1, durations
+}
+
+// adHocSteps reads a pipeline from the query i.e. ?functions=fetch,resize,upload&timeout=10s
+func adHocSteps(query url.Values) []requests.PipelineStep {
+	var steps []requests.PipelineStep
+	for _, function := range strings.Split(query.Get("functions"), ",") {
+		if function = strings.TrimSpace(function); len(function) > 0 {
+			steps = append(steps, requests.PipelineStep{Function: function, Timeout: query.Get("timeout")})
+		}
+	}
+	return steps
+}
+
+// pipelineSteps finds the steps of a named pipeline or of one given in the query.
+func pipelineSteps(r *http.Request, store PipelineStore) ([]requests.PipelineStep, int, error) {
+	name := mux.Vars(r)["name"]
+	if len(name) == 0 {
+		steps := adHocSteps(r.URL.Query())
+		if err := validateSteps(steps); err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("provide a pipeline name or ?functions=a,b,c: %s", err)
+		}
+		return steps, http.StatusOK, nil
+	}
+
+	pipeline, err := store.Get(name)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if pipeline == nil {
+		return nil, http.StatusNotFound, fmt.Errorf("Cannot find pipeline: %s.", name)
+	}
+	return pipeline.Steps, http.StatusOK, nil
+}
+
+// MakePipelineHandler runs a named pipeline (/pipeline/{name}) or the functions given in the query
+// (/pipeline?functions=a,b,c) and returns the last step's response.
+func MakePipelineHandler(invoke http.Handler, store PipelineStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		steps, status, err := pipelineSteps(r, store)
+		if err != nil {
+			w.WriteHeader(status)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		response, last, durations := runPipeline(invoke, r, steps, body)
+
+		header := w.Header()
+		copyHeaders(&header, &response.header)
+		header.Del("Content-Length")
+		header.Set(PipelineDurationsHeader, strings.Join(durations, ", "))
+		if response.status < 200 || response.status > 299 {
+			header.Set(PipelineFailedStepHeader, fmt.Sprintf("%d:%s", last+1, steps[last].Function))
+		}
+		w.WriteHeader(response.status)
+		w.Write(response.body.Bytes())
+	}
+}
+
+// MakePipelinesHandler lists and saves (GET/POST/PUT /system/pipelines) or reads and deletes
+// (GET/DELETE /system/pipelines/{name}) named pipelines.
+func MakePipelinesHandler(store PipelineStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		name := mux.Vars(r)["name"]
+
+		switch {
+		case r.Method == http.MethodGet && len(name) == 0:
+			pipelines, err := store.List()
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(err.Error()))
+				return
+			}
+			pipelineBytes, _ := json.Marshal(pipelines)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			w.Write(pipelineBytes)
+
+		case r.Method == http.MethodGet:
+			pipeline, err := store.Get(name)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(err.Error()))
+				return
+			}
+			if pipeline == nil {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(fmt.Sprintf("Cannot find pipeline: %s.", name)))
+				return
+			}
+			pipelineBytes, _ := json.Marshal(pipeline)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			w.Write(pipelineBytes)
+
+		case r.Method == http.MethodDelete:
+			if err := store.Delete(name); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(err.Error()))
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+
+		default:
+			body, _ := ioutil.ReadAll(r.Body)
+			pipeline := requests.Pipeline{}
+			if err := json.Unmarshal(body, &pipeline); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(err.Error()))
+				return
+			}
+			if err := validatePipeline(pipeline); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(err.Error()))
+				return
+			}
+			if err := store.Save(pipeline); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(err.Error()))
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}
+	}
+}
+
+// pipelineState travels with an asynchronous pipeline through the queue. Steps holds the step
+// being run followed by those still to run, Step is its index in the pipeline. Nonce is unique
+// to each run so that a step's callback is only taken once.
+type pipelineState struct {
+	Steps     []requests.PipelineStep `json:"steps"`
+	Step      int                     `json:"step"`
+	Nonce     string                  `json:"nonce"`
+	Header    http.Header             `json:"header,omitempty"`
+	Callback  string                  `json:"callback,omitempty"`
+	CallID    string                  `json:"callId,omitempty"`
+	Durations []string                `json:"durations,omitempty"`
+	Queued    int64                   `json:"queued"`
+	Expires   int64                   `json:"expires"`
+}
+
+// PipelineQueue runs pipelines through the queue. Each step calls back to GatewayURL with the
+// pipeline's state, which is signed with Secret so callers can't forge steps.
+type PipelineQueue struct {
+	Queue      queue.CanQueueRequests
+	GatewayURL string
+	Secret     []byte
+	// Expiry is how long the callback of a queued step is accepted, a day when zero.
+	Expiry time.Duration
+
+	mu sync.Mutex
+	// ran holds the steps whose callback was taken until their state expires. It is kept by
+	// each gateway, so with several gateways a callback can only be replayed until it expires.
+	ran map[string]int64
+}
+
+// pipelineHeader is the header every step of a queued pipeline is called with: the caller's
+// own, without hop-by-hop headers or credentials as the state travels in the callback URL.
+func pipelineHeader(header http.Header) http.Header {
+	stepHeader := make(http.Header)
+	copyHeaders(&stepHeader, &header)
+	removeHopHeaders(stepHeader)
+	for _, name := range []string{"Content-Length", "X-Callback-Url", StartTimeHeader, IdempotencyKeyHeader, "Authorization", "Cookie", apiKeyHeader} {
+		stepHeader.Del(name)
+	}
+	return stepHeader
+}
+
+func (p *PipelineQueue) sign(state string) string {
+	mac := hmac.New(sha256.New, p.Secret)
+	mac.Write([]byte(state))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// readState checks the signature of the state in a callback and decodes it.
+func (p *PipelineQueue) readState(query url.Values) (pipelineState, bool) {
+	state := pipelineState{}
+	encoded := query.Get("state")
+	if !hmac.Equal([]byte(p.sign(encoded)), []byte(query.Get("sig"))) {
+		return state, false
+	}
+	stateBytes, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || json.Unmarshal(stateBytes, &state) != nil || len(state.Steps) == 0 {
+		return state, false
+	}
+	if time.Now().UnixNano() > state.Expires {
+		return state, false
+	}
+	return state, true
+}
+
+func stepKey(state pipelineState) string {
+	return state.Nonce + "/" + strconv.Itoa(state.Step)
+}
+
+// claim records that the callback of the state's step has been taken, it returns false when it
+// already was.
+func (p *PipelineQueue) claim(state pipelineState) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now().UnixNano()
+	if p.ran == nil {
+		p.ran = make(map[string]int64)
+	}
+	for key, expires := range p.ran {
+		if now > expires {
+			delete(p.ran, key)
+		}
+	}
+
+	key := stepKey(state)
+	if _, ok := p.ran[key]; ok {
+		return false
+	}
+	p.ran[key] = state.Expires
+	return true
+}
+
+// release lets a step's callback be taken again after it couldn't be handled.
+func (p *PipelineQueue) release(state pipelineState) {
+	p.mu.Lock()
+	delete(p.ran, stepKey(state))
+	p.mu.Unlock()
+}
+
+// queueStep queues the first step in state with the body and its content type, its result is
+// reported to the gateway's pipeline callback which queues the next step.
+func (p *PipelineQueue) queueStep(state pipelineState, contentType string, body []byte) error {
+	expiry := p.Expiry
+	if expiry == 0 {
+		expiry = time.Hour * 24
+	}
+	state.Queued = time.Now().UnixNano()
+	state.Expires = state.Queued + expiry.Nanoseconds()
+	stateBytes, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	callbackURL, err := url.Parse(strings.TrimSuffix(p.GatewayURL, "/") + "/system/pipeline-callback")
+	if err != nil {
+		return err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(stateBytes)
+	callbackURL.RawQuery = url.Values{"state": []string{encoded}, "sig": []string{p.sign(encoded)}}.Encode()
+
+	stepHeader := make(http.Header)
+	copyHeaders(&stepHeader, &state.Header)
+	stepHeader.Del("Content-Type")
+	if len(contentType) > 0 {
+		stepHeader.Set("Content-Type", contentType)
+	}
+	stepHeader.Set(CallIDHeader, state.CallID)
+
+	return p.Queue.Queue(&queue.Request{
+		Function:    state.Steps[0].Function,
+		Body:        body,
+		Method:      http.MethodPost,
+		Header:      stepHeader,
+		CallbackURL: callbackURL,
+	})
+}
+
+// MakeAsyncPipelineHandler queues a pipeline and accepts it straight away, the final response
+// goes to the X-Callback-Url given by the client. Step timeouts don't apply to queued steps, use
+// the com.openfaas.exec_timeout label of each function instead. Steps don't receive the caller's
+// credentials, only the headers set once they were checked.
+func MakeAsyncPipelineHandler(store PipelineStore, pipelineQueue *PipelineQueue, authenticator *Authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		steps, status, err := pipelineSteps(r, store)
+		if err != nil {
+			w.WriteHeader(status)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		// Queued steps don't pass through the gateway's routes, so the caller is checked against
+		// every step up front.
+		if authenticator != nil {
+			for _, step := range steps {
+				if !authenticator.Authorise(w, r, step.Function) {
+					return
+				}
+			}
+		}
+
+		callback := r.Header.Get("X-Callback-Url")
+		if len(callback) > 0 {
+			if _, err := url.Parse(callback); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(err.Error()))
+				return
+			}
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		state := pipelineState{
+			Steps:    steps,
+			Nonce:    newCallID(),
+			Header:   pipelineHeader(r.Header),
+			Callback: callback,
+			CallID:   r.Header.Get(CallIDHeader),
+		}
+		if err := pipelineQueue.queueStep(state, r.Header.Get("Content-Type"), body); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// MakePipelineCallbackHandler receives the result of a queued step, then queues the next step or
+// delivers the result to the client's callback when the pipeline is done or a step failed.
+func MakePipelineCallbackHandler(pipelineQueue *PipelineQueue, client *http.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		state, ok := pipelineQueue.readState(r.URL.Query())
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Invalid pipeline state."))
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		if !pipelineQueue.claim(state) {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte("Pipeline step has already run."))
+			return
+		}
+
+		status := http.StatusOK
+		if functionStatus, err := strconv.Atoi(r.Header.Get("X-Function-Status")); err == nil {
+			status = functionStatus
+		}
+
+		step := state.Steps[0]
+		state.Durations = append(state.Durations, fmt.Sprintf("%s=%f", step.Function, time.Since(time.Unix(0, state.Queued)).Seconds()))
+		done := len(state.Steps) == 1
+		failed := status < 200 || status > 299
+
+		if !done && !failed {
+			next := state
+			next.Steps = state.Steps[1:]
+			next.Step = state.Step + 1
+			if err := pipelineQueue.queueStep(next, r.Header.Get("Content-Type"), body); err != nil {
+				log.Printf("[%s] Unable to queue pipeline step %s: %s", state.CallID, next.Steps[0].Function, err)
+				pipelineQueue.release(state)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+
+		log.Printf("[%s] Pipeline finished at %s with %d", state.CallID, step.Function, status)
+		w.WriteHeader(http.StatusOK)
+
+		if len(state.Callback) == 0 {
+			return
+		}
+
+		req, err := http.NewRequest(http.MethodPost, state.Callback, bytes.NewReader(body))
+		if err != nil {
+			log.Printf("[%s] Invalid pipeline callback: %s", state.CallID, err)
+			return
+		}
+		if contentType := r.Header.Get("Content-Type"); len(contentType) > 0 {
+			req.Header.Set("Content-Type", contentType)
+		}
+		req.Header.Set(CallIDHeader, state.CallID)
+		req.Header.Set("X-Function-Status", strconv.Itoa(status))
+		req.Header.Set(PipelineDurationsHeader, strings.Join(state.Durations, ", "))
+		if failed {
+			req.Header.Set(PipelineFailedStepHeader, step.Function)
+		}
+
+		res, err := client.Do(req)
+		if err != nil {
+			log.Printf("[%s] Unable to deliver pipeline result: %s", state.CallID, err)
+			return
+		}
+		res.Body.Close()
+	}
+}
@@ -5,13 +5,16 @@ package handlers
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"math/rand"
-	"net"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -19,106 +22,125 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/nwright-nz/openfaas-cf-backend/metrics"
+	"github.com/nwright-nz/openfaas-cf-backend/tracing"
 	"github.com/nwright-nz/openfaas-cf-backend/types"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 // MakeProxy creates a proxy for HTTP web requests which can be routed to a function.
-func MakeProxy(metrics metrics.MetricOptions, wildcard bool, client *cfclient.Client, logger *logrus.Logger) http.HandlerFunc {
-	proxyClient := http.Client{
-		Transport: &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-			DialContext: (&net.Dialer{
-				Timeout:   3 * time.Second,
-				KeepAlive: 0,
-			}).DialContext,
-			MaxIdleConns:          1,
-			DisableKeepAlives:     true,
-			IdleConnTimeout:       120 * time.Millisecond,
-			ExpectContinueTimeout: 1500 * time.Millisecond,
-		},
-	}
-
+// When balancer is nil calls go through the function's public route on the gorouter, when
+// splitter is set calls to functions with a traffic policy are spread over their versions.
+// Failed calls are retried and guarded by a circuit breaker as set by each function's labels.
+func MakeProxy(metrics metrics.MetricOptions, wildcard bool, client *cfclient.Client, balancer *InstanceBalancer, splitter *TrafficSplitter, resilience *Resilience, config types.GatewayConfig, proxyClient *http.Client, logger *logrus.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
 
-		if r.Method == "POST" {
-			logger.Infoln(r.Header)
-
-			xfunctionHeader := r.Header["X-Function"]
-			if len(xfunctionHeader) > 0 {
-				logger.Infoln(xfunctionHeader)
-			}
+		callID := r.Header.Get(CallIDHeader)
+		logger.Infof("[%s] %v", callID, r.Header)
 
-			// getServiceName
-			var serviceName string
-			if wildcard {
-				vars := mux.Vars(r)
-				name := vars["name"]
-				serviceName = name
-			} else if len(xfunctionHeader) > 0 {
-				serviceName = xfunctionHeader[0]
-			}
+		xfunctionHeader := r.Header["X-Function"]
+		if len(xfunctionHeader) > 0 {
+			logger.Infof("[%s] %v", callID, xfunctionHeader)
+		}
 
-			if len(serviceName) > 0 {
-				lookupInvoke(w, r, metrics, serviceName, client, logger, &proxyClient)
-			} else {
-				w.WriteHeader(http.StatusBadRequest)
-				w.Write([]byte("Provide an x-function header or valid route /function/function_name."))
-			}
+		// getServiceName
+		var serviceName string
+		if wildcard {
+			vars := mux.Vars(r)
+			name := vars["name"]
+			serviceName = name
+		}
+		if len(serviceName) == 0 && len(xfunctionHeader) > 0 {
+			serviceName = xfunctionHeader[0]
+		}
 
+		if len(serviceName) > 0 {
+			lookupInvoke(w, r, metrics, serviceName, client, balancer, splitter, resilience, config, logger, proxyClient)
 		} else {
-			w.WriteHeader(http.StatusMethodNotAllowed)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Provide an x-function header or valid route /function/function_name."))
 		}
 	}
 }
 
-func lookupInvoke(w http.ResponseWriter, r *http.Request, metrics metrics.MetricOptions, name string, c *cfclient.Client, logger *logrus.Logger, proxyClient *http.Client) {
-	exists, err := lookupSwarmService(name, c)
+func lookupInvoke(w http.ResponseWriter, r *http.Request, metrics metrics.MetricOptions, name string, c *cfclient.Client, balancer *InstanceBalancer, splitter *TrafficSplitter, resilience *Resilience, config types.GatewayConfig, logger *logrus.Logger, proxyClient *http.Client) {
+	ctx, span := tracing.StartSpan(r.Context(), "lookupInvoke", tracing.Internal)
+	defer span.Finish()
+	r = r.WithContext(ctx)
+
+	version := splitter.pick(name, r)
+	span.SetAttribute("faas.function", name)
+	span.SetAttribute("faas.version", version)
+
+	callID := r.Header.Get(CallIDHeader)
+
+	fmt.Printf("[%s] Resolving: '%s'\n", callID, versionedName(name, version))
+	_, lookupSpan := tracing.StartSpan(ctx, "cf.ListAppsByQuery", tracing.Client)
+	exists, err := lookupSwarmService(versionedName(name, version), c)
+	if err != nil {
+		lookupSpan.SetError(err)
+	}
+	lookupSpan.Finish()
 
 	if err != nil || exists == false {
 		if err != nil {
-			logger.Infof("Could not resolve service: %s error: %s.", name, err)
+			logger.Infof("[%s] Could not resolve service: %s error: %s.", callID, versionedName(name, version), err)
 		}
 
 		// TODO: Should record the 404/not found error in Prometheus.
-		writeHead(name, metrics, http.StatusNotFound, w)
-		w.Write([]byte(fmt.Sprintf("Cannot find service: %s.", name)))
+		writeHead(name, version, metrics, http.StatusNotFound, w)
+		w.Write([]byte(fmt.Sprintf("Cannot find service: %s.", versionedName(name, version))))
 	}
 
 	if exists {
-		defer trackTime(time.Now(), metrics, name)
-		requestBody, _ := ioutil.ReadAll(r.Body)
-		invokeService(c, w, r, metrics, name, requestBody, logger, proxyClient)
+		defer trackTime(time.Now(), metrics, name, version)
+
+		if config.MaxRequestBytes > 0 {
+			if r.ContentLength > config.MaxRequestBytes {
+				writeHead(name, version, metrics, http.StatusRequestEntityTooLarge, w)
+				w.Write([]byte(fmt.Sprintf("Request body exceeds the limit of %d bytes.", config.MaxRequestBytes)))
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, config.MaxRequestBytes)
+		}
+
+		invokeService(c, w, r, metrics, name, version, balancer, resilience, config, logger, proxyClient)
 	}
 }
 
 func lookupSwarmService(serviceName string, c *cfclient.Client) (bool, error) {
-	fmt.Printf("Resolving: '%s'\n", serviceName)
-	services, err := c.ListApps()
-	return len(services) > 0, err
+	_, exists, err := findFunctionApp(serviceName, c)
+	return exists, err
 }
 
-func invokeService(c *cfclient.Client, w http.ResponseWriter, r *http.Request, metrics metrics.MetricOptions, service string, requestBody []byte, logger *logrus.Logger, proxyClient *http.Client) {
-	stamp := strconv.FormatInt(time.Now().Unix(), 10)
-	osEnv := types.OsEnv{}
-	readConfig := types.ReadConfig{}
-	config := readConfig.Read(osEnv)
-	defaultOrg, err := c.GetOrgByName(config.CFOrg)
+// findFunctionApp finds the app for a function in any space, constraints may have placed
+// it outside of the default space.
+func findFunctionApp(serviceName string, c *cfclient.Client) (cfclient.App, bool, error) {
+	query := url.Values{}
+	query.Add("q", fmt.Sprintf("name:%s", serviceName))
+	apps, err := c.ListAppsByQuery(query)
 	if err != nil {
-		fmt.Println("there was an error getting the org guid " + err.Error())
+		return cfclient.App{}, false, err
 	}
-	defaultSpace, err := c.GetSpaceByName(config.CFSpace, defaultOrg.Guid)
-	if err != nil {
-		fmt.Println("there was an error getting the space guid " + err.Error())
+
+	for _, app := range apps {
+		if functionProp, _ := app.Environment["function"]; functionProp == "true" {
+			return app, true, nil
+		}
 	}
-	fmt.Println(defaultOrg.Guid, defaultSpace.Guid)
+	return cfclient.App{}, false, nil
+}
+
+// invokeService streams the request body to the function and its response back to the client.
+// Bodies are only buffered when a call can be retried.
+func invokeService(c *cfclient.Client, w http.ResponseWriter, r *http.Request, metrics metrics.MetricOptions, service string, version string, balancer *InstanceBalancer, resilience *Resilience, config types.GatewayConfig, logger *logrus.Logger, proxyClient *http.Client) {
+	callID := r.Header.Get(CallIDHeader)
 
 	defer func(when time.Time) {
 		seconds := time.Since(when).Seconds()
 
-		fmt.Printf("[%s] took %f seconds\n", stamp, seconds)
-		metrics.GatewayFunctionsHistogram.WithLabelValues(service).Observe(seconds)
+		fmt.Printf("[%s] took %f seconds\n", callID, seconds)
+		metrics.GatewayFunctionsHistogram.WithLabelValues(service, version).Observe(seconds)
 	}(time.Now())
 
 	//TODO: inject setting rather than looking up each time.
@@ -129,79 +151,334 @@ func invokeService(c *cfclient.Client, w http.ResponseWriter, r *http.Request, m
 
 	// watchdogPort := 0
 	addr := "0"
-	fmt.Println("*******************  Service name: " + service)
-	application, err := c.AppByName(service, defaultSpace.Guid, defaultOrg.Guid)
+	fmt.Printf("[%s] Service name: %s\n", callID, versionedName(service, version))
+	_, appSpan := tracing.StartSpan(r.Context(), "cf.ListAppsByQuery", tracing.Client)
+	application, _, err := findFunctionApp(versionedName(service, version), c)
 	if err != nil {
-		fmt.Println("Error getting app " + err.Error())
+		appSpan.SetError(err)
+		fmt.Printf("[%s] Error getting app %s\n", callID, err)
+	}
+	appSpan.Finish()
+
+	fmt.Printf("[%s] Image: %s\n", callID, application.DockerImage)
+
+	labels := readLabels(application.Environment)
+	policy := ParseResiliencePolicy(labels)
+	breaker := resilience.breaker(service, version)
+	budget := resilience.budget(service, version)
+
+	// The call ends when the client goes away or the function's exec timeout passes.
+	ctx := r.Context()
+	timeout := callTimeout(r, labels)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
 	}
 
-	fmt.Println(application.DockerImage)
-	services, err := c.GetAppRoutes(application.Guid)
+	limiter := resilience.limiter(service, version)
+	if err := limiter.Acquire(ctx, policy.MaxInflight, policy.MaxQueue, policy.QueueTimeout); err != nil {
+		if r.Context().Err() != nil {
+			logger.Infof("[%s] Client went away waiting for %s: %s", callID, service, err)
+			return
+		}
+		if err == context.DeadlineExceeded {
+			metrics.GatewayFunctionTimeouts.WithLabelValues(service, version).Inc()
+			writeHead(service, version, metrics, http.StatusGatewayTimeout, w)
+			w.Write([]byte(fmt.Sprintf("Function %s timed out after %s waiting for a free slot.", service, timeout)))
+			return
+		}
+		w.Header().Set("Retry-After", "1")
+		writeHead(service, version, metrics, http.StatusTooManyRequests, w)
+		w.Write([]byte(fmt.Sprintf("Too many calls to service: %s, %s.", service, err)))
+		return
+	}
+	defer limiter.Release()
 
-	if err != nil {
-		fmt.Println("error getting route : " + err.Error())
+	if allowed, wait := breaker.Allow(); !allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait/time.Second)+1))
+		writeHead(service, version, metrics, http.StatusServiceUnavailable, w)
+		w.Write([]byte("Circuit breaker open for service: " + service))
+		return
+	}
+	budget.call()
+
+	// Only a body which is empty or small enough to buffer can be sent again.
+	attempts := policy.Attempts
+	var body []byte
+	if attempts > 1 {
+		if r.ContentLength > 0 && r.ContentLength <= maxRetryBodyBytes {
+			body, err = ioutil.ReadAll(r.Body)
+			if err != nil {
+				breaker.Cancel()
+				if isRequestTooLarge(err) {
+					writeHead(service, version, metrics, http.StatusRequestEntityTooLarge, w)
+					w.Write([]byte(fmt.Sprintf("Request body exceeds the limit of %d bytes.", config.MaxRequestBytes)))
+					return
+				}
+				writeHead(service, version, metrics, http.StatusBadRequest, w)
+				w.Write([]byte("Unable to read request body: " + err.Error()))
+				return
+			}
+		} else if r.ContentLength != 0 {
+			attempts = 1
+		}
 	}
-	fmt.Println("route number: " + string(len(services)))
-	for _, service := range services {
 
-		// info, err := service.Info()
-		// if err != nil {
-		// 	fmt.Println(err)
-		// }
-		//watchdogPort, _ = strconv.Atoi(os.Getenv("PORT"))
+	if balancer == nil {
+		_, routesSpan := tracing.StartSpan(r.Context(), "cf.GetAppRoutes", tracing.Client)
+		services, err := c.GetAppRoutes(application.Guid)
+
+		if err != nil {
+			routesSpan.SetError(err)
+			fmt.Printf("[%s] error getting route : %s\n", callID, err)
+		}
+		routesSpan.Finish()
+		fmt.Printf("[%s] route number: %d\n", callID, len(services))
+		for _, service := range services {
+
+			// info, err := service.Info()
+			// if err != nil {
+			// 	fmt.Println(err)
+			// }
+			//watchdogPort, _ = strconv.Atoi(os.Getenv("PORT"))
 
-		addr = service.Host + ".bosh-lite.com" // need to figure out how to get the domain from the host
+			addr = service.Host + ".bosh-lite.com" // need to figure out how to get the domain from the host
 
-		log.Printf("Route detected: " + addr)
+			log.Printf("[%s] Route detected: %s", callID, addr)
+		}
 	}
 
-	// Use DNS-RR via tasks.servicename if enabled as override, otherwise VIP.
-	// if dnsrr {
-	// 	entries, lookupErr := net.LookupIP(fmt.Sprintf("tasks.%s", service))
-	// 	if lookupErr == nil && len(entries) > 0 {
-	// 		index := randomInt(0, len(entries))
-	// 		addr = entries[index].String()
-	// 	}
-	// }
-	url := fmt.Sprintf("http://%s/", addr)
+	var endpoint *Endpoint
+	var response *http.Response
+	for attempt := 1; ; attempt++ {
+		if balancer != nil {
+			endpoint, err = balancer.Acquire(application)
+			if err != nil {
+				breaker.Failure(policy.BreakerFailures, policy.BreakerOpen)
+				logger.Infof("[%s] Could not find instances of service: %s error: %s.", callID, service, err)
+				writeHead(service, version, metrics, http.StatusServiceUnavailable, w)
+				w.Write([]byte("No instances available for service: " + service))
+				return
+			}
+			addr = endpoint.Address
+		}
+
+		// Use DNS-RR via tasks.servicename if enabled as override, otherwise VIP.
+		// if dnsrr {
+		// 	entries, lookupErr := net.LookupIP(fmt.Sprintf("tasks.%s", service))
+		// 	if lookupErr == nil && len(entries) > 0 {
+		// 		index := randomInt(0, len(entries))
+		// 		addr = entries[index].String()
+		// 	}
+		// }
+		url := fmt.Sprintf("http://%s%s", addr, upstreamPath(r.URL.EscapedPath(), service))
+		if len(r.URL.RawQuery) > 0 {
+			url += "?" + r.URL.RawQuery
+		}
 
-	contentType := r.Header.Get("Content-Type")
-	fmt.Printf("[%s] Forwarding request [%s] to: %s\n", stamp, contentType, url)
+		contentType := r.Header.Get("Content-Type")
+		fmt.Printf("[%s] Forwarding request %s [%s] to: %s\n", callID, r.Method, contentType, url)
 
-	request, err := http.NewRequest("POST", url, bytes.NewReader(requestBody))
+		var requestBody io.Reader = r.Body
+		if body != nil {
+			requestBody = bytes.NewReader(body)
+		}
+
+		request, err := http.NewRequestWithContext(ctx, r.Method, url, requestBody)
+		if err != nil {
+			breaker.Cancel()
+			if endpoint != nil {
+				balancer.Release(endpoint, false)
+			}
+			writeHead(service, version, metrics, http.StatusInternalServerError, w)
+			w.Write([]byte(err.Error()))
+			return
+		}
 
-	copyHeaders(&request.Header, &r.Header)
+		// A known length is sent as-is, otherwise the body is streamed with chunked encoding.
+		request.ContentLength = r.ContentLength
 
-	defer request.Body.Close()
+		copyHeaders(&request.Header, &r.Header)
+		removeHopHeaders(request.Header)
+		addForwardedHeaders(request.Header, r)
+		request.Header.Del(ExecTimeoutHeader)
 
-	response, err := proxyClient.Do(request)
-	if err != nil {
-		logger.Infoln(err)
-		writeHead(service, metrics, http.StatusInternalServerError, w)
+		// Upgrade is hop-by-hop, so the request to switch protocols is made again to the function.
+		if isUpgrade(r) {
+			request.Header.Set("Connection", "Upgrade")
+			request.Header.Set("Upgrade", r.Header.Get("Upgrade"))
+		}
+
+		_, callSpan := tracing.StartSpan(ctx, "call "+versionedName(service, version), tracing.Client)
+		callSpan.SetAttribute("http.method", r.Method)
+		callSpan.SetAttribute("http.url", url)
+		callSpan.SetAttribute("faas.attempt", strconv.Itoa(attempt))
+		callSpan.Inject(request.Header)
+
+		response, err = proxyClient.Do(request)
+		if err == nil {
+			callSpan.SetAttribute("http.status_code", strconv.Itoa(response.StatusCode))
+			defer callSpan.Finish()
+			break
+		}
+		callSpan.SetError(err)
+		callSpan.Finish()
+
+		if isRequestTooLarge(err) {
+			breaker.Success()
+			if endpoint != nil {
+				balancer.Release(endpoint, false)
+			}
+			writeHead(service, version, metrics, http.StatusRequestEntityTooLarge, w)
+			w.Write([]byte(fmt.Sprintf("Request body exceeds the limit of %d bytes.", config.MaxRequestBytes)))
+			return
+		}
+
+		if ctx.Err() != nil {
+			if endpoint != nil {
+				balancer.Release(endpoint, false)
+			}
+			handleCancelledCall(ctx, r, w, metrics, service, version, timeout, breaker, policy, logger)
+			return
+		}
+
+		if endpoint != nil {
+			balancer.Release(endpoint, true)
+		}
+		logger.Infof("[%s] %s", callID, err)
+
+		if attempt < attempts && isRetryable(r.Method, err) && budget.withdraw(policy.Budget) {
+			backoff := policy.BackoffFor(attempt)
+			logger.Infof("[%s] Retrying %s in %s, attempt %d of %d", callID, service, backoff, attempt+1, attempts)
+			if waitForRetry(ctx, backoff) {
+				continue
+			}
+			handleCancelledCall(ctx, r, w, metrics, service, version, timeout, breaker, policy, logger)
+			return
+		}
+
+		breaker.Failure(policy.BreakerFailures, policy.BreakerOpen)
+		writeHead(service, version, metrics, http.StatusInternalServerError, w)
 		buf := bytes.NewBufferString("Can't reach service: " + service)
 		w.Write(buf.Bytes())
 		return
 	}
+	defer response.Body.Close()
+
+	if endpoint != nil {
+		defer balancer.Release(endpoint, false)
+	}
 
-	responseBody, readErr := ioutil.ReadAll(response.Body)
-	if readErr != nil {
-		fmt.Println(readErr)
+	switch response.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		breaker.Failure(policy.BreakerFailures, policy.BreakerOpen)
+	default:
+		breaker.Success()
+	}
 
-		writeHead(service, metrics, http.StatusInternalServerError, w)
-		buf := bytes.NewBufferString("Error reading response from service: " + service)
-		w.Write(buf.Bytes())
+	if response.StatusCode == http.StatusSwitchingProtocols {
+		trackInvocation(service, version, metrics, response.StatusCode)
+
+		connected := time.Now()
+		err := tunnel(ctx, w, response)
+		metrics.GatewayConnectionSeconds.WithLabelValues(service, version, "websocket").Observe(time.Since(connected).Seconds())
+
+		if ctx.Err() == context.DeadlineExceeded {
+			metrics.GatewayFunctionTimeouts.WithLabelValues(service, version).Inc()
+		}
+		logger.Infof("[%s] Connection to %s closed: %v", callID, service, err)
+		return
+	}
+
+	if config.MaxResponseBytes > 0 && response.ContentLength > config.MaxResponseBytes {
+		writeHead(service, version, metrics, http.StatusBadGateway, w)
+		w.Write([]byte(fmt.Sprintf("Response from service: %s exceeds the limit of %d bytes.", service, config.MaxResponseBytes)))
 		return
 	}
 
 	clientHeader := w.Header()
 	copyHeaders(&clientHeader, &response.Header)
+	removeHopHeaders(clientHeader)
 
-	// TODO: copyHeaders removes the need for this line - test removal.
-	// Match header for strict services
-	w.Header().Set("Content-Type", r.Header.Get("Content-Type"))
+	// Event streams stay open past the server's write timeout, bounded by the exec timeout instead.
+	eventStream := isEventStream(response.Header)
+	if eventStream {
+		if err := clearWriteDeadline(w); err != nil {
+			logger.Infof("[%s] Unable to lift write timeout for event stream from %s: %s", callID, service, err)
+		}
+		defer func(connected time.Time) {
+			metrics.GatewayConnectionSeconds.WithLabelValues(service, version, "sse").Observe(time.Since(connected).Seconds())
+		}(time.Now())
+	}
+
+	writeHead(service, version, metrics, response.StatusCode, w)
+
+	if _, err := copyResponse(w, response.Body, config.MaxResponseBytes); err != nil {
+		logger.Infof("[%s] Response from %s interrupted: %s", callID, service, err)
+
+		if ctx.Err() == context.DeadlineExceeded && r.Context().Err() == nil {
+			metrics.GatewayFunctionTimeouts.WithLabelValues(service, version).Inc()
+		}
+
+		// The status has gone out, aborting is the only way to tell the client the body is incomplete.
+		if err == errResponseTooLarge || ctx.Err() != nil {
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
+
+// handleCancelledCall answers a call which ended before the function responded, either with a
+// 504 for the exec timeout or not at all when the client disconnected.
+func handleCancelledCall(ctx context.Context, r *http.Request, w http.ResponseWriter, metrics metrics.MetricOptions, service string, version string, timeout time.Duration, breaker *CircuitBreaker, policy ResiliencePolicy, logger *logrus.Logger) {
+	if r.Context().Err() != nil {
+		breaker.Cancel()
+		logger.Infof("[%s] Client went away during call to %s: %s", r.Header.Get(CallIDHeader), service, r.Context().Err())
+		return
+	}
 
-	writeHead(service, metrics, http.StatusOK, w)
-	w.Write(responseBody)
+	breaker.Failure(policy.BreakerFailures, policy.BreakerOpen)
+	metrics.GatewayFunctionTimeouts.WithLabelValues(service, version).Inc()
+	writeHead(service, version, metrics, http.StatusGatewayTimeout, w)
+	w.Write([]byte(fmt.Sprintf("Function %s timed out after %s.", service, timeout)))
+}
+
+// upstreamPath is the part of the path after /function/{name}, which is passed on to the function.
+func upstreamPath(path string, service string) string {
+	prefix := "/function/" + service
+	if strings.HasPrefix(path, prefix+"/") {
+		return path[len(prefix):]
+	}
+	if path == prefix {
+		return "/"
+	}
+	return path
+}
+
+// hopHeaders only apply to a single connection so aren't forwarded, see RFC 7230 section 6.1.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func removeHopHeaders(header http.Header) {
+	for _, connection := range header["Connection"] {
+		for _, name := range strings.Split(connection, ",") {
+			if name = strings.TrimSpace(name); len(name) > 0 {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
 }
 
 func copyHeaders(destination *http.Header, source *http.Header) {
@@ -217,17 +494,17 @@ func randomInt(min, max int) int {
 	return rand.Intn(max-min) + min
 }
 
-func writeHead(service string, metrics metrics.MetricOptions, code int, w http.ResponseWriter) {
+func writeHead(service string, version string, metrics metrics.MetricOptions, code int, w http.ResponseWriter) {
 	w.WriteHeader(code)
 
-	trackInvocation(service, metrics, code)
+	trackInvocation(service, version, metrics, code)
 }
 
-func trackInvocation(service string, metrics metrics.MetricOptions, code int) {
-	metrics.GatewayFunctionInvocation.With(prometheus.Labels{"function_name": service, "code": strconv.Itoa(code)}).Inc()
+func trackInvocation(service string, version string, metrics metrics.MetricOptions, code int) {
+	metrics.GatewayFunctionInvocation.With(prometheus.Labels{"function_name": service, "code": strconv.Itoa(code), "version": version}).Inc()
 }
 
-func trackTime(then time.Time, metrics metrics.MetricOptions, name string) {
+func trackTime(then time.Time, metrics metrics.MetricOptions, name string, version string) {
 	since := time.Since(then)
-	metrics.GatewayFunctionsHistogram.WithLabelValues(name).Observe(since.Seconds())
+	metrics.GatewayFunctionsHistogram.WithLabelValues(name, version).Observe(since.Seconds())
 }
@@ -10,9 +10,10 @@ import (
 	"net/url"
 
 	"github.com/Sirupsen/logrus"
-	"github.com/alexellis/faas/gateway/queue"
 	"github.com/gorilla/mux"
 	"github.com/nwright-nz/openfaas-cf-backend/metrics"
+	"github.com/nwright-nz/openfaas-cf-backend/queue"
+	"github.com/nwright-nz/openfaas-cf-backend/tracing"
 )
 
 // MakeQueuedProxy accepts work onto a queue
@@ -44,22 +45,37 @@ func MakeQueuedProxy(metrics metrics.MetricOptions, wildcard bool, logger *logru
 
 			callbackURL = urlVal
 		}
+
+		// The header carries the call ID so the invocation can be traced through the queue.
+		header := make(http.Header)
+		copyHeaders(&header, &r.Header)
+		removeHopHeaders(header)
+		addForwardedHeaders(header, r)
+
+		_, span := tracing.StartSpan(r.Context(), "queue.publish "+name, tracing.Producer)
+		span.SetAttribute("faas.function", name)
+		span.Inject(header)
+		defer span.Finish()
+
 		req := &queue.Request{
 			Function:    name,
 			Body:        body,
 			Method:      r.Method,
 			QueryString: r.URL.RawQuery,
-			Header:      r.Header,
+			Header:      header,
 			CallbackURL: callbackURL,
 		}
 
+		callID := r.Header.Get(CallIDHeader)
 		err = canQueueRequests.Queue(req)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte(err.Error()))
-			fmt.Println(err)
+			span.SetError(err)
+			fmt.Printf("[%s] %s\n", callID, err)
 			return
 		}
+		logger.Infof("[%s] Queued call to %s", callID, name)
 		w.WriteHeader(http.StatusAccepted)
 
 	}
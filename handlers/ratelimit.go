@@ -0,0 +1,192 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nwright-nz/openfaas-cf-backend/metrics"
+)
+
+// Labels which rate limit calls to a function.
+const (
+	// RateLimitRateLabel is the sustained rate in calls per second, no limit when unset.
+	RateLimitRateLabel = "com.openfaas.ratelimit.rate"
+	// RateLimitBurstLabel is the bucket size, defaults to one second of calls.
+	RateLimitBurstLabel = "com.openfaas.ratelimit.burst"
+	// RateLimitKeyLabel picks who is limited: ip (default), apikey or header:<name>. apikey needs
+	// the function's auth policy to check the key, other callers are limited by IP.
+	RateLimitKeyLabel = "com.openfaas.ratelimit.key"
+)
+
+// apiKeyHeader carries the caller's API key.
+const apiKeyHeader = "X-API-Key"
+
+// RateLimitResult is the outcome of taking a token from a bucket.
+type RateLimitResult struct {
+	Allowed   bool
+	Remaining int
+	// Reset is how long until the bucket is full again.
+	Reset time.Duration
+	// RetryAfter is how long until the next token when the call isn't allowed.
+	RetryAfter time.Duration
+}
+
+// RateLimitStore keeps token buckets, it can be backed by memory or a store shared by gateways.
+type RateLimitStore interface {
+	// Take removes a token from the bucket for key, which refills at rate tokens per second
+	// up to burst tokens.
+	Take(key string, rate float64, burst int) (RateLimitResult, error)
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+	rate    float64
+	burst   int
+}
+
+// MemoryRateLimitStore keeps token buckets in the gateway's memory.
+type MemoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	takes   int
+
+	// Now returns the current time, tests replace it to move the clock.
+	Now func() time.Time
+}
+
+// NewMemoryRateLimitStore creates an empty MemoryRateLimitStore.
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{
+		buckets: make(map[string]*tokenBucket),
+		Now:     time.Now,
+	}
+}
+
+// Take implements RateLimitStore.
+func (s *MemoryRateLimitStore) Take(key string, rate float64, burst int) (RateLimitResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.Now()
+	bucket, ok := s.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(burst), updated: now}
+		s.buckets[key] = bucket
+	}
+	bucket.rate = rate
+	bucket.burst = burst
+
+	bucket.tokens = math.Min(float64(burst), bucket.tokens+now.Sub(bucket.updated).Seconds()*rate)
+	bucket.updated = now
+
+	result := RateLimitResult{}
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = secondsToDuration((1 - bucket.tokens) / rate)
+	}
+	result.Remaining = int(bucket.tokens)
+	result.Reset = secondsToDuration((float64(burst) - bucket.tokens) / rate)
+
+	s.takes++
+	if s.takes%1024 == 0 {
+		s.sweep(now)
+	}
+
+	return result, nil
+}
+
+// sweep drops buckets which have been idle long enough to have refilled at their own rate, a
+// full bucket is the same as a new one.
+func (s *MemoryRateLimitStore) sweep(now time.Time) {
+	for key, bucket := range s.buckets {
+		if bucket.tokens+now.Sub(bucket.updated).Seconds()*bucket.rate >= float64(bucket.burst) {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// FunctionLabelLookup returns the labels of a function by name.
+type FunctionLabelLookup func(name string) (map[string]string, error)
+
+// MakeRateLimitHandler rejects calls with 429 once the caller has used up the rate set by the
+// function's labels, other calls go on to next.
+func MakeRateLimitHandler(next http.HandlerFunc, lookup FunctionLabelLookup, store RateLimitStore, metricsOptions metrics.MetricOptions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+		if len(name) == 0 {
+			name = r.Header.Get("X-Function")
+		}
+		if len(name) == 0 {
+			next(w, r)
+			return
+		}
+
+		labels, err := lookup(name)
+		if err != nil {
+			log.Printf("Unable to read labels of %s, not rate limiting: %s", name, err)
+			next(w, r)
+			return
+		}
+
+		rate := labelFloat(labels, RateLimitRateLabel, 0)
+		if rate == 0 {
+			next(w, r)
+			return
+		}
+		burst := labelInt(labels, RateLimitBurstLabel, int(math.Ceil(rate)))
+		if burst == 0 {
+			burst = 1
+		}
+
+		key := name + "/" + rateLimitKey(r, labels[RateLimitKeyLabel])
+		result, err := store.Take(key, rate, burst)
+		if err != nil {
+			log.Printf("Rate limit store unavailable for %s, not rate limiting: %s", name, err)
+			next(w, r)
+			return
+		}
+
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(burst))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		w.Header().Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(result.Reset.Seconds()))))
+
+		if !result.Allowed {
+			metricsOptions.GatewayRateLimited.WithLabelValues(name).Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(result.RetryAfter.Seconds()))))
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(fmt.Sprintf("Rate limit exceeded for function: %s.", name)))
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// rateLimitKey identifies the caller, by client IP unless the function keys on an API key or header.
+func rateLimitKey(r *http.Request, keyBy string) string {
+	switch {
+	case keyBy == "apikey":
+		// The ID is only set once the key has been checked.
+		if keyID := r.Header.Get(apiKeyIDHeader); len(keyID) > 0 {
+			return "apikey:" + keyID
+		}
+	case strings.HasPrefix(keyBy, "header:"):
+		header := strings.TrimPrefix(keyBy, "header:")
+		return "header:" + r.Header.Get(header)
+	}
+	return "ip:" + clientIP(r)
+}
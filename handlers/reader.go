@@ -24,6 +24,16 @@ func MakeFunctionReader(metricsOptions metrics.MetricOptions, c *cfclient.Client
 			fmt.Println(err)
 		}
 
+		constraints, err := listAppAnnotation(c, constraintsAnnotation)
+		if err != nil {
+			log.Println("Unable to read function constraints: ", err)
+		}
+
+		versions, err := listAppLabel(c, versionLabel)
+		if err != nil {
+			log.Println("Unable to read function versions: ", err)
+		}
+
 		// TODO: Filter only "faas" functions (via metadata?)
 		var functions []requests.Function
 
@@ -40,6 +50,9 @@ func MakeFunctionReader(metricsOptions metrics.MetricOptions, c *cfclient.Client
 					Image:           imageName,
 					InvocationCount: 0,
 					Replicas:        uint64(service.Instances),
+					Constraints:     readConstraints(constraints[service.Guid]),
+					Version:         versions[service.Guid],
+					Labels:          readLabels(service.Environment),
 					//EnvProcess:      envProcess.(string),
 				}
 
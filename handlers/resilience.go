@@ -0,0 +1,314 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/nwright-nz/openfaas-cf-backend/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Labels which tune retries and the circuit breaker of a function.
+const (
+	RetryAttemptsLabel   = "com.openfaas.retry.attempts"
+	RetryBackoffLabel    = "com.openfaas.retry.backoff"
+	RetryMaxBackoffLabel = "com.openfaas.retry.max_backoff"
+	RetryBudgetLabel     = "com.openfaas.retry.budget"
+	BreakerFailuresLabel = "com.openfaas.breaker.failures"
+	BreakerOpenLabel     = "com.openfaas.breaker.open"
+	MaxInflightLabel     = "com.openfaas.max_inflight"
+	MaxQueueLabel        = "com.openfaas.max_queue"
+	QueueTimeoutLabel    = "com.openfaas.queue_timeout"
+)
+
+// maxRetryBodyBytes is the largest request body buffered so that it can be sent again.
+const maxRetryBodyBytes = 1024 * 1024
+
+// ResiliencePolicy is how calls to a function are retried and when its breaker opens.
+type ResiliencePolicy struct {
+	// Attempts is the total number of tries for a call, 1 disables retries.
+	Attempts int
+	// Backoff before the first retry, doubled for each retry up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Budget is the percentage of calls which may be retried.
+	Budget int
+
+	// BreakerFailures is the number of consecutive failures which opens the breaker, 0 disables it.
+	BreakerFailures int
+	// BreakerOpen is how long the breaker stays open before a probe call is let through.
+	BreakerOpen time.Duration
+
+	// MaxInflight caps the calls in progress, 0 is no limit. Up to MaxQueue more calls wait
+	// for QueueTimeout before being turned away.
+	MaxInflight  int
+	MaxQueue     int
+	QueueTimeout time.Duration
+}
+
+// ParseResiliencePolicy reads a policy from function labels, missing labels take the defaults.
+// Retries and the breaker are off unless the function opts in with the retry and breaker labels.
+func ParseResiliencePolicy(labels map[string]string) ResiliencePolicy {
+	return ResiliencePolicy{
+		Attempts:        labelInt(labels, RetryAttemptsLabel, 1),
+		Backoff:         labelDuration(labels, RetryBackoffLabel, 100*time.Millisecond),
+		MaxBackoff:      labelDuration(labels, RetryMaxBackoffLabel, 2*time.Second),
+		Budget:          labelInt(labels, RetryBudgetLabel, 20),
+		BreakerFailures: labelInt(labels, BreakerFailuresLabel, 0),
+		BreakerOpen:     labelDuration(labels, BreakerOpenLabel, 30*time.Second),
+		MaxInflight:     labelInt(labels, MaxInflightLabel, 0),
+		MaxQueue:        labelInt(labels, MaxQueueLabel, 0),
+		QueueTimeout:    labelDuration(labels, QueueTimeoutLabel, 5*time.Second),
+	}
+}
+
+// BackoffFor returns the wait before the given retry, counting from 1.
+func (p ResiliencePolicy) BackoffFor(retry int) time.Duration {
+	backoff := p.Backoff
+	for i := 1; i < retry && backoff < p.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > p.MaxBackoff {
+		return p.MaxBackoff
+	}
+	return backoff
+}
+
+// isRetryable decides whether a failed call can be sent again. Connection refused means the
+// function never saw the request, other errors are only retried for idempotent methods.
+func isRetryable(method string, err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// Breaker states, also the value of the state gauge.
+const (
+	BreakerClosed   = 0
+	BreakerOpen     = 1
+	BreakerHalfOpen = 2
+)
+
+// CircuitBreaker stops calls to a function after consecutive failures, once open it waits
+// before letting a single probe call through to decide whether to close again.
+type CircuitBreaker struct {
+	mu        sync.Mutex
+	state     int
+	failures  int
+	openUntil time.Time
+	probing   bool
+	gauge     prometheus.Gauge
+}
+
+// NewCircuitBreaker creates a closed breaker, gauge may be nil.
+func NewCircuitBreaker(gauge prometheus.Gauge) *CircuitBreaker {
+	breaker := &CircuitBreaker{gauge: gauge}
+	breaker.setState(BreakerClosed)
+	return breaker
+}
+
+// State returns one of BreakerClosed, BreakerOpen or BreakerHalfOpen.
+func (b *CircuitBreaker) State() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Allow reports whether a call may go ahead, when it can't it returns how long until the next probe.
+// Every allowed call must be followed by Success, Failure or Cancel.
+func (b *CircuitBreaker) Allow() (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if wait := time.Until(b.openUntil); wait > 0 {
+			return false, wait
+		}
+		b.setState(BreakerHalfOpen)
+		b.probing = true
+		return true, 0
+	case BreakerHalfOpen:
+		if b.probing {
+			return false, time.Second
+		}
+		b.probing = true
+		return true, 0
+	}
+	return true, 0
+}
+
+// Success records a call which reached the function and closes the breaker.
+func (b *CircuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	b.probing = false
+	if b.state != BreakerClosed {
+		b.setState(BreakerClosed)
+	}
+}
+
+// Failure records a failed call, the breaker opens for openFor after threshold consecutive
+// failures or when a probe fails. A threshold of 0 never opens it.
+func (b *CircuitBreaker) Failure(threshold int, openFor time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.probing = false
+	if threshold == 0 {
+		return
+	}
+	if b.state == BreakerHalfOpen || b.failures >= threshold {
+		b.openUntil = time.Now().Add(openFor)
+		b.setState(BreakerOpen)
+	}
+}
+
+// Cancel releases an allowed call whose outcome says nothing about the function.
+func (b *CircuitBreaker) Cancel() {
+	b.mu.Lock()
+	b.probing = false
+	b.mu.Unlock()
+}
+
+func (b *CircuitBreaker) setState(state int) {
+	b.state = state
+	if b.gauge != nil {
+		b.gauge.Set(float64(state))
+	}
+}
+
+// retryBudget limits retries to a share of the calls to a function within a window, so that
+// retries can't multiply the load on a function which is already failing.
+type retryBudget struct {
+	mu      sync.Mutex
+	started time.Time
+	calls   int
+	retries int
+}
+
+const (
+	retryBudgetWindow = 10 * time.Second
+	// minRetries are allowed per window whatever the budget, so that quiet functions still retry.
+	minRetries = 3
+)
+
+func (b *retryBudget) call() {
+	b.mu.Lock()
+	b.roll()
+	b.calls++
+	b.mu.Unlock()
+}
+
+func (b *retryBudget) withdraw(percent int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.roll()
+	if b.retries >= minRetries+b.calls*percent/100 {
+		return false
+	}
+	b.retries++
+	return true
+}
+
+func (b *retryBudget) roll() {
+	if time.Since(b.started) > retryBudgetWindow {
+		b.started = time.Now()
+		b.calls = 0
+		b.retries = 0
+	}
+}
+
+// Resilience keeps the circuit breaker, retry budget and concurrency limiter of each function version.
+type Resilience struct {
+	metrics metrics.MetricOptions
+
+	mu       sync.Mutex
+	breakers map[string]*CircuitBreaker
+	budgets  map[string]*retryBudget
+	limiters map[string]*ConcurrencyLimiter
+}
+
+// NewResilience creates breakers which report their state through metricsOptions.
+func NewResilience(metricsOptions metrics.MetricOptions) *Resilience {
+	return &Resilience{
+		metrics:  metricsOptions,
+		breakers: make(map[string]*CircuitBreaker),
+		budgets:  make(map[string]*retryBudget),
+		limiters: make(map[string]*ConcurrencyLimiter),
+	}
+}
+
+func (r *Resilience) breaker(service string, version string) *CircuitBreaker {
+	key := versionedName(service, version)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	breaker, ok := r.breakers[key]
+	if !ok {
+		breaker = NewCircuitBreaker(r.metrics.GatewayCircuitBreakerState.WithLabelValues(service, version))
+		r.breakers[key] = breaker
+	}
+	return breaker
+}
+
+func (r *Resilience) budget(service string, version string) *retryBudget {
+	key := versionedName(service, version)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	budget, ok := r.budgets[key]
+	if !ok {
+		budget = &retryBudget{started: time.Now()}
+		r.budgets[key] = budget
+	}
+	return budget
+}
+
+func (r *Resilience) limiter(service string, version string) *ConcurrencyLimiter {
+	key := versionedName(service, version)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	limiter, ok := r.limiters[key]
+	if !ok {
+		limiter = NewConcurrencyLimiter(
+			r.metrics.GatewayFunctionInflight.WithLabelValues(service, version),
+			r.metrics.GatewayFunctionQueued.WithLabelValues(service, version),
+		)
+		r.limiters[key] = limiter
+	}
+	return limiter
+}
+
+// waitForRetry sleeps for backoff, false when the call was cancelled or timed out first.
+func waitForRetry(ctx context.Context, backoff time.Duration) bool {
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	cfclient "github.com/nwright-nz/go-cfclient"
+	"github.com/nwright-nz/openfaas-cf-backend/metrics"
+	"github.com/nwright-nz/openfaas-cf-backend/requests"
+)
+
+const (
+	// envRefAnnotation is the GUID of the user-provided service instance holding the environment a
+	// droplet was deployed with.
+	envRefAnnotation = "openfaas.env-ref"
+	// envHashAnnotation is the SHA-256 of that environment.
+	envHashAnnotation = "openfaas.env-sha256"
+)
+
+// snapshotEnvironment records the environment of a deployment against its droplet so that a
+// rollback restores configuration as well as the image. Annotations are small and readable by
+// anyone who can see the droplet, so the environment is kept as the credentials of a
+// user-provided service instance and the droplet only refers to it.
+func snapshotEnvironment(c *cfclient.Client, appName string, spaceGUID string, dropletGUID string, snapshot map[string]string) error {
+	snapshotBytes, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	hash := hashEnvironment(snapshotBytes)
+
+	// Deployments with the same environment share a snapshot.
+	instanceGUID, err := saveUserProvidedCredentials(c, spaceGUID, "openfaas-env-"+appName+"-"+hash[:16], snapshot)
+	if err != nil {
+		return err
+	}
+
+	return annotateDroplet(c, dropletGUID, map[string]string{
+		envRefAnnotation:  instanceGUID,
+		envHashAnnotation: hash,
+	})
+}
+
+func hashEnvironment(snapshot []byte) string {
+	sum := sha256.Sum256(snapshot)
+	return hex.EncodeToString(sum[:])
+}
+
+// MakeRevisionsHandler lists the droplets of a function, newest first.
+func MakeRevisionsHandler(metricsOptions metrics.MetricOptions, c *cfclient.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+
+		app, exists, err := findFunctionApp(name, c)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(fmt.Sprintf("Cannot find service: %s.", name)))
+			return
+		}
+
+		droplets, err := listAppDroplets(c, app.Guid)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		current, err := currentDropletGUID(c, app.Guid)
+		if err != nil {
+			log.Printf("Unable to find current droplet of %s: %s", name, err)
+		}
+
+		revisions := []requests.FunctionRevision{}
+		for _, droplet := range droplets {
+			if droplet.State != "STAGED" {
+				continue
+			}
+			revisions = append(revisions, requests.FunctionRevision{
+				Revision:  droplet.GUID,
+				Image:     droplet.Image,
+				CreatedAt: droplet.CreatedAt,
+				EnvHash:   droplet.Metadata.Annotations[envHashAnnotation],
+				Current:   droplet.GUID == current,
+			})
+		}
+
+		revisionBytes, _ := json.Marshal(revisions)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(revisionBytes)
+	}
+}
+
+// MakeRollbackHandler points a function back at an earlier droplet and its environment, then
+// restarts it without staging.
+func MakeRollbackHandler(metricsOptions metrics.MetricOptions, c *cfclient.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+		revision := r.URL.Query().Get("revision")
+		if len(revision) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Provide the revision to roll back to i.e. ?revision=<droplet guid>"))
+			return
+		}
+
+		app, exists, err := findFunctionApp(name, c)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(fmt.Sprintf("Cannot find service: %s.", name)))
+			return
+		}
+
+		droplets, err := listAppDroplets(c, app.Guid)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		var target *Droplet
+		for i := range droplets {
+			if droplets[i].GUID == revision && droplets[i].State == "STAGED" {
+				target = &droplets[i]
+			}
+		}
+		if target == nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(fmt.Sprintf("No revision %s for function: %s.", revision, name)))
+			return
+		}
+
+		if instanceGUID, ok := target.Metadata.Annotations[envRefAnnotation]; ok {
+			snapshot, err := userProvidedCredentials(c, instanceGUID)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte("Unable to read environment of revision: " + err.Error()))
+				return
+			}
+
+			changes := make(map[string]string)
+			for k := range app.Environment {
+				changes[k] = ""
+			}
+			for k, v := range snapshot {
+				changes[k] = v
+			}
+
+			if err := updateAppEnvironment(c, app, changes); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte("Unable to restore environment: " + err.Error()))
+				return
+			}
+		} else {
+			log.Printf("Revision %s of %s has no environment snapshot, keeping the current environment", revision, name)
+		}
+
+		if _, err := c.AssignDropletToApp(app.Guid, target.GUID); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Unable to assign droplet: " + err.Error()))
+			return
+		}
+
+		if err := restartApp(c, app.Guid); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Unable to restart function: " + err.Error()))
+			return
+		}
+
+		log.Printf("Rolled back %s to revision %s (%s)", name, target.GUID, target.Image)
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,418 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	cfclient "github.com/nwright-nz/go-cfclient"
+	"github.com/nwright-nz/openfaas-cf-backend/requests"
+)
+
+// routesAnnotation holds the JSON routes of a function on its app.
+const routesAnnotation = "openfaas.com/routes"
+
+// routeRetryWait is how long a failure to read routes is remembered before the store is read again.
+const routeRetryWait = 5 * time.Second
+
+// reservedPaths belong to the gateway so are never routed to functions, on any host.
+var reservedPaths = []string{"/function", "/async-function", "/system", "/pipeline", "/async-pipeline", "/ui", "/metrics"}
+
+// RouteStore keeps the routing table.
+type RouteStore interface {
+	List() ([]requests.FunctionRoute, error)
+	// Save adds a route or replaces the one with the same host and path.
+	Save(route requests.FunctionRoute) error
+	Delete(host string, path string) error
+}
+
+// MemoryRouteStore keeps routes in the gateway's memory.
+type MemoryRouteStore struct {
+	mu     sync.Mutex
+	routes []requests.FunctionRoute
+}
+
+// NewMemoryRouteStore creates an empty MemoryRouteStore.
+func NewMemoryRouteStore() *MemoryRouteStore {
+	return &MemoryRouteStore{}
+}
+
+// List implements RouteStore.
+func (s *MemoryRouteStore) List() ([]requests.FunctionRoute, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]requests.FunctionRoute{}, s.routes...), nil
+}
+
+// Save implements RouteStore.
+func (s *MemoryRouteStore) Save(route requests.FunctionRoute) error {
+	s.mu.Lock()
+	s.routes = append(withoutRoute(s.routes, route.Host, route.Path), route)
+	s.mu.Unlock()
+	return nil
+}
+
+// Delete implements RouteStore.
+func (s *MemoryRouteStore) Delete(host string, path string) error {
+	s.mu.Lock()
+	s.routes = withoutRoute(s.routes, host, path)
+	s.mu.Unlock()
+	return nil
+}
+
+func withoutRoute(routes []requests.FunctionRoute, host string, path string) []requests.FunctionRoute {
+	kept := []requests.FunctionRoute{}
+	for _, route := range routes {
+		if route.Host != host || route.Path != path {
+			kept = append(kept, route)
+		}
+	}
+	return kept
+}
+
+// AppRouteStore keeps each function's routes in an annotation on its app, so routes are removed
+// along with the function. Routes to a function with versions are kept on its first version found.
+type AppRouteStore struct {
+	client *cfclient.Client
+}
+
+// NewAppRouteStore creates a store which reads and writes app annotations.
+func NewAppRouteStore(client *cfclient.Client) *AppRouteStore {
+	return &AppRouteStore{client: client}
+}
+
+// appRoutes reads the routes of every app, keyed by app GUID.
+func (s *AppRouteStore) appRoutes() (map[string][]requests.FunctionRoute, error) {
+	values, err := listAppAnnotation(s.client, routesAnnotation)
+	if err != nil {
+		return nil, err
+	}
+
+	appRoutes := make(map[string][]requests.FunctionRoute)
+	for guid, value := range values {
+		routes := []requests.FunctionRoute{}
+		if err := json.Unmarshal([]byte(value), &routes); err != nil {
+			log.Printf("Ignoring unreadable routes on app %s: %s", guid, err)
+			continue
+		}
+		appRoutes[guid] = routes
+	}
+	return appRoutes, nil
+}
+
+func (s *AppRouteStore) writeRoutes(appGUID string, routes []requests.FunctionRoute) error {
+	if len(routes) == 0 {
+		return annotateApp(s.client, appGUID, map[string]*string{routesAnnotation: nil})
+	}
+	value, err := json.Marshal(routes)
+	if err != nil {
+		return err
+	}
+	encoded := string(value)
+	return annotateApp(s.client, appGUID, map[string]*string{routesAnnotation: &encoded})
+}
+
+// List implements RouteStore.
+func (s *AppRouteStore) List() ([]requests.FunctionRoute, error) {
+	appRoutes, err := s.appRoutes()
+	if err != nil {
+		return nil, err
+	}
+
+	all := []requests.FunctionRoute{}
+	for _, routes := range appRoutes {
+		all = append(all, routes...)
+	}
+	return all, nil
+}
+
+// Save implements RouteStore.
+func (s *AppRouteStore) Save(route requests.FunctionRoute) error {
+	appGUID, err := s.functionAppGUID(route.Function)
+	if err != nil {
+		return err
+	}
+
+	appRoutes, err := s.appRoutes()
+	if err != nil {
+		return err
+	}
+
+	for guid, routes := range appRoutes {
+		if guid == appGUID {
+			continue
+		}
+		if kept := withoutRoute(routes, route.Host, route.Path); len(kept) < len(routes) {
+			if err := s.writeRoutes(guid, kept); err != nil {
+				return err
+			}
+		}
+	}
+	return s.writeRoutes(appGUID, append(withoutRoute(appRoutes[appGUID], route.Host, route.Path), route))
+}
+
+// Delete implements RouteStore.
+func (s *AppRouteStore) Delete(host string, path string) error {
+	appRoutes, err := s.appRoutes()
+	if err != nil {
+		return err
+	}
+
+	for guid, routes := range appRoutes {
+		if kept := withoutRoute(routes, host, path); len(kept) < len(routes) {
+			if err := s.writeRoutes(guid, kept); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *AppRouteStore) functionAppGUID(name string) (string, error) {
+	app, exists, err := findFunctionApp(name, s.client)
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		return app.Guid, nil
+	}
+
+	versions, err := listFunctionVersions(s.client, name)
+	if err != nil {
+		return "", err
+	}
+	if len(versions) > 0 {
+		return versions[0].GUID, nil
+	}
+	return "", fmt.Errorf("Cannot find function: %s.", name)
+}
+
+// normaliseRoute lower-cases the host and cleans the path so equal routes compare equal.
+func normaliseRoute(route requests.FunctionRoute) requests.FunctionRoute {
+	route.Host = strings.ToLower(strings.TrimSpace(route.Host))
+	if len(route.Path) == 0 {
+		route.Path = "/"
+	}
+	route.Path = path.Clean("/" + route.Path)
+	return route
+}
+
+// validateRoute checks a normalised route.
+func validateRoute(route requests.FunctionRoute) error {
+	if !validFunctionName.MatchString(route.Function) {
+		return fmt.Errorf("invalid function name: %q", route.Function)
+	}
+	if strings.ContainsAny(route.Host, ":/ ") {
+		return fmt.Errorf("host should be a hostname without a port: %q", route.Host)
+	}
+	if len(route.Host) == 0 && route.Path == "/" {
+		return fmt.Errorf("a route without a host needs a path")
+	}
+	for _, reserved := range reservedPaths {
+		// A route with a host may cover reserved paths, such as /, which are then left to the gateway.
+		if pathHasPrefix(route.Path, reserved) || (len(route.Host) == 0 && pathHasPrefix(reserved, route.Path)) {
+			return fmt.Errorf("%s is used by the gateway", route.Path)
+		}
+	}
+	return nil
+}
+
+// isReservedPath reports whether p belongs to the gateway.
+func isReservedPath(p string) bool {
+	for _, reserved := range reservedPaths {
+		if pathHasPrefix(p, reserved) {
+			return true
+		}
+	}
+	return false
+}
+
+// pathHasPrefix matches whole segments, so /orders matches /orders/1 but not /ordersx.
+func pathHasPrefix(p string, prefix string) bool {
+	if prefix == "/" || p == prefix {
+		return true
+	}
+	return strings.HasPrefix(p, prefix+"/")
+}
+
+// RouteTable caches the routes in a store and matches calls against them.
+type RouteTable struct {
+	store   RouteStore
+	refresh time.Duration
+
+	mu      sync.Mutex
+	routes  []requests.FunctionRoute
+	fetched time.Time
+	err     error
+	failed  time.Time
+}
+
+// NewRouteTable re-reads the store when its routes are older than refresh.
+func NewRouteTable(store RouteStore, refresh time.Duration) *RouteTable {
+	return &RouteTable{store: store, refresh: refresh}
+}
+
+// Routes returns the routes with the most specific first: routes with a host, then longer paths.
+func (t *RouteTable) Routes() ([]requests.FunctionRoute, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.routes != nil && time.Since(t.fetched) < t.refresh {
+		return t.routes, nil
+	}
+	// While the store is failing the last routes read are kept, rather than reading it on every call.
+	if time.Since(t.failed) < routeRetryWait {
+		if t.routes != nil {
+			return t.routes, nil
+		}
+		return nil, t.err
+	}
+
+	routes, err := t.store.List()
+	if err != nil {
+		t.err = err
+		t.failed = time.Now()
+		if t.routes != nil {
+			log.Printf("Unable to read routes, keeping the last read: %s", err)
+			return t.routes, nil
+		}
+		return nil, err
+	}
+	sort.SliceStable(routes, func(i, j int) bool {
+		if (len(routes[i].Host) > 0) != (len(routes[j].Host) > 0) {
+			return len(routes[i].Host) > 0
+		}
+		return len(routes[i].Path) > len(routes[j].Path)
+	})
+	t.routes = routes
+	t.fetched = time.Now()
+	return routes, nil
+}
+
+// Forget drops the cached routes after a change.
+func (t *RouteTable) Forget() {
+	t.mu.Lock()
+	t.routes = nil
+	t.failed = time.Time{}
+	t.mu.Unlock()
+}
+
+// Match finds the route for a call to host and path, the gateway's own paths never match.
+func (t *RouteTable) Match(host string, p string) (requests.FunctionRoute, bool) {
+	if isReservedPath(p) {
+		return requests.FunctionRoute{}, false
+	}
+	routes, err := t.Routes()
+	if err != nil {
+		log.Printf("Unable to read routes: %s", err)
+		return requests.FunctionRoute{}, false
+	}
+
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	host = strings.ToLower(host)
+
+	for _, route := range routes {
+		if (len(route.Host) == 0 || route.Host == host) && pathHasPrefix(p, route.Path) {
+			return route, true
+		}
+	}
+	return requests.FunctionRoute{}, false
+}
+
+// MakeRouteHandler rewrites calls which match a route to /function/{name} before they reach
+// next, the gateway's router, so they're handled like any other function call. Calls to / with
+// an X-Function header are sent to that function when no route matches.
+func MakeRouteHandler(next http.Handler, table *RouteTable) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		route, ok := table.Match(r.Host, r.URL.Path)
+		if !ok {
+			function := r.Header.Get("X-Function")
+			if r.URL.Path != "/" || !validFunctionName.MatchString(function) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			route = requests.FunctionRoute{Path: "/", Function: function}
+		}
+
+		upstream := r.URL.Path
+		if route.StripPrefix && route.Path != "/" {
+			upstream = strings.TrimPrefix(upstream, route.Path)
+			r.Header.Set("X-Forwarded-Prefix", route.Path)
+		}
+		if !strings.HasPrefix(upstream, "/") {
+			upstream = "/" + upstream
+		}
+
+		routed := r.WithContext(r.Context())
+		routedURL := *r.URL
+		routedURL.Path = "/function/" + route.Function + upstream
+		routedURL.RawPath = ""
+		routed.URL = &routedURL
+		routed.RequestURI = routedURL.RequestURI()
+
+		next.ServeHTTP(w, routed)
+	}
+}
+
+// MakeRoutesHandler lists (GET), saves (POST/PUT) or deletes (DELETE ?host=&path=) routes.
+func MakeRoutesHandler(table *RouteTable) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		switch r.Method {
+		case http.MethodGet:
+			routes, err := table.Routes()
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(err.Error()))
+				return
+			}
+			routeBytes, _ := json.Marshal(routes)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			w.Write(routeBytes)
+
+		case http.MethodDelete:
+			query := r.URL.Query()
+			route := normaliseRoute(requests.FunctionRoute{Host: query.Get("host"), Path: query.Get("path")})
+			if err := table.store.Delete(route.Host, route.Path); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(err.Error()))
+				return
+			}
+			table.Forget()
+			w.WriteHeader(http.StatusOK)
+
+		default:
+			route := requests.FunctionRoute{}
+			if err := json.NewDecoder(r.Body).Decode(&route); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(err.Error()))
+				return
+			}
+			route = normaliseRoute(route)
+			if err := validateRoute(route); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(err.Error()))
+				return
+			}
+			if err := table.store.Save(route); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(err.Error()))
+				return
+			}
+			table.Forget()
+			w.WriteHeader(http.StatusOK)
+		}
+	}
+}
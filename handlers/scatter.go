@@ -0,0 +1,203 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/nwright-nz/openfaas-cf-backend/requests"
+)
+
+const (
+	defaultScatterParallelism = 8
+	maxScatterParallelism     = 64
+	maxScatterCalls           = 1000
+)
+
+// MakeScatterHandler calls each function and body in a ScatterRequest through invoke, the
+// gateway's router, and gathers the results. Failed calls are reported in their own result so
+// the response is a 200 unless the request itself is invalid. Clients which accept
+// multipart/mixed get one part per call instead of JSON.
+func MakeScatterHandler(invoke http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		body, _ := ioutil.ReadAll(r.Body)
+		scatter := requests.ScatterRequest{}
+		if err := json.Unmarshal(body, &scatter); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		if len(scatter.Calls) == 0 || len(scatter.Calls) > maxScatterCalls {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("Provide between 1 and %d calls.", maxScatterCalls)))
+			return
+		}
+
+		var timeout time.Duration
+		if len(scatter.Timeout) > 0 {
+			parsed, err := time.ParseDuration(scatter.Timeout)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(fmt.Sprintf("Invalid timeout: %s", scatter.Timeout)))
+				return
+			}
+			timeout = parsed
+		}
+
+		parallelism := scatter.Parallelism
+		if parallelism <= 0 {
+			parallelism = defaultScatterParallelism
+		}
+		if parallelism > maxScatterParallelism {
+			parallelism = maxScatterParallelism
+		}
+
+		results := make([]requests.ScatterResult, len(scatter.Calls))
+		slots := make(chan struct{}, parallelism)
+		var wg sync.WaitGroup
+
+		for i, call := range scatter.Calls {
+			if len(call.Function) == 0 {
+				call.Function = scatter.Function
+			}
+			if len(call.Body) == 0 && len(call.BodyEncoding) == 0 {
+				call.Body = scatter.Body
+				call.BodyEncoding = scatter.BodyEncoding
+			}
+
+			wg.Add(1)
+			slots <- struct{}{}
+			go func(i int, call requests.ScatterCall) {
+				defer func() {
+					<-slots
+					wg.Done()
+				}()
+				results[i] = scatterCall(invoke, r, call, timeout)
+			}(i, call)
+		}
+		wg.Wait()
+
+		if strings.Contains(r.Header.Get("Accept"), "multipart/mixed") {
+			writeScatterMultipart(w, results)
+			return
+		}
+
+		for i := range results {
+			if !utf8.ValidString(results[i].Body) {
+				results[i].Body = base64.StdEncoding.EncodeToString([]byte(results[i].Body))
+				results[i].BodyEncoding = "base64"
+			}
+		}
+		resultBytes, _ := json.Marshal(requests.ScatterResponse{Results: results})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(resultBytes)
+	}
+}
+
+// scatterCall makes one call, copying the client's headers such as X-Call-Id and auth.
+func scatterCall(invoke http.Handler, r *http.Request, call requests.ScatterCall, timeout time.Duration) requests.ScatterResult {
+	result := requests.ScatterResult{Function: call.Function}
+
+	if !validFunctionName.MatchString(call.Function) {
+		result.Status = http.StatusBadRequest
+		result.Error = fmt.Sprintf("invalid function name: %q", call.Function)
+		return result
+	}
+
+	body := []byte(call.Body)
+	if call.BodyEncoding == "base64" {
+		decoded, err := base64.StdEncoding.DecodeString(call.Body)
+		if err != nil {
+			result.Status = http.StatusBadRequest
+			result.Error = "body isn't valid base64"
+			return result
+		}
+		body = decoded
+	}
+
+	ctx := r.Context()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	callRequest, _ := http.NewRequestWithContext(ctx, http.MethodPost, "/function/"+call.Function, bytes.NewReader(body))
+	copyHeaders(&callRequest.Header, &r.Header)
+	removeHopHeaders(callRequest.Header)
+	callRequest.Header.Del("Content-Length")
+	callRequest.Header.Del("Accept")
+	callRequest.Header.Del(StartTimeHeader)
+	callRequest.Header.Del("Content-Type")
+	if len(call.ContentType) > 0 {
+		callRequest.Header.Set("Content-Type", call.ContentType)
+	}
+	callRequest.RemoteAddr = r.RemoteAddr
+	callRequest.Host = r.Host
+
+	start := time.Now()
+	response := newBufferedResponse()
+	aborted := serveDetached(invoke, response, callRequest)
+	result.Duration = time.Since(start).Seconds()
+
+	if ctx.Err() == context.DeadlineExceeded && r.Context().Err() == nil {
+		result.Status = http.StatusGatewayTimeout
+		result.Error = fmt.Sprintf("timed out after %s", timeout)
+		return result
+	}
+	if aborted {
+		result.Status = http.StatusBadGateway
+		result.Error = "function didn't return a complete response"
+		return result
+	}
+
+	result.Status = response.status
+	result.Body = response.body.String()
+	result.ContentType = response.header.Get("Content-Type")
+	if result.Status < 200 || result.Status > 299 {
+		result.Error = http.StatusText(result.Status)
+	}
+	return result
+}
+
+// writeScatterMultipart writes one part per result with its status and duration as headers.
+func writeScatterMultipart(w http.ResponseWriter, results []requests.ScatterResult) {
+	writer := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+writer.Boundary())
+	w.WriteHeader(http.StatusOK)
+
+	for _, result := range results {
+		header := make(textproto.MIMEHeader)
+		header.Set("X-Function", result.Function)
+		header.Set("X-Function-Status", strconv.Itoa(result.Status))
+		header.Set(DurationHeader, strconv.FormatFloat(result.Duration, 'f', 6, 64))
+		if len(result.ContentType) > 0 {
+			header.Set("Content-Type", result.ContentType)
+		}
+		if len(result.Error) > 0 {
+			header.Set("X-Function-Error", result.Error)
+		}
+
+		part, err := writer.CreatePart(header)
+		if err != nil {
+			return
+		}
+		part.Write([]byte(result.Body))
+	}
+	writer.Close()
+}
@@ -0,0 +1,185 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nwright-nz/openfaas-cf-backend/metrics"
+)
+
+// Labels which mirror a function's calls to a candidate function.
+const (
+	// ShadowLabel names the function which receives copies of calls.
+	ShadowLabel = "com.openfaas.shadow"
+	// ShadowPercentLabel is the share of calls copied, 10 by default.
+	ShadowPercentLabel = "com.openfaas.shadow.percent"
+)
+
+const (
+	// maxShadowBodyBytes bounds the bodies buffered to copy, larger calls aren't mirrored.
+	maxShadowBodyBytes = 1024 * 1024
+	// maxShadowInflight bounds the copies in progress, calls over it aren't mirrored.
+	maxShadowInflight = 64
+	// shadowTimeout bounds a copy, the shadow's own exec timeout still applies.
+	shadowTimeout = 5 * time.Minute
+)
+
+// statusRecorder remembers the status of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(data []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(data)
+}
+
+// Unwrap lets http.ResponseController reach the connection for hijacking and deadlines.
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+func (s *statusRecorder) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// discardResponse keeps the status of a shadow's response and drops the body.
+type discardResponse struct {
+	header http.Header
+	status int
+}
+
+func (d *discardResponse) Header() http.Header {
+	return d.header
+}
+
+func (d *discardResponse) WriteHeader(status int) {
+	if d.status == 0 {
+		d.status = status
+	}
+}
+
+func (d *discardResponse) Write(data []byte) (int, error) {
+	if d.status == 0 {
+		d.status = http.StatusOK
+	}
+	return len(data), nil
+}
+
+type shadowOutcome struct {
+	status   int
+	duration time.Duration
+}
+
+// MakeShadowHandler copies a sample of calls to the function named by its shadow label through
+// invoke, which calls the function in the X-Function header, and records how the shadow's status
+// and latency compare to the primary's. Copies run in the background with their own deadline and
+// their responses are discarded, so the primary call never waits for them.
+func MakeShadowHandler(next http.HandlerFunc, lookup FunctionLabelLookup, invoke http.HandlerFunc, metricsOptions metrics.MetricOptions) http.HandlerFunc {
+	inflight := make(chan struct{}, maxShadowInflight)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+		if len(name) == 0 {
+			name = r.Header.Get("X-Function")
+		}
+		if len(name) == 0 || isUpgrade(r) {
+			next(w, r)
+			return
+		}
+
+		labels, err := lookup(name)
+		shadow := labels[ShadowLabel]
+		if err != nil || len(shadow) == 0 || shadow == name || !validFunctionName.MatchString(shadow) {
+			next(w, r)
+			return
+		}
+
+		percent := labelFloat(labels, ShadowPercentLabel, 10)
+		if rand.Float64()*100 >= percent || r.ContentLength < 0 || r.ContentLength > maxShadowBodyBytes {
+			next(w, r)
+			return
+		}
+
+		select {
+		case inflight <- struct{}{}:
+		default:
+			metricsOptions.GatewayShadowCalls.WithLabelValues(name, shadow, "", "dropped").Inc()
+			next(w, r)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			<-inflight
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		shadowRequest, cancel := makeShadowRequest(r, shadow, body)
+		primary := make(chan shadowOutcome, 1)
+
+		go func() {
+			defer func() {
+				cancel()
+				<-inflight
+			}()
+
+			start := time.Now()
+			response := &discardResponse{header: make(http.Header)}
+			aborted := serveDetached(invoke, response, shadowRequest)
+			shadowDuration := time.Since(start)
+
+			outcome := <-primary
+			shadowCode := strconv.Itoa(response.status)
+			if response.status == 0 || aborted {
+				shadowCode = "error"
+			}
+			metricsOptions.GatewayShadowCalls.WithLabelValues(name, shadow, strconv.Itoa(outcome.status), shadowCode).Inc()
+			metricsOptions.GatewayShadowLatencyDifference.WithLabelValues(name, shadow).Observe((shadowDuration - outcome.duration).Seconds())
+		}()
+
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			primary <- shadowOutcome{status: recorder.status, duration: time.Since(start)}
+		}()
+		next(recorder, r)
+	}
+}
+
+// makeShadowRequest copies a call for the shadow, detached from the client's connection.
+func makeShadowRequest(r *http.Request, shadow string, body []byte) (*http.Request, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), shadowTimeout)
+	shadowRequest, _ := http.NewRequestWithContext(ctx, r.Method, "/function/"+shadow+upstreamPath(r.URL.Path, mux.Vars(r)["name"]), bytes.NewReader(body))
+	shadowRequest.URL.RawQuery = r.URL.RawQuery
+	copyHeaders(&shadowRequest.Header, &r.Header)
+	removeHopHeaders(shadowRequest.Header)
+	shadowRequest.Header.Set("X-Function", shadow)
+	shadowRequest.Header.Set("X-Shadow-Of", r.Header.Get(CallIDHeader))
+	shadowRequest.Header.Set(CallIDHeader, newCallID())
+	shadowRequest.RemoteAddr = r.RemoteAddr
+	shadowRequest.Host = r.Host
+	return shadowRequest, cancel
+}
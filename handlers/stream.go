@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+)
+
+// errResponseTooLarge is returned when a function's response goes over the configured limit.
+var errResponseTooLarge = errors.New("response exceeds the maximum size")
+
+// isRequestTooLarge reports whether err came from a request body going over its limit.
+func isRequestTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
+
+// serveDetached calls h on one of the gateway's own goroutines, where net/http doesn't recover
+// the http.ErrAbortHandler panic the proxy uses to abort a call it can't finish. It reports
+// whether the call was aborted, any other panic is logged and counts as aborted.
+func serveDetached(h http.Handler, w http.ResponseWriter, r *http.Request) (aborted bool) {
+	defer func() {
+		if err := recover(); err != nil {
+			aborted = true
+			if err != http.ErrAbortHandler {
+				log.Printf("[%s] Call to %s failed: %v", r.Header.Get(CallIDHeader), r.URL.Path, err)
+			}
+		}
+	}()
+	h.ServeHTTP(w, r)
+	return false
+}
+
+// copyResponse streams a function's response to the client, flushing after every read so that
+// progress output and chunked responses arrive as they're written. A limit of 0 means no limit.
+func copyResponse(w http.ResponseWriter, body io.Reader, limit int64) (int64, error) {
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+
+	var written int64
+	for {
+		n, readErr := body.Read(buf)
+		if n > 0 {
+			if limit > 0 && written+int64(n) > limit {
+				return written, errResponseTooLarge
+			}
+
+			wn, writeErr := w.Write(buf[:n])
+			written += int64(wn)
+			if writeErr != nil {
+				return written, writeErr
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+
+		if readErr == io.EOF {
+			return written, nil
+		}
+		if readErr != nil {
+			return written, readErr
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	cfclient "github.com/nwright-nz/go-cfclient"
+	"github.com/nwright-nz/openfaas-cf-backend/requests"
+)
+
+const (
+	// functionLabel and versionLabel are set on apps deployed as a version of a function, so
+	// that the versions can be found with a label selector.
+	functionLabel = "openfaas.com/function"
+	versionLabel  = "openfaas.com/version"
+	// trafficAnnotation holds the traffic policy, stored on every version of the function.
+	trafficAnnotation = "openfaas.com/traffic"
+)
+
+// versionedName is the app name for a version of a function i.e. name-v3
+func versionedName(name string, version string) string {
+	if len(version) == 0 {
+		return name
+	}
+	return name + "-" + version
+}
+
+// invalidPolicyError is returned when a traffic policy doesn't fit the deployed versions.
+type invalidPolicyError struct {
+	message string
+}
+
+func (e invalidPolicyError) Error() string {
+	return e.message
+}
+
+type cachedPolicy struct {
+	policy  *requests.TrafficPolicy
+	fetched time.Time
+}
+
+// TrafficSplitter picks which version of a function serves each call using the
+// function's traffic policy. Policies are cached and re-read from the Cloud Controller
+// so that several gateways converge.
+type TrafficSplitter struct {
+	client  *cfclient.Client
+	refresh time.Duration
+
+	mu       sync.Mutex
+	policies map[string]cachedPolicy
+}
+
+// NewTrafficSplitter create a TrafficSplitter which re-reads policies after refresh.
+func NewTrafficSplitter(client *cfclient.Client, refresh time.Duration) *TrafficSplitter {
+	return &TrafficSplitter{
+		client:   client,
+		refresh:  refresh,
+		policies: make(map[string]cachedPolicy),
+	}
+}
+
+// Pick returns the version to call for a function, false when the function has no policy.
+func (t *TrafficSplitter) Pick(name string, r *http.Request) (string, bool) {
+	policy, err := t.Policy(name)
+	if err != nil {
+		log.Printf("Unable to read traffic policy for %s: %s", name, err)
+		return "", false
+	}
+	if policy == nil {
+		return "", false
+	}
+
+	var sticky string
+	if len(policy.StickyHeader) > 0 {
+		sticky = r.Header.Get(policy.StickyHeader)
+	}
+	return PickVersion(*policy, sticky), true
+}
+
+// pickedVersionKey carries the version picked for a call by a handler in front of the proxy.
+type pickedVersionKey struct{}
+
+type pickedVersion struct {
+	name    string
+	version string
+}
+
+// withVersion records the version picked for a call to a function.
+func withVersion(r *http.Request, name string, version string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), pickedVersionKey{}, pickedVersion{name: name, version: version}))
+}
+
+// pick returns the version to call for a function, keeping to a version already picked for
+// the call. A nil TrafficSplitter always picks the unversioned app.
+func (t *TrafficSplitter) pick(name string, r *http.Request) string {
+	if picked, ok := r.Context().Value(pickedVersionKey{}).(pickedVersion); ok && picked.name == name {
+		return picked.version
+	}
+	if t == nil {
+		return ""
+	}
+	version, _ := t.Pick(name, r)
+	return version
+}
+
+// Policy returns the traffic policy of a function, nil when it has none.
+func (t *TrafficSplitter) Policy(name string) (*requests.TrafficPolicy, error) {
+	t.mu.Lock()
+	cached, ok := t.policies[name]
+	t.mu.Unlock()
+
+	if ok && time.Since(cached.fetched) < t.refresh {
+		return cached.policy, nil
+	}
+
+	apps, err := t.versions(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var policy *requests.TrafficPolicy
+	for _, app := range apps {
+		if len(app.Traffic) > 0 {
+			policy = &requests.TrafficPolicy{}
+			if err := json.Unmarshal([]byte(app.Traffic), policy); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+
+	t.mu.Lock()
+	t.policies[name] = cachedPolicy{policy: policy, fetched: time.Now()}
+	t.mu.Unlock()
+
+	return policy, nil
+}
+
+// SetPolicy validates a traffic policy against the deployed versions and stores it on each of them.
+func (t *TrafficSplitter) SetPolicy(name string, policy requests.TrafficPolicy) error {
+	apps, err := t.versions(name)
+	if err != nil {
+		return err
+	}
+
+	deployed := make(map[string]functionVersionApp)
+	for _, app := range apps {
+		deployed[app.Version] = app
+	}
+
+	total := 0
+	for version, weight := range policy.Weights {
+		if _, ok := deployed[version]; !ok {
+			return invalidPolicyError{fmt.Sprintf("unknown version %s of function %s", version, name)}
+		}
+		if weight < 0 {
+			return invalidPolicyError{fmt.Sprintf("weight for version %s can't be negative", version)}
+		}
+		total += weight
+	}
+	if total == 0 {
+		return invalidPolicyError{fmt.Sprintf("traffic policy for %s needs at least one version with a weight", name)}
+	}
+
+	value, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
+	encoded := string(value)
+
+	for _, app := range deployed {
+		if err := annotateApp(t.client, app.GUID, map[string]*string{trafficAnnotation: &encoded}); err != nil {
+			return err
+		}
+	}
+
+	t.mu.Lock()
+	t.policies[name] = cachedPolicy{policy: &policy, fetched: time.Now()}
+	t.mu.Unlock()
+
+	return nil
+}
+
+// Forget drops the cached policy of a function so that it's re-read on the next call.
+func (t *TrafficSplitter) Forget(name string) {
+	t.mu.Lock()
+	delete(t.policies, name)
+	t.mu.Unlock()
+}
+
+// versions lists the apps deployed as a version of the function.
+func (t *TrafficSplitter) versions(name string) ([]functionVersionApp, error) {
+	return listFunctionVersions(t.client, name)
+}
+
+// PickVersion chooses a version by weight, a non-empty sticky value always maps to the same version
+// while the policy is unchanged.
+func PickVersion(policy requests.TrafficPolicy, sticky string) string {
+	versions := make([]string, 0, len(policy.Weights))
+	total := 0
+	for version, weight := range policy.Weights {
+		if weight > 0 {
+			versions = append(versions, version)
+			total += weight
+		}
+	}
+	if total == 0 {
+		return ""
+	}
+	sort.Strings(versions)
+
+	var point int
+	if len(sticky) > 0 {
+		hash := fnv.New32a()
+		hash.Write([]byte(sticky))
+		point = int(hash.Sum32() % uint32(total))
+	} else {
+		point = rand.Intn(total)
+	}
+
+	for _, version := range versions {
+		point -= policy.Weights[version]
+		if point < 0 {
+			return version
+		}
+	}
+	return versions[len(versions)-1]
+}
+
+// MakeTrafficHandler reads (GET) or replaces (POST/PUT) the traffic policy of a function.
+func MakeTrafficHandler(splitter *TrafficSplitter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		name := mux.Vars(r)["name"]
+
+		if r.Method == http.MethodGet {
+			policy, err := splitter.Policy(name)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(err.Error()))
+				return
+			}
+			if policy == nil {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(fmt.Sprintf("No traffic policy for function: %s.", name)))
+				return
+			}
+
+			policyBytes, _ := json.Marshal(policy)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			w.Write(policyBytes)
+			return
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+		policy := requests.TrafficPolicy{}
+		if err := json.Unmarshal(body, &policy); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		// Accept the short form {"v2": 90, "v3": 10} as well as {"weights": {...}}.
+		if policy.Weights == nil {
+			weights := make(map[string]int)
+			if err := json.Unmarshal(body, &weights); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("Traffic policy should map versions to weights."))
+				return
+			}
+			policy.Weights = weights
+		}
+
+		if err := splitter.SetPolicy(name, policy); err != nil {
+			status := http.StatusInternalServerError
+			if _, ok := err.(invalidPolicyError); ok {
+				status = http.StatusBadRequest
+			}
+			w.WriteHeader(status)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
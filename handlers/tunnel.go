@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// isUpgrade reports whether the client asked to switch protocols i.e. to a WebSocket.
+func isUpgrade(r *http.Request) bool {
+	if len(r.Header.Get("Upgrade")) == 0 {
+		return false
+	}
+	for _, connection := range r.Header["Connection"] {
+		for _, option := range strings.Split(connection, ",") {
+			if strings.EqualFold(strings.TrimSpace(option), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isEventStream reports whether a response is a stream of Server-Sent Events.
+func isEventStream(header http.Header) bool {
+	return strings.HasPrefix(header.Get("Content-Type"), "text/event-stream")
+}
+
+// clearWriteDeadline lifts the server's write timeout for a long-lived response, which
+// then lasts until the function ends it or the call's context is done.
+func clearWriteDeadline(w http.ResponseWriter) error {
+	return http.NewResponseController(w).SetWriteDeadline(time.Time{})
+}
+
+// tunnel completes a protocol switch the function accepted and copies bytes both ways
+// between the client and the function until either side closes or ctx is done.
+func tunnel(ctx context.Context, w http.ResponseWriter, response *http.Response) error {
+	upstream, ok := response.Body.(io.ReadWriteCloser)
+	if !ok {
+		return errors.New("upstream connection can't be used for a tunnel")
+	}
+	defer upstream.Close()
+
+	conn, buffered, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// The server's read and write timeouts don't apply to the tunnel.
+	conn.SetDeadline(time.Time{})
+
+	header := w.Header().Clone()
+	for k, vv := range response.Header {
+		header[k] = vv
+	}
+	if err := writeSwitchingProtocols(buffered.Writer, header); err != nil {
+		return err
+	}
+
+	// Bytes the client sent after its request may already be buffered.
+	if pending := buffered.Reader.Buffered(); pending > 0 {
+		data, _ := buffered.Reader.Peek(pending)
+		if _, err := upstream.Write(data); err != nil {
+			return err
+		}
+	}
+
+	done := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(upstream, conn)
+		done <- err
+	}()
+	go func() {
+		_, err := io.Copy(conn, upstream)
+		done <- err
+	}()
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	return err
+}
+
+func writeSwitchingProtocols(w *bufio.Writer, header http.Header) error {
+	fmt.Fprintf(w, "HTTP/1.1 %d %s\r\n", http.StatusSwitchingProtocols, http.StatusText(http.StatusSwitchingProtocols))
+	if err := header.Write(w); err != nil {
+		return err
+	}
+	w.WriteString("\r\n")
+	return w.Flush()
+}
@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/nwright-nz/openfaas-cf-backend/queue"
+	"github.com/nwright-nz/openfaas-cf-backend/requests"
+)
+
+// queuedCallKey marks calls made by a QueueWorker, the caller was authorised when the call was queued.
+type queuedCallKey struct{}
+
+func isQueuedCall(r *http.Request) bool {
+	queued, _ := r.Context().Value(queuedCallKey{}).(bool)
+	return queued
+}
+
+// QueueWorker calls functions for requests taken from a queue, in place of a separate
+// queue-worker. Requests are acked once the call is done and its result delivered, so requests
+// in flight when the gateway stops are delivered again.
+type QueueWorker struct {
+	consumer    queue.Consumer
+	invoke      http.Handler
+	client      *http.Client
+	concurrency int
+	maxAttempts int
+}
+
+// NewQueueWorker calls functions through invoke, the gateway's router, so that queued calls take
+// the same path as /function/ calls. Calls which fail with a status the client may retry, such as
+// 503 or 429, are queued again until they have been tried maxAttempts times.
+func NewQueueWorker(consumer queue.Consumer, invoke http.Handler, client *http.Client, concurrency int, maxAttempts int) *QueueWorker {
+	return &QueueWorker{
+		consumer:    consumer,
+		invoke:      invoke,
+		client:      client,
+		concurrency: concurrency,
+		maxAttempts: maxAttempts,
+	}
+}
+
+// Run calls functions until the queue is closed or ctx is done.
+func (qw *QueueWorker) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < qw.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			qw.work(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+func (qw *QueueWorker) work(ctx context.Context) {
+	for {
+		delivery, err := qw.consumer.Receive(ctx)
+		if err == queue.ErrClosed || ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("Unable to receive queued request: %s", err)
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		qw.handle(ctx, delivery)
+	}
+}
+
+func (qw *QueueWorker) handle(ctx context.Context, delivery *queue.Delivery) {
+	req := delivery.Request
+	callID := req.Header.Get(CallIDHeader)
+
+	start := time.Now()
+	response := qw.call(ctx, req)
+	duration := time.Since(start)
+
+	// The gateway is stopping, the request is delivered again when it starts.
+	if ctx.Err() != nil {
+		qw.consumer.Nack(delivery)
+		return
+	}
+
+	if retryableStatus(response.status) && delivery.Attempts+1 < qw.maxAttempts {
+		wait := time.Duration(1<<uint(delivery.Attempts)) * time.Second
+		if wait > time.Second*30 {
+			wait = time.Second * 30
+		}
+		log.Printf("[%s] Queued call to %s failed with %d, retrying in %s", callID, req.Function, response.status, wait)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+		}
+		qw.consumer.Nack(delivery)
+		return
+	}
+
+	log.Printf("[%s] Queued call to %s finished with %d", callID, req.Function, response.status)
+	qw.report(ctx, req.Function, response.status, duration)
+	if req.CallbackURL != nil {
+		deliverResult(qw.client, req.CallbackURL.String(), requests.CallResult{
+			CallID:     callID,
+			Function:   req.Function,
+			Status:     "done",
+			StatusCode: response.status,
+			Header:     response.header,
+			Body:       response.body.Bytes(),
+			Duration:   duration.Seconds(),
+		})
+	}
+
+	if err := qw.consumer.Ack(delivery); err != nil {
+		log.Printf("[%s] Unable to ack queued call to %s: %s", callID, req.Function, err)
+	}
+}
+
+// call invokes the function with the request as it was queued.
+func (qw *QueueWorker) call(ctx context.Context, req *queue.Request) *bufferedResponse {
+	response := newBufferedResponse()
+	if !validFunctionName.MatchString(req.Function) {
+		response.WriteHeader(http.StatusBadRequest)
+		response.Write([]byte("Invalid function name."))
+		return response
+	}
+
+	method := req.Method
+	if len(method) == 0 {
+		method = http.MethodPost
+	}
+	target := "/function/" + req.Function
+	if len(req.QueryString) > 0 {
+		target += "?" + req.QueryString
+	}
+
+	callRequest, err := http.NewRequestWithContext(context.WithValue(ctx, queuedCallKey{}, true), method, target, bytes.NewReader(req.Body))
+	if err != nil {
+		response.WriteHeader(http.StatusBadRequest)
+		response.Write([]byte(err.Error()))
+		return response
+	}
+	copyHeaders(&callRequest.Header, &req.Header)
+	callRequest.Header.Del("Content-Length")
+	callRequest.Header.Del("X-Callback-Url")
+	// The key was checked when the call was queued, a sync call with the same key mustn't be
+	// replayed in place of this one.
+	callRequest.Header.Del(IdempotencyKeyHeader)
+	callRequest.Header.Del(StartTimeHeader)
+
+	if serveDetached(qw.invoke, response, callRequest) {
+		// The call timed out or its response was too large after the status went out.
+		aborted := newBufferedResponse()
+		aborted.WriteHeader(http.StatusBadGateway)
+		aborted.Write([]byte(fmt.Sprintf("Function %s didn't return a complete response.", req.Function)))
+		return aborted
+	}
+	if response.status == 0 {
+		response.status = http.StatusOK
+	}
+	return response
+}
+
+// report records the call on /system/async-report, as a separate queue-worker would.
+func (qw *QueueWorker) report(ctx context.Context, function string, status int, duration time.Duration) {
+	body, _ := json.Marshal(requests.AsyncReport{FunctionName: function, StatusCode: status, TimeTaken: duration.Seconds()})
+	reportRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, "/system/async-report", bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	reportRequest.Header.Set("Content-Type", "application/json")
+	qw.invoke.ServeHTTP(newBufferedResponse(), reportRequest)
+}
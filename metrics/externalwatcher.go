@@ -6,7 +6,6 @@ package metrics
 import (
 	"encoding/json"
 	"io/ioutil"
-	"net"
 	"net/http"
 	"net/url"
 	"time"
@@ -16,22 +15,9 @@ import (
 	"github.com/nwright-nz/openfaas-cf-backend/requests"
 )
 
-func AttachExternalWatcher(endpointURL url.URL, metricsOptions MetricOptions, label string, interval time.Duration) {
+func AttachExternalWatcher(endpointURL url.URL, metricsOptions MetricOptions, label string, interval time.Duration, proxyClient *http.Client) {
 	ticker := time.NewTicker(interval)
 	quit := make(chan struct{})
-	proxyClient := http.Client{
-		Transport: &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-			DialContext: (&net.Dialer{
-				Timeout:   3 * time.Second,
-				KeepAlive: 0,
-			}).DialContext,
-			MaxIdleConns:          1,
-			DisableKeepAlives:     true,
-			IdleConnTimeout:       120 * time.Millisecond,
-			ExpectContinueTimeout: 1500 * time.Millisecond,
-		},
-	}
 
 	go func() {
 		for {
@@ -47,6 +33,7 @@ func AttachExternalWatcher(endpointURL url.URL, metricsOptions MetricOptions, la
 					continue
 				}
 				bytesOut, readErr := ioutil.ReadAll(res.Body)
+				res.Body.Close()
 				if readErr != nil {
 					log.Println(err)
 					continue
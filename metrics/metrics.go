@@ -11,9 +11,24 @@ import (
 
 // MetricOptions to be used by web handlers
 type MetricOptions struct {
-	GatewayFunctionInvocation *prometheus.CounterVec
-	GatewayFunctionsHistogram *prometheus.HistogramVec
-	ServiceReplicasCounter    *prometheus.GaugeVec
+	GatewayFunctionInvocation  *prometheus.CounterVec
+	GatewayFunctionsHistogram  *prometheus.HistogramVec
+	ServiceReplicasCounter     *prometheus.GaugeVec
+	GatewayCircuitBreakerState *prometheus.GaugeVec
+	GatewayFunctionTimeouts    *prometheus.CounterVec
+	GatewayFunctionInflight    *prometheus.GaugeVec
+	GatewayFunctionQueued      *prometheus.GaugeVec
+	GatewayRateLimited         *prometheus.CounterVec
+	GatewayCacheHits           *prometheus.CounterVec
+	GatewayCacheMisses         *prometheus.CounterVec
+	GatewayConnectionSeconds   *prometheus.HistogramVec
+	GatewayUnauthorized        *prometheus.CounterVec
+
+	GatewayShadowCalls             *prometheus.CounterVec
+	GatewayShadowLatencyDifference *prometheus.HistogramVec
+
+	GatewayAsyncInvocation *prometheus.CounterVec
+	GatewayAsyncHistogram  *prometheus.HistogramVec
 }
 
 // PrometheusHandler Bootstraps prometheus for metrics collection
@@ -26,14 +41,14 @@ func BuildMetricsOptions() MetricOptions {
 	gatewayFunctionsHistogram := prometheus.NewHistogramVec(prometheus.HistogramOpts{
 		Name: "gateway_functions_seconds",
 		Help: "Function time taken",
-	}, []string{"function_name"})
+	}, []string{"function_name", "version"})
 
 	gatewayFunctionInvocation := prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "gateway_function_invocation_total",
 			Help: "Individual function metrics",
 		},
-		[]string{"function_name", "code"},
+		[]string{"function_name", "code", "version"},
 	)
 
 	serviceReplicas := prometheus.NewGaugeVec(
@@ -44,10 +59,122 @@ func BuildMetricsOptions() MetricOptions {
 		[]string{"function_name"},
 	)
 
+	circuitBreakerState := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gateway_function_circuit_breaker_state",
+			Help: "Circuit breaker state of each function, 0 closed, 1 open, 2 half-open",
+		},
+		[]string{"function_name", "version"},
+	)
+
+	functionTimeouts := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gateway_function_timeouts_total",
+			Help: "Function calls which exceeded their exec timeout",
+		},
+		[]string{"function_name", "version"},
+	)
+
+	functionInflight := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gateway_function_inflight",
+			Help: "Calls in progress to each function",
+		},
+		[]string{"function_name", "version"},
+	)
+
+	functionQueued := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gateway_function_queued",
+			Help: "Calls waiting for a function's concurrency limit",
+		},
+		[]string{"function_name", "version"},
+	)
+
+	rateLimited := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gateway_function_rate_limited_total",
+			Help: "Calls rejected by a function's rate limit",
+		},
+		[]string{"function_name"},
+	)
+
+	cacheHits := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gateway_function_cache_hits_total",
+			Help: "Calls answered from the response cache",
+		},
+		[]string{"function_name"},
+	)
+
+	cacheMisses := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gateway_function_cache_misses_total",
+			Help: "Calls to cached functions which weren't in the response cache",
+		},
+		[]string{"function_name"},
+	)
+
+	connectionSeconds := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gateway_function_connection_seconds",
+		Help:    "Duration of WebSocket and Server-Sent Events connections to functions",
+		Buckets: []float64{1, 10, 60, 300, 900, 3600, 14400},
+	}, []string{"function_name", "version", "kind"})
+
+	unauthorized := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gateway_function_unauthorized_total",
+			Help: "Calls rejected by a function's auth policy",
+		},
+		[]string{"function_name"},
+	)
+
+	shadowCalls := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gateway_function_shadow_calls_total",
+			Help: "Calls copied to a shadow function by the status of the primary and the shadow",
+		},
+		[]string{"function_name", "shadow", "primary_code", "shadow_code"},
+	)
+
+	shadowLatencyDifference := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gateway_function_shadow_latency_difference_seconds",
+		Help:    "Time taken by a shadow function less the time taken by the primary",
+		Buckets: []float64{-5, -1, -0.5, -0.1, -0.05, -0.01, 0, 0.01, 0.05, 0.1, 0.5, 1, 5},
+	}, []string{"function_name", "shadow"})
+
+	asyncInvocation := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gateway_async_invocation_total",
+			Help: "Queued calls reported by queue workers",
+		},
+		[]string{"function_name", "code"},
+	)
+
+	asyncHistogram := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "gateway_async_seconds",
+		Help: "Time taken by queued calls reported by queue workers",
+	}, []string{"function_name"})
+
 	metricsOptions := MetricOptions{
-		GatewayFunctionsHistogram: gatewayFunctionsHistogram,
-		GatewayFunctionInvocation: gatewayFunctionInvocation,
-		ServiceReplicasCounter:    serviceReplicas,
+		GatewayFunctionsHistogram:  gatewayFunctionsHistogram,
+		GatewayFunctionInvocation:  gatewayFunctionInvocation,
+		ServiceReplicasCounter:     serviceReplicas,
+		GatewayCircuitBreakerState: circuitBreakerState,
+		GatewayFunctionTimeouts:    functionTimeouts,
+		GatewayFunctionInflight:    functionInflight,
+		GatewayFunctionQueued:      functionQueued,
+		GatewayRateLimited:         rateLimited,
+		GatewayCacheHits:           cacheHits,
+		GatewayCacheMisses:         cacheMisses,
+		GatewayConnectionSeconds:   connectionSeconds,
+		GatewayUnauthorized:        unauthorized,
+
+		GatewayShadowCalls:             shadowCalls,
+		GatewayShadowLatencyDifference: shadowLatencyDifference,
+
+		GatewayAsyncInvocation: asyncInvocation,
+		GatewayAsyncHistogram:  asyncHistogram,
 	}
 
 	return metricsOptions
@@ -58,4 +185,17 @@ func RegisterMetrics(metricsOptions MetricOptions) {
 	prometheus.Register(metricsOptions.GatewayFunctionInvocation)
 	prometheus.Register(metricsOptions.GatewayFunctionsHistogram)
 	prometheus.Register(metricsOptions.ServiceReplicasCounter)
+	prometheus.Register(metricsOptions.GatewayCircuitBreakerState)
+	prometheus.Register(metricsOptions.GatewayFunctionTimeouts)
+	prometheus.Register(metricsOptions.GatewayFunctionInflight)
+	prometheus.Register(metricsOptions.GatewayFunctionQueued)
+	prometheus.Register(metricsOptions.GatewayRateLimited)
+	prometheus.Register(metricsOptions.GatewayCacheHits)
+	prometheus.Register(metricsOptions.GatewayCacheMisses)
+	prometheus.Register(metricsOptions.GatewayConnectionSeconds)
+	prometheus.Register(metricsOptions.GatewayUnauthorized)
+	prometheus.Register(metricsOptions.GatewayShadowCalls)
+	prometheus.Register(metricsOptions.GatewayShadowLatencyDifference)
+	prometheus.Register(metricsOptions.GatewayAsyncInvocation)
+	prometheus.Register(metricsOptions.GatewayAsyncHistogram)
 }
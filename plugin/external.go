@@ -7,10 +7,8 @@ import (
 	"bytes"
 	"encoding/json"
 	"log"
-	"net"
 	"net/http"
 	"net/url"
-	"time"
 
 	"fmt"
 
@@ -21,21 +19,7 @@ import (
 )
 
 // NewExternalServiceQuery proxies service queries to external plugin via HTTP
-func NewExternalServiceQuery(externalURL url.URL) handlers.ServiceQuery {
-	proxyClient := http.Client{
-		Transport: &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-			DialContext: (&net.Dialer{
-				Timeout:   3 * time.Second,
-				KeepAlive: 0,
-			}).DialContext,
-			MaxIdleConns:          1,
-			DisableKeepAlives:     true,
-			IdleConnTimeout:       120 * time.Millisecond,
-			ExpectContinueTimeout: 1500 * time.Millisecond,
-		},
-	}
-
+func NewExternalServiceQuery(externalURL url.URL, proxyClient *http.Client) handlers.ServiceQuery {
 	return ExternalServiceQuery{
 		URL:         externalURL,
 		ProxyClient: proxyClient,
@@ -45,7 +29,7 @@ func NewExternalServiceQuery(externalURL url.URL) handlers.ServiceQuery {
 // ExternalServiceQuery proxies service queries to external plugin via HTTP
 type ExternalServiceQuery struct {
 	URL         url.URL
-	ProxyClient http.Client
+	ProxyClient *http.Client
 }
 
 const maxReplicas = 40
@@ -102,13 +86,13 @@ func (s ExternalServiceQuery) SetReplicas(serviceName string, count uint64) erro
 	req, _ := http.NewRequest("POST", urlPath, bytes.NewReader(requestBody))
 	defer req.Body.Close()
 	res, err := s.ProxyClient.Do(req)
-
-	defer res.Body.Close()
-
 	if err != nil {
 		log.Println(urlPath, err)
+		return err
 	}
 
+	defer res.Body.Close()
+
 	if res.StatusCode != http.StatusOK {
 		err = fmt.Errorf("error scaling HTTP code %d, %s", res.StatusCode, urlPath)
 	}
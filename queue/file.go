@@ -0,0 +1,306 @@
+package queue
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// fileLeaseRefresh is how often a FileQueue renews its lease and looks for requests left in
+	// flight by instances which have gone.
+	fileLeaseRefresh = 10 * time.Second
+	// fileLeaseTTL is how long a lease lasts without being renewed.
+	fileLeaseTTL = time.Minute
+)
+
+// fileEntry is a request as written to disk.
+type fileEntry struct {
+	Request  *Request `json:"request"`
+	Attempts int      `json:"attempts"`
+}
+
+// FileQueue keeps each request in a file so requests survive restarts. Requests are moved from
+// pending/ to inflight/ while they're being handled, named with the instance handling them. Each
+// instance renews a lease in leases/, and requests in flight with an instance whose lease has run
+// out, because it crashed or stopped, are moved back to pending/. On Cloud Foundry dir should be
+// on a volume service, as container disks don't outlive the container, and it can be shared by
+// several gateway instances.
+type FileQueue struct {
+	dir   string
+	owner string
+
+	mu     sync.Mutex
+	closed bool
+	ready  chan struct{}
+	stop   chan struct{}
+}
+
+// NewFileQueue uses dir for the queue, creating it when needed.
+func NewFileQueue(dir string) (*FileQueue, error) {
+	owner := make([]byte, 8)
+	rand.Read(owner)
+	q := &FileQueue{
+		dir:   dir,
+		owner: hex.EncodeToString(owner),
+		ready: make(chan struct{}, 1),
+		stop:  make(chan struct{}),
+	}
+	for _, sub := range []string{"pending", "inflight", "leases"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := q.renewLease(); err != nil {
+		return nil, err
+	}
+	if err := q.recoverInflight(); err != nil {
+		return nil, err
+	}
+	go q.maintain()
+	return q, nil
+}
+
+// maintain renews the lease and recovers requests from instances which have gone until Close.
+func (q *FileQueue) maintain() {
+	ticker := time.NewTicker(fileLeaseRefresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-q.stop:
+			return
+		case <-ticker.C:
+		}
+		if err := q.renewLease(); err != nil {
+			log.Printf("Unable to renew queue lease: %s", err)
+		}
+		if err := q.recoverInflight(); err != nil {
+			log.Printf("Unable to recover queued requests: %s", err)
+		}
+	}
+}
+
+func (q *FileQueue) renewLease() error {
+	path := q.path("leases", q.owner)
+	now := time.Now()
+	err := os.Chtimes(path, now, now)
+	if os.IsNotExist(err) {
+		return ioutil.WriteFile(path, nil, 0600)
+	}
+	return err
+}
+
+// leaseExpired reports whether owner has stopped renewing its lease.
+func (q *FileQueue) leaseExpired(owner string) bool {
+	if len(owner) == 0 {
+		return true
+	}
+	info, err := os.Stat(q.path("leases", owner))
+	return err != nil || time.Since(info.ModTime()) > fileLeaseTTL
+}
+
+// inflightName names a request's file while owner is handling it.
+func inflightName(owner string, name string) string {
+	return owner + "_" + name
+}
+
+// recoverInflight moves requests in flight with instances whose lease has run out back to
+// pending/ so they're delivered again.
+func (q *FileQueue) recoverInflight() error {
+	inflight, err := ioutil.ReadDir(q.path("inflight", ""))
+	if err != nil {
+		return err
+	}
+	for _, file := range inflight {
+		owner, name := "", file.Name()
+		if i := strings.Index(name, "_"); i >= 0 {
+			owner, name = name[:i], name[i+1:]
+		}
+		if owner == q.owner || !q.leaseExpired(owner) {
+			continue
+		}
+
+		// Moving the file claims it, so only one instance puts it back.
+		claimed := q.path("inflight", inflightName(q.owner, name))
+		if err := os.Rename(q.path("inflight", file.Name()), claimed); err != nil {
+			continue
+		}
+		entry, err := q.read(claimed)
+		if err != nil {
+			log.Printf("Dropping unreadable queued request %s: %s", name, err)
+			os.Remove(claimed)
+			continue
+		}
+		entry.Attempts++
+		if err := q.write(name, entry); err != nil {
+			return err
+		}
+		os.Remove(claimed)
+		q.signal()
+	}
+
+	leases, err := ioutil.ReadDir(q.path("leases", ""))
+	if err != nil {
+		return err
+	}
+	for _, lease := range leases {
+		if lease.Name() != q.owner && q.leaseExpired(lease.Name()) {
+			os.Remove(q.path("leases", lease.Name()))
+		}
+	}
+	return nil
+}
+
+func (q *FileQueue) path(sub string, name string) string {
+	return filepath.Join(q.dir, sub, name)
+}
+
+func (q *FileQueue) read(path string) (fileEntry, error) {
+	entry := fileEntry{}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return entry, err
+	}
+	err = json.Unmarshal(data, &entry)
+	return entry, err
+}
+
+// write puts an entry in pending/ atomically, so a reader never sees part of a file.
+func (q *FileQueue) write(name string, entry fileEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(q.dir, "write-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), q.path("pending", name))
+}
+
+func (q *FileQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Queue implements CanQueueRequests.
+func (q *FileQueue) Queue(req *Request) error {
+	q.mu.Lock()
+	closed := q.closed
+	q.mu.Unlock()
+	if closed {
+		return ErrClosed
+	}
+
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	// Names sort in the order requests were queued.
+	name := fmt.Sprintf("%020d-%s.json", time.Now().UnixNano(), hex.EncodeToString(suffix))
+	if err := q.write(name, fileEntry{Request: req}); err != nil {
+		return err
+	}
+	q.signal()
+	return nil
+}
+
+// Receive implements Consumer.
+func (q *FileQueue) Receive(ctx context.Context) (*Delivery, error) {
+	for {
+		q.mu.Lock()
+		closed := q.closed
+		q.mu.Unlock()
+		if closed {
+			return nil, ErrClosed
+		}
+
+		pending, err := ioutil.ReadDir(q.path("pending", ""))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range pending {
+			if !strings.HasSuffix(file.Name(), ".json") {
+				continue
+			}
+			// Moving the file claims it, another receiver which lost the race moves on.
+			claimed := q.path("inflight", inflightName(q.owner, file.Name()))
+			if err := os.Rename(q.path("pending", file.Name()), claimed); err != nil {
+				continue
+			}
+			entry, err := q.read(claimed)
+			if err != nil {
+				log.Printf("Dropping unreadable queued request %s: %s", file.Name(), err)
+				os.Remove(claimed)
+				continue
+			}
+			return &Delivery{ID: file.Name(), Request: entry.Request, Attempts: entry.Attempts}, nil
+		}
+
+		select {
+		case <-q.ready:
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Ack implements Consumer.
+func (q *FileQueue) Ack(delivery *Delivery) error {
+	err := os.Remove(q.path("inflight", inflightName(q.owner, delivery.ID)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Nack implements Consumer.
+func (q *FileQueue) Nack(delivery *Delivery) error {
+	entry := fileEntry{Request: delivery.Request, Attempts: delivery.Attempts + 1}
+	if err := q.write(delivery.ID, entry); err != nil {
+		return err
+	}
+	os.Remove(q.path("inflight", inflightName(q.owner, delivery.ID)))
+	q.signal()
+	return nil
+}
+
+// Close implements Provider. Requests on disk are kept, and giving up the lease lets other
+// instances, or the next to start, deliver those still in flight again.
+func (q *FileQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !q.closed {
+		q.closed = true
+		close(q.stop)
+		os.Remove(q.path("leases", q.owner))
+	}
+	return nil
+}
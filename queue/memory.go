@@ -0,0 +1,114 @@
+package queue
+
+import (
+	"context"
+	"strconv"
+	"sync"
+)
+
+// MemoryQueue keeps requests in the gateway's memory, they're lost when the gateway stops.
+type MemoryQueue struct {
+	mu       sync.Mutex
+	pending  []*Delivery
+	inflight map[string]*Delivery
+	next     int
+	closed   bool
+	ready    chan struct{}
+}
+
+// NewMemoryQueue creates an empty MemoryQueue.
+func NewMemoryQueue() *MemoryQueue {
+	return &MemoryQueue{inflight: make(map[string]*Delivery), ready: make(chan struct{}, 1)}
+}
+
+// Queue implements CanQueueRequests.
+func (q *MemoryQueue) Queue(req *Request) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return ErrClosed
+	}
+	q.next++
+	q.pending = append(q.pending, &Delivery{ID: strconv.Itoa(q.next), Request: req})
+	q.signal()
+	return nil
+}
+
+// signal wakes a waiting receiver, the caller holds the lock.
+func (q *MemoryQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Receive implements Consumer.
+func (q *MemoryQueue) Receive(ctx context.Context) (*Delivery, error) {
+	for {
+		q.mu.Lock()
+		if q.closed {
+			q.mu.Unlock()
+			return nil, ErrClosed
+		}
+		if len(q.pending) > 0 {
+			delivery := q.pending[0]
+			q.pending = q.pending[1:]
+			q.inflight[delivery.ID] = delivery
+			if len(q.pending) > 0 {
+				q.signal()
+			}
+			q.mu.Unlock()
+			return delivery, nil
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-q.ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Ack implements Consumer.
+func (q *MemoryQueue) Ack(delivery *Delivery) error {
+	q.mu.Lock()
+	delete(q.inflight, delivery.ID)
+	q.mu.Unlock()
+	return nil
+}
+
+// Nack implements Consumer.
+func (q *MemoryQueue) Nack(delivery *Delivery) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.inflight[delivery.ID]; !ok || q.closed {
+		return nil
+	}
+	delete(q.inflight, delivery.ID)
+	delivery.Attempts++
+	q.pending = append(q.pending, delivery)
+	q.signal()
+	return nil
+}
+
+// Len is the number of requests waiting to be delivered.
+func (q *MemoryQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+// Close implements Provider, receivers return ErrClosed.
+func (q *MemoryQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !q.closed {
+		q.closed = true
+		close(q.ready)
+	}
+	return nil
+}
@@ -0,0 +1,273 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nats-io/go-nats"
+	"github.com/nats-io/go-nats-streaming"
+)
+
+// ErrNotConnected is returned while the NATS Streaming connection is being made.
+var ErrNotConnected = errors.New("not connected to NATS Streaming")
+
+// NATSConfig is where and how requests are published to NATS Streaming.
+type NATSConfig struct {
+	// URL i.e. nats://nats:4222
+	URL       string
+	ClusterID string
+	// ClientID should be unique to each gateway instance.
+	ClientID string
+	Subject  string
+
+	// ReconnectWait is the first wait between attempts to connect, it doubles up to MaxBackoff.
+	ReconnectWait time.Duration
+	MaxBackoff    time.Duration
+
+	// QueueGroup is the durable queue group requests are received in, requests are only
+	// published when empty. Requests which aren't acked within AckWait are delivered again.
+	QueueGroup  string
+	MaxInflight int
+	AckWait     time.Duration
+}
+
+// NATSQueue publishes requests to NATS Streaming for a queue-worker. The connection is made in
+// the background and made again, with backoff, when it's lost.
+type NATSQueue struct {
+	config NATSConfig
+
+	mu         sync.Mutex
+	nc         *nats.Conn
+	sc         stan.Conn
+	connecting bool
+	closed     bool
+
+	deliveries chan *stan.Msg
+	inflight   map[string]*stan.Msg
+	done       chan struct{}
+}
+
+// NewNATSQueue starts connecting to NATS Streaming, requests fail with ErrNotConnected until
+// the connection is made.
+func NewNATSQueue(config NATSConfig) *NATSQueue {
+	q := &NATSQueue{
+		config:     config,
+		deliveries: make(chan *stan.Msg, config.MaxInflight),
+		inflight:   make(map[string]*stan.Msg),
+		done:       make(chan struct{}),
+	}
+	q.reconnect(nil)
+	return q
+}
+
+// reconnect replaces the streaming connection, unless failed has already been replaced or
+// another reconnect is under way.
+func (q *NATSQueue) reconnect(failed stan.Conn) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed || q.connecting || q.sc != failed {
+		return
+	}
+	if q.sc != nil {
+		q.sc.Close()
+		q.sc = nil
+	}
+	q.connecting = true
+	go q.connect()
+}
+
+func (q *NATSQueue) connect() {
+	wait := q.config.ReconnectWait
+	for {
+		sc, err := q.dial()
+		q.mu.Lock()
+		if q.closed {
+			q.connecting = false
+			q.mu.Unlock()
+			if sc != nil {
+				sc.Close()
+			}
+			return
+		}
+		if err == nil {
+			q.sc = sc
+			q.connecting = false
+			q.mu.Unlock()
+			log.Printf("Connected to NATS Streaming cluster %s as %s", q.config.ClusterID, q.config.ClientID)
+			return
+		}
+		q.mu.Unlock()
+
+		log.Printf("Unable to connect to NATS Streaming at %s, retrying in %s: %s", q.config.URL, wait, err)
+		time.Sleep(wait)
+		if wait *= 2; wait > q.config.MaxBackoff {
+			wait = q.config.MaxBackoff
+		}
+	}
+}
+
+// dial connects to NATS, which reconnects by itself, and then opens a streaming session on it.
+func (q *NATSQueue) dial() (stan.Conn, error) {
+	q.mu.Lock()
+	nc := q.nc
+	q.mu.Unlock()
+
+	if nc == nil || nc.IsClosed() {
+		var err error
+		nc, err = nats.Connect(q.config.URL,
+			nats.Name(q.config.ClientID),
+			nats.MaxReconnects(-1),
+			nats.ReconnectWait(q.config.ReconnectWait),
+			nats.DisconnectHandler(func(*nats.Conn) {
+				log.Printf("Disconnected from NATS at %s", q.config.URL)
+			}),
+			nats.ReconnectHandler(func(c *nats.Conn) {
+				log.Printf("Reconnected to NATS at %s", c.ConnectedUrl())
+			}))
+		if err != nil {
+			return nil, err
+		}
+		q.mu.Lock()
+		q.nc = nc
+		q.mu.Unlock()
+	}
+
+	sc, err := stan.Connect(q.config.ClusterID, q.config.ClientID, stan.NatsConn(nc))
+	if err != nil || len(q.config.QueueGroup) == 0 {
+		return sc, err
+	}
+
+	_, err = sc.QueueSubscribe(q.config.Subject, q.config.QueueGroup, q.receive,
+		stan.DurableName(q.config.QueueGroup),
+		stan.SetManualAckMode(),
+		stan.MaxInflight(q.config.MaxInflight),
+		stan.AckWait(q.config.AckWait))
+	if err != nil {
+		sc.Close()
+		return nil, err
+	}
+	return sc, nil
+}
+
+// receive hands a message from the subscription to Receive.
+func (q *NATSQueue) receive(msg *stan.Msg) {
+	select {
+	case q.deliveries <- msg:
+	case <-q.done:
+	}
+}
+
+// Queue implements CanQueueRequests.
+func (q *NATSQueue) Queue(req *Request) error {
+	out, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	sc, closed := q.sc, q.closed
+	q.mu.Unlock()
+	if closed {
+		return ErrClosed
+	}
+	if sc == nil {
+		return ErrNotConnected
+	}
+
+	if err := sc.Publish(q.config.Subject, out); err != nil {
+		// The streaming server may have restarted and forgotten the session.
+		if err == stan.ErrConnectionClosed || err == stan.ErrBadConnection || err == stan.ErrTimeout {
+			q.reconnect(sc)
+		}
+		return err
+	}
+	return nil
+}
+
+// Receive implements Consumer, it needs a QueueGroup. The streaming server doesn't count
+// deliveries, so attempts travel in the request and a redelivery after AckWait adds one.
+func (q *NATSQueue) Receive(ctx context.Context) (*Delivery, error) {
+	for {
+		select {
+		case msg := <-q.deliveries:
+			req := Request{}
+			if err := json.Unmarshal(msg.Data, &req); err != nil {
+				log.Printf("Dropping unreadable queued request %d: %s", msg.Sequence, err)
+				msg.Ack()
+				continue
+			}
+
+			delivery := &Delivery{ID: strconv.FormatUint(msg.Sequence, 10), Request: &req, Attempts: req.Attempts}
+			if msg.Redelivered {
+				delivery.Attempts++
+			}
+			q.mu.Lock()
+			q.inflight[delivery.ID] = msg
+			q.mu.Unlock()
+			return delivery, nil
+		case <-q.done:
+			return nil, ErrClosed
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (q *NATSQueue) take(delivery *Delivery) *stan.Msg {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	msg := q.inflight[delivery.ID]
+	delete(q.inflight, delivery.ID)
+	return msg
+}
+
+// Ack implements Consumer.
+func (q *NATSQueue) Ack(delivery *Delivery) error {
+	if msg := q.take(delivery); msg != nil {
+		return msg.Ack()
+	}
+	return nil
+}
+
+// Nack implements Consumer. The request is published again with its attempts counted and the
+// original acked, if publishing fails the original is delivered again once AckWait has passed.
+func (q *NATSQueue) Nack(delivery *Delivery) error {
+	msg := q.take(delivery)
+	if msg == nil {
+		return nil
+	}
+
+	retry := *delivery.Request
+	retry.Attempts = delivery.Attempts + 1
+	if err := q.Queue(&retry); err != nil {
+		return err
+	}
+	return msg.Ack()
+}
+
+// Close implements Provider.
+func (q *NATSQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return nil
+	}
+	q.closed = true
+	close(q.done)
+	if q.sc != nil {
+		q.sc.Close()
+		q.sc = nil
+	}
+	if q.nc != nil {
+		q.nc.Close()
+	}
+	return nil
+}
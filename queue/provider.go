@@ -0,0 +1,33 @@
+package queue
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrClosed is returned once a provider has been closed.
+var ErrClosed = errors.New("queue closed")
+
+// Provider is a queue backend the gateway publishes asynchronous requests to.
+type Provider interface {
+	CanQueueRequests
+	Close() error
+}
+
+// Delivery is a request taken from a queue, which stays on the queue until it's acked.
+type Delivery struct {
+	ID      string
+	Request *Request
+	// Attempts counts earlier deliveries of the request which weren't acked.
+	Attempts int
+}
+
+// Consumer is implemented by providers the gateway can take requests from itself.
+type Consumer interface {
+	// Receive blocks until a request is available or ctx is done.
+	Receive(ctx context.Context) (*Delivery, error)
+	// Ack removes a delivered request from the queue.
+	Ack(delivery *Delivery) error
+	// Nack returns a delivered request to the queue to be delivered again.
+	Nack(delivery *Delivery) error
+}
@@ -14,6 +14,9 @@ type Request struct {
 	QueryString string
 	Function    string
 	CallbackURL *url.URL `json:"CallbackUrl"`
+
+	// Attempts counts earlier deliveries, for queues which don't count them.
+	Attempts int `json:"Attempts,omitempty"`
 }
 
 // CanQueueRequests can take on asynchronous requests
@@ -25,8 +25,17 @@ type CreateFunctionRequest struct {
 	// (see ~/.docker/config.json)
 	RegistryAuth string `json:"registryAuth,omitempty"`
 
-	// Constraints are specific to back-end orchestration platform
+	// Constraints place the function's app, supported expressions are
+	// org == <name>, space == <name> and isolation_segment == <name>
 	Constraints []string `json:"constraints"`
+
+	// Version deploys the function as a separate app i.e. name-v3 which
+	// receives traffic according to the function's traffic policy.
+	Version string `json:"version,omitempty"`
+
+	// Labels tune how the gateway calls the function i.e.
+	// com.openfaas.exec_timeout, com.openfaas.max_inflight or com.openfaas.retry.attempts
+	Labels map[string]string `json:"labels,omitempty"`
 }
 
 // DeleteFunctionRequest delete a deployed function
@@ -60,6 +69,34 @@ type Function struct {
 	InvocationCount float64 `json:"invocationCount"` // TODO: shouldn't this be int64?
 	Replicas        uint64  `json:"replicas"`
 	EnvProcess      string  `json:"envProcess"`
+
+	// Constraints the function was deployed with i.e. isolation_segment == gpu-free
+	Constraints []string `json:"constraints,omitempty"`
+
+	// Version is set when the app is one version of a function.
+	Version string `json:"version,omitempty"`
+
+	// Labels the function was deployed with.
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// TrafficPolicy splits calls to a function between its versions by weight.
+type TrafficPolicy struct {
+	// Weights maps versions to their relative share i.e. {"v2": 90, "v3": 10}
+	Weights map[string]int `json:"weights"`
+
+	// StickyHeader routes calls with the same value for this header to the same version.
+	StickyHeader string `json:"stickyHeader,omitempty"`
+}
+
+// FunctionRevision is a droplet a function has been deployed with.
+type FunctionRevision struct {
+	Revision  string `json:"revision"`
+	Image     string `json:"image"`
+	CreatedAt string `json:"createdAt"`
+	// EnvHash identifies the environment deployed with the revision.
+	EnvHash string `json:"envHash,omitempty"`
+	Current bool   `json:"current"`
 }
 
 // AsyncReport is the report from a function executed on a queue worker.
@@ -68,3 +105,98 @@ type AsyncReport struct {
 	StatusCode   int     `json:"statusCode"`
 	TimeTaken    float64 `json:"timeTaken"`
 }
+
+// Pipeline runs functions in sequence, each step receives the previous step's response.
+type Pipeline struct {
+	Name  string         `json:"name"`
+	Steps []PipelineStep `json:"steps"`
+}
+
+// PipelineStep is one function call within a pipeline.
+type PipelineStep struct {
+	Function string `json:"function"`
+
+	// Timeout bounds the step i.e. 10s, the function's own exec timeout applies when empty.
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// ScatterRequest calls several functions or bodies at once through /system/scatter.
+type ScatterRequest struct {
+	// Function and Body are used by calls which don't set their own.
+	Function     string `json:"function,omitempty"`
+	Body         string `json:"body,omitempty"`
+	BodyEncoding string `json:"bodyEncoding,omitempty"`
+
+	Calls []ScatterCall `json:"calls"`
+
+	// Parallelism limits the calls in progress at once, 8 when empty.
+	Parallelism int `json:"parallelism,omitempty"`
+
+	// Timeout bounds each call i.e. 10s.
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// ScatterCall is one call within a ScatterRequest, BodyEncoding may be "base64" for binary bodies.
+type ScatterCall struct {
+	Function     string `json:"function,omitempty"`
+	Body         string `json:"body,omitempty"`
+	BodyEncoding string `json:"bodyEncoding,omitempty"`
+	ContentType  string `json:"contentType,omitempty"`
+}
+
+// ScatterResult is the outcome of one call, in the same order as the calls.
+type ScatterResult struct {
+	Function     string  `json:"function"`
+	Status       int     `json:"status"`
+	Body         string  `json:"body"`
+	BodyEncoding string  `json:"bodyEncoding,omitempty"`
+	ContentType  string  `json:"contentType,omitempty"`
+	Duration     float64 `json:"durationSeconds"`
+	Error        string  `json:"error,omitempty"`
+}
+
+// ScatterResponse gathers the results of a ScatterRequest.
+type ScatterResponse struct {
+	Results []ScatterResult `json:"results"`
+}
+
+// FunctionRoute sends calls for a host and path prefix to a function i.e. api.example.com/orders
+// to orders-fn. An empty Host matches any host.
+type FunctionRoute struct {
+	Host     string `json:"host,omitempty"`
+	Path     string `json:"path"`
+	Function string `json:"function"`
+
+	// StripPrefix removes Path before calling the function, so api.example.com/orders/1 calls /1.
+	StripPrefix bool `json:"stripPrefix,omitempty"`
+}
+
+// APIKey allows calls to functions with the apikey auth policy. Key is only returned when the
+// key is created, the gateway keeps a hash of it.
+type APIKey struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+
+	// Functions the key may call, any function when empty.
+	Functions []string `json:"functions,omitempty"`
+
+	// Created is an RFC 3339 time.
+	Created string `json:"created"`
+
+	Key string `json:"key,omitempty"`
+}
+
+// CallResult is the outcome of a call which carried on in the background after the gateway
+// accepted it, see /system/results/{id}.
+type CallResult struct {
+	CallID   string `json:"callId"`
+	Function string `json:"function"`
+
+	// Status is pending until the function responds, then done.
+	Status string `json:"status"`
+
+	StatusCode int                 `json:"statusCode,omitempty"`
+	Header     map[string][]string `json:"header,omitempty"`
+	Body       []byte              `json:"body,omitempty"`
+	Duration   float64             `json:"durationSeconds,omitempty"`
+}
@@ -4,6 +4,8 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
 	"fmt"
 	"log"
 	"net/http"
@@ -13,12 +15,13 @@ import (
 	"time"
 
 	"github.com/Sirupsen/logrus"
-	natsHandler "github.com/alexellis/faas-nats/handler"
 	"github.com/gorilla/mux"
 	cfclient "github.com/nwright-nz/go-cfclient"
 	internalHandlers "github.com/nwright-nz/openfaas-cf-backend/handlers"
 	"github.com/nwright-nz/openfaas-cf-backend/metrics"
 	"github.com/nwright-nz/openfaas-cf-backend/plugin"
+	"github.com/nwright-nz/openfaas-cf-backend/queue"
+	"github.com/nwright-nz/openfaas-cf-backend/tracing"
 	"github.com/nwright-nz/openfaas-cf-backend/types"
 )
 
@@ -30,11 +33,35 @@ type handlerSet struct {
 	Alert          http.HandlerFunc
 	RoutelessProxy http.HandlerFunc
 
+	// Traffic - read or set the traffic policy across versions of a function
+	Traffic http.HandlerFunc
+
+	// Revisions - list the droplets a function has been deployed with
+	Revisions http.HandlerFunc
+
+	// Rollback - run a function on an earlier droplet
+	Rollback http.HandlerFunc
+
+	// PurgeCache - drop the cached responses of a function
+	PurgeCache http.HandlerFunc
+
 	// QueuedProxy - queue work and return synchronous response
 	QueuedProxy http.HandlerFunc
 
 	// AsyncReport - report a defered execution result
 	AsyncReport http.HandlerFunc
+
+	// Pipelines - store named chains of functions
+	Pipelines http.HandlerFunc
+
+	// Results - fetch the results of calls which carried on in the background
+	Results http.HandlerFunc
+
+	// APIKeys - create and revoke keys for functions with the apikey auth policy
+	APIKeys http.HandlerFunc
+
+	// Routes - map custom hostnames and paths to functions
+	Routes http.HandlerFunc
 }
 
 func main() {
@@ -58,7 +85,7 @@ func main() {
 
 	client, err := cfclient.NewClient(c)
 	if err != nil {
-		log.Printf("ERROR: " + err.Error())
+		log.Printf("ERROR: %s", err.Error())
 		log.Fatal("Can't create Cloud Foundry client")
 	} else {
 		log.Printf("Successfully connected to cloud foundry")
@@ -68,28 +95,112 @@ func main() {
 	metrics.RegisterMetrics(metricsOptions)
 
 	var faasHandlers handlerSet
+	var pipelines internalHandlers.PipelineStore
+	var authenticator *internalHandlers.Authenticator
+	var cors func(next http.HandlerFunc) http.HandlerFunc
+	idempotency := internalHandlers.NewMemoryIdempotencyStore()
+	trustedProxies, err := internalHandlers.ParseTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		log.Fatalf("faas_trusted_proxies: %s", err)
+	}
+	routes := internalHandlers.NewRouteTable(internalHandlers.NewMemoryRouteStore(), time.Second*30)
+
+	// One transport is shared by every call to functions and providers so connections are re-used.
+	proxyClient := types.NewProxyClient(config)
 
 	if config.UseExternalProvider() {
 
 		reverseProxy := httputil.NewSingleHostReverseProxy(config.FunctionsProviderURL)
+		reverseProxy.Transport = proxyClient.Transport
 
-		faasHandlers.Proxy = internalHandlers.MakeForwardingProxyHandler(reverseProxy, &metricsOptions)
-		faasHandlers.RoutelessProxy = internalHandlers.MakeForwardingProxyHandler(reverseProxy, &metricsOptions)
+		faasHandlers.Proxy = internalHandlers.MakeCallIDHandler(internalHandlers.MakeForwardingProxyHandler(reverseProxy, &metricsOptions))
+		faasHandlers.RoutelessProxy = internalHandlers.MakeCallIDHandler(internalHandlers.MakeForwardingProxyHandler(reverseProxy, &metricsOptions))
 		faasHandlers.ListFunctions = internalHandlers.MakeForwardingProxyHandler(reverseProxy, &metricsOptions)
 		faasHandlers.DeployFunction = internalHandlers.MakeForwardingProxyHandler(reverseProxy, &metricsOptions)
 		faasHandlers.DeleteFunction = internalHandlers.MakeForwardingProxyHandler(reverseProxy, &metricsOptions)
-		alertHandler := plugin.NewExternalServiceQuery(*config.FunctionsProviderURL)
+		alertHandler := plugin.NewExternalServiceQuery(*config.FunctionsProviderURL, proxyClient)
 		faasHandlers.Alert = internalHandlers.MakeAlertHandler(alertHandler)
 
-		metrics.AttachExternalWatcher(*config.FunctionsProviderURL, metricsOptions, "func", time.Second*5)
+		metrics.AttachExternalWatcher(*config.FunctionsProviderURL, metricsOptions, "func", time.Second*5, proxyClient)
 
 	} else {
 		maxRestarts := uint64(5)
 		print(maxRestarts)
-		faasHandlers.Proxy = internalHandlers.MakeProxy(metricsOptions, true, client, &logger)
-		faasHandlers.RoutelessProxy = internalHandlers.MakeProxy(metricsOptions, true, client, &logger)
+
+		var balancer *internalHandlers.InstanceBalancer
+		if config.DirectFunctions {
+			discovery := internalHandlers.NewStatsDiscovery(client)
+			if len(config.InternalDomain) > 0 {
+				discovery = internalHandlers.NewInternalDomainDiscovery(config.InternalDomain, config.InternalPort)
+			}
+			balancer = internalHandlers.NewInstanceBalancer(discovery, config.LoadBalancer, config.EjectionTime, config.InstanceRefresh)
+			log.Printf("Direct functions enabled, load balancer: %s", config.LoadBalancer)
+		}
+
+		splitter := internalHandlers.NewTrafficSplitter(client, time.Second*30)
+		resilience := internalHandlers.NewResilience(metricsOptions)
+
+		labelCache := internalHandlers.NewLabelCache(client, time.Second*30)
+		rateLimits := internalHandlers.NewMemoryRateLimitStore()
+		responseCache := internalHandlers.NewResponseCache(config.CacheMaxBytes)
+
+		proxy := internalHandlers.MakeProxy(metricsOptions, true, client, balancer, splitter, resilience, config, proxyClient, &logger)
+		// Shadow copies call the function in their X-Function header on the proxy itself.
+		proxy = internalHandlers.MakeShadowHandler(proxy, labelCache.Lookup, proxy, metricsOptions)
+		results := internalHandlers.NewMemoryResultStore(config.ResultTTL)
+		proxy = internalHandlers.MakeAsyncFallbackHandler(proxy, labelCache.Lookup, results, proxyClient)
+		faasHandlers.Results = internalHandlers.MakeResultHandler(results)
+		proxy = internalHandlers.MakeCacheHandler(proxy, labelCache.Lookup, responseCache, splitter, metricsOptions)
+		proxy = internalHandlers.MakeRateLimitHandler(proxy, labelCache.Lookup, rateLimits, metricsOptions)
+		proxy = internalHandlers.MakeIdempotencyHandler(proxy, idempotency, config.IdempotencyTTL)
+
+		keyStore := internalHandlers.APIKeyStore(internalHandlers.NewMemoryAPIKeyStore())
+		if len(config.GatewayAppGUID) > 0 {
+			keyStore = internalHandlers.NewAppAPIKeyStore(client, config.GatewayAppGUID)
+		}
+		apiKeys := internalHandlers.NewAPIKeys(keyStore, time.Second*30)
+		var jwtVerifier *internalHandlers.JWTVerifier
+		if len(config.AuthJWKS) > 0 {
+			jwtVerifier = internalHandlers.NewJWTVerifier(config.AuthJWKS, config.AuthJWTIssuer, config.AuthJWTAudience, time.Minute*5, proxyClient)
+		}
+		authenticator = internalHandlers.NewAuthenticator(labelCache.Lookup, apiKeys, jwtVerifier, metricsOptions)
+		proxy = internalHandlers.MakeAuthHandler(proxy, authenticator)
+		if len(config.AdminToken) > 0 {
+			faasHandlers.APIKeys = internalHandlers.MakeAdminAuthHandler(internalHandlers.MakeAPIKeysHandler(apiKeys), config.AdminToken)
+		} else {
+			log.Println("faas_admin_token not set, /system/keys is disabled")
+		}
+
+		corsDefaults := internalHandlers.DefaultCORSPolicy(config)
+		proxy = internalHandlers.MakeCORSHandler(proxy, labelCache.Lookup, corsDefaults)
+		cors = func(next http.HandlerFunc) http.HandlerFunc {
+			return internalHandlers.MakeCORSHandler(next, labelCache.Lookup, corsDefaults)
+		}
+
+		proxy = internalHandlers.MakeClientIPHandler(proxy, trustedProxies)
+		proxy = internalHandlers.MakeCallIDHandler(proxy)
+
+		faasHandlers.Proxy = proxy
+		faasHandlers.RoutelessProxy = proxy
+		faasHandlers.PurgeCache = internalHandlers.MakeCachePurgeHandler(responseCache)
 		faasHandlers.ListFunctions = internalHandlers.MakeFunctionReader(metricsOptions, client)
-		faasHandlers.DeployFunction = internalHandlers.MakeNewFunctionHandler(metricsOptions, client, maxRestarts)
+		faasHandlers.DeployFunction = internalHandlers.MakeNewFunctionHandler(metricsOptions, client, config, splitter, maxRestarts)
+		faasHandlers.Traffic = internalHandlers.MakeTrafficHandler(splitter)
+		faasHandlers.Revisions = internalHandlers.MakeRevisionsHandler(metricsOptions, client)
+		faasHandlers.Rollback = internalHandlers.MakeRollbackHandler(metricsOptions, client)
+
+		pipelines = internalHandlers.NewMemoryPipelineStore()
+		if len(config.GatewayAppGUID) > 0 {
+			pipelines = internalHandlers.NewAppPipelineStore(client, config.GatewayAppGUID)
+		}
+		faasHandlers.Pipelines = internalHandlers.MakePipelinesHandler(pipelines)
+
+		routes = internalHandlers.NewRouteTable(internalHandlers.NewAppRouteStore(client), time.Second*30)
+		if len(config.AdminToken) > 0 {
+			faasHandlers.Routes = internalHandlers.MakeAdminAuthHandler(internalHandlers.MakeRoutesHandler(routes), config.AdminToken)
+		} else {
+			log.Println("faas_admin_token not set, /system/routes is disabled")
+		}
 		//faasHandlers.DeleteFunction = internalHandlers.MakeDeleteFunctionHandler(metricsOptions, cfClient)
 
 		//Nigel - To implement the alerting/scaling.
@@ -100,14 +211,54 @@ func main() {
 		//metrics.AttachSwarmWatcher(dockerClient, metricsOptions, functionLabel)
 	}
 
-	if config.UseNATS() {
+	var asyncQueue queue.Provider
+	switch config.QueueBackend {
+	case "nats":
+		if !config.UseNATS() {
+			log.Fatalln("faas_queue_backend nats needs faas_nats_address and faas_nats_port")
+		}
 		log.Println("Async enabled: Using NATS Streaming.")
-		natsQueue, queueErr := natsHandler.CreateNatsQueue(*config.NATSAddress, *config.NATSPort)
+		natsConfig := queue.NATSConfig{
+			URL:           fmt.Sprintf("nats://%s:%d", *config.NATSAddress, *config.NATSPort),
+			ClusterID:     config.NATSClusterID,
+			ClientID:      config.NATSClientID,
+			Subject:       config.NATSSubject,
+			ReconnectWait: time.Second,
+			MaxBackoff:    time.Second * 30,
+		}
+		// The gateway only joins the queue group when it runs queued calls itself.
+		if config.QueueWorkers > 0 {
+			natsConfig.QueueGroup = config.NATSQueueGroup
+			natsConfig.MaxInflight = config.QueueWorkers
+			natsConfig.AckWait = config.NATSAckWait
+		}
+		asyncQueue = queue.NewNATSQueue(natsConfig)
+	case "memory":
+		log.Println("Async enabled: Using an in-memory queue, queued calls are lost on restart.")
+		asyncQueue = queue.NewMemoryQueue()
+	case "file":
+		log.Printf("Async enabled: Using a file queue in %s.\n", config.QueueDir)
+		fileQueue, queueErr := queue.NewFileQueue(config.QueueDir)
 		if queueErr != nil {
 			log.Fatalln(queueErr)
 		}
+		asyncQueue = fileQueue
+	}
+	if asyncQueue != nil && config.QueueBackend != "nats" && config.QueueWorkers == 0 {
+		log.Println("faas_queue_workers not set, queued calls won't run without a queue worker")
+	}
 
-		faasHandlers.QueuedProxy = internalHandlers.MakeQueuedProxy(metricsOptions, true, &logger, natsQueue)
+	if asyncQueue != nil {
+		queuedProxy := internalHandlers.MakeQueuedProxy(metricsOptions, true, &logger, asyncQueue)
+		queuedProxy = internalHandlers.MakeIdempotencyHandler(queuedProxy, idempotency, config.IdempotencyTTL)
+		if authenticator != nil {
+			queuedProxy = internalHandlers.MakeAuthHandler(queuedProxy, authenticator)
+		}
+		if cors != nil {
+			queuedProxy = cors(queuedProxy)
+		}
+		queuedProxy = internalHandlers.MakeClientIPHandler(queuedProxy, trustedProxies)
+		faasHandlers.QueuedProxy = internalHandlers.MakeCallIDHandler(queuedProxy)
 		faasHandlers.AsyncReport = internalHandlers.MakeAsyncReport(metricsOptions)
 	}
 
@@ -117,7 +268,7 @@ func main() {
 
 	// r.StrictSlash(false)	// This didn't work, so register routes twice.
 	r.HandleFunc("/function/{name:[-a-zA-Z_0-9]+}", faasHandlers.Proxy)
-	r.HandleFunc("/function/{name:[-a-zA-Z_0-9]+}/", faasHandlers.Proxy)
+	r.PathPrefix("/function/{name:[-a-zA-Z_0-9]+}/").HandlerFunc(faasHandlers.Proxy)
 
 	// TODO: implement alerting
 	//r.HandleFunc("/system/alert", faasHandlers.Alert)
@@ -125,11 +276,79 @@ func main() {
 	r.HandleFunc("/system/functions", faasHandlers.DeployFunction).Methods("POST")
 	r.HandleFunc("/system/functions", faasHandlers.DeleteFunction).Methods("DELETE")
 
+	if faasHandlers.Traffic != nil {
+		r.HandleFunc("/system/functions/{name:[-a-zA-Z_0-9]+}/traffic", faasHandlers.Traffic).Methods("GET", "POST", "PUT")
+	}
+
+	if faasHandlers.Revisions != nil {
+		r.HandleFunc("/system/functions/{name:[-a-zA-Z_0-9]+}/revisions", faasHandlers.Revisions).Methods("GET")
+		r.HandleFunc("/system/functions/{name:[-a-zA-Z_0-9]+}/rollback", faasHandlers.Rollback).Methods("POST")
+	}
+
+	if faasHandlers.PurgeCache != nil {
+		r.HandleFunc("/system/functions/{name:[-a-zA-Z_0-9]+}/cache", faasHandlers.PurgeCache).Methods("DELETE")
+	}
+
 	if faasHandlers.QueuedProxy != nil {
-		r.HandleFunc("/async-function/{name:[-a-zA-Z_0-9]+}/", faasHandlers.QueuedProxy).Methods("POST")
-		r.HandleFunc("/async-function/{name:[-a-zA-Z_0-9]+}", faasHandlers.QueuedProxy).Methods("POST")
-		//TODO: implement alerting
-		//	r.HandleFunc("/system/async-report", faasHandlers.AsyncReport)
+		// OPTIONS is only routed when the gateway answers CORS preflights.
+		asyncMethods := []string{"POST"}
+		if cors != nil {
+			asyncMethods = append(asyncMethods, "OPTIONS")
+		}
+		r.HandleFunc("/async-function/{name:[-a-zA-Z_0-9]+}/", faasHandlers.QueuedProxy).Methods(asyncMethods...)
+		r.HandleFunc("/async-function/{name:[-a-zA-Z_0-9]+}", faasHandlers.QueuedProxy).Methods(asyncMethods...)
+		r.HandleFunc("/system/async-report", faasHandlers.AsyncReport).Methods("POST")
+	}
+
+	if faasHandlers.Results != nil {
+		r.HandleFunc("/system/results/{id:[0-9a-f]+}", faasHandlers.Results).Methods("GET")
+	}
+
+	if faasHandlers.APIKeys != nil {
+		r.HandleFunc("/system/keys", faasHandlers.APIKeys).Methods("GET", "POST")
+		r.HandleFunc("/system/keys/{id:[0-9a-f]+}", faasHandlers.APIKeys).Methods("DELETE")
+	}
+
+	if faasHandlers.Routes != nil {
+		r.HandleFunc("/system/routes", faasHandlers.Routes).Methods("GET", "POST", "PUT", "DELETE")
+	}
+
+	// Calls are made through the router so they take the same path as /function/ calls.
+	r.HandleFunc("/system/scatter", internalHandlers.MakeScatterHandler(r)).Methods("POST")
+
+	if faasHandlers.Pipelines != nil {
+		// Steps are called through the router so they take the same path as /function/ calls.
+		pipeline := internalHandlers.MakePipelineHandler(r, pipelines)
+		r.HandleFunc("/pipeline", pipeline).Methods("POST")
+		r.HandleFunc("/pipeline/{name:[-a-zA-Z_0-9.]+}", pipeline).Methods("POST")
+		r.HandleFunc("/system/pipelines", faasHandlers.Pipelines).Methods("GET", "POST", "PUT")
+		r.HandleFunc("/system/pipelines/{name:[-a-zA-Z_0-9.]+}", faasHandlers.Pipelines).Methods("GET", "DELETE")
+
+		if asyncQueue != nil && len(config.GatewayURL) > 0 {
+			secret := []byte(config.CallbackSecret)
+			if len(secret) == 0 {
+				secret = make([]byte, 32)
+				rand.Read(secret)
+				log.Println("faas_callback_secret not set, queued pipelines only work with a single gateway instance")
+			}
+			pipelineQueue := &internalHandlers.PipelineQueue{Queue: asyncQueue, GatewayURL: config.GatewayURL, Secret: secret}
+
+			asyncPipeline := internalHandlers.MakeAsyncPipelineHandler(pipelines, pipelineQueue, authenticator)
+			r.HandleFunc("/async-pipeline", asyncPipeline).Methods("POST")
+			r.HandleFunc("/async-pipeline/{name:[-a-zA-Z_0-9.]+}", asyncPipeline).Methods("POST")
+			r.HandleFunc("/system/pipeline-callback", internalHandlers.MakePipelineCallbackHandler(pipelineQueue, proxyClient)).Methods("POST")
+		}
+	}
+
+	if asyncQueue != nil && config.QueueWorkers > 0 {
+		consumer, ok := asyncQueue.(queue.Consumer)
+		if !ok {
+			log.Fatalf("faas_queue_workers is set but faas_queue_backend %s can't be consumed by the gateway", config.QueueBackend)
+		}
+		log.Printf("Running queued calls with %d workers", config.QueueWorkers)
+		// Queued calls are made through the router so they take the same path as /function/ calls.
+		worker := internalHandlers.NewQueueWorker(consumer, r, proxyClient, config.QueueWorkers, config.QueueMaxAttempts)
+		go worker.Run(context.Background())
 	}
 
 	fs := http.FileServer(http.Dir("./assets/"))
@@ -146,12 +365,20 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	// Custom hostnames and paths are rewritten to /function/{name} before the router sees them.
+	var handler http.Handler = internalHandlers.MakeRouteHandler(r, routes)
+	if len(config.TracingEndpoint) > 0 {
+		exporter := tracing.NewOTLPExporter(config.TracingEndpoint, config.TracingServiceName, time.Second*5, proxyClient)
+		handler = tracing.NewTracer(exporter, config.TracingSampleRatio).Handler(handler)
+		log.Printf("Tracing enabled, exporting to %s", config.TracingEndpoint)
+	}
+
 	s := &http.Server{
 		Addr:           fmt.Sprintf(":%d", tcpPort),
 		ReadTimeout:    config.ReadTimeout,
 		WriteTimeout:   config.WriteTimeout,
 		MaxHeaderBytes: http.DefaultMaxHeaderBytes, // 1MB - can be overridden by setting Server.MaxHeaderBytes.
-		Handler:        r,
+		Handler:        handler,
 	}
 
 	log.Fatal(s.ListenAndServe())
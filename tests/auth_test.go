@@ -0,0 +1,180 @@
+package tests
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nwright-nz/openfaas-cf-backend/handlers"
+	"github.com/nwright-nz/openfaas-cf-backend/metrics"
+	"github.com/nwright-nz/openfaas-cf-backend/requests"
+)
+
+func makeAuthRouter(labels map[string]string, keys *handlers.APIKeys, verifier *handlers.JWTVerifier) *mux.Router {
+	lookup := func(name string) (map[string]string, error) {
+		return labels, nil
+	}
+	function := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Jwt-Claim-Sub") + r.Header.Get("X-Api-Key-Name") + r.Header.Get("X-Api-Key-Id")))
+	}
+
+	authenticator := handlers.NewAuthenticator(lookup, keys, verifier, metrics.BuildMetricsOptions())
+	router := mux.NewRouter()
+	router.HandleFunc("/function/{name}", handlers.MakeAuthHandler(function, authenticator))
+	return router
+}
+
+func callWithHeader(router *mux.Router, header string, value string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/function/orders", nil)
+	if len(header) > 0 {
+		req.Header.Set(header, value)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestAuth_APIKeys(t *testing.T) {
+	keys := handlers.NewAPIKeys(handlers.NewMemoryAPIKeyStore(), time.Minute)
+	keysHandler := handlers.MakeAPIKeysHandler(keys)
+
+	rr := httptest.NewRecorder()
+	keysHandler(rr, httptest.NewRequest(http.MethodPost, "/system/keys", strings.NewReader(`{"name":"ci","functions":["orders"]}`)))
+	created := requests.APIKey{}
+	json.Unmarshal(rr.Body.Bytes(), &created)
+	if rr.Code != http.StatusCreated || len(created.Key) == 0 {
+		t.Logf("Want 201 with the key, got %d %s", rr.Code, rr.Body.String())
+		t.Fail()
+		return
+	}
+
+	rr = httptest.NewRecorder()
+	keysHandler(rr, httptest.NewRequest(http.MethodGet, "/system/keys", nil))
+	if strings.Contains(rr.Body.String(), created.Key) {
+		t.Log("Want keys listed without the key itself")
+		t.Fail()
+	}
+
+	router := makeAuthRouter(map[string]string{handlers.AuthLabel: "apikey"}, keys, nil)
+	if rr := callWithHeader(router, "X-API-Key", created.Key); rr.Code != http.StatusOK || rr.Body.String() != "ci"+created.ID {
+		t.Logf("Want 200 for a valid key, got %d %s", rr.Code, rr.Body.String())
+		t.Fail()
+	}
+	if rr := callWithHeader(router, "X-API-Key", created.ID+".wrong"); rr.Code != http.StatusUnauthorized {
+		t.Logf("Want 401 for a wrong key, got %d", rr.Code)
+		t.Fail()
+	}
+	if rr := callWithHeader(router, "X-Api-Key-Name", "forged"); rr.Code != http.StatusUnauthorized {
+		t.Logf("Want 401 without a key, got %d", rr.Code)
+		t.Fail()
+	}
+
+	public := makeAuthRouter(map[string]string{}, keys, nil)
+	for _, header := range []string{"X-Api-Key-Name", "X-Api-Key-Id"} {
+		if rr := callWithHeader(public, header, "forged"); rr.Code != http.StatusOK || rr.Body.String() != "" {
+			t.Logf("Want public calls allowed with a forged %s removed, got %d %s", header, rr.Code, rr.Body.String())
+			t.Fail()
+		}
+	}
+}
+
+func TestAuth_AdminToken(t *testing.T) {
+	keys := handlers.NewAPIKeys(handlers.NewMemoryAPIKeyStore(), time.Minute)
+	keysHandler := handlers.MakeAdminAuthHandler(handlers.MakeAPIKeysHandler(keys), "s3cret")
+
+	rr := httptest.NewRecorder()
+	keysHandler(rr, httptest.NewRequest(http.MethodPost, "/system/keys", strings.NewReader(`{"name":"ci"}`)))
+	if rr.Code != http.StatusUnauthorized {
+		t.Logf("Want 401 without the admin token, got %d", rr.Code)
+		t.Fail()
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/system/keys", strings.NewReader(`{"name":"ci"}`))
+	req.Header.Set("Authorization", "Bearer wrong")
+	rr = httptest.NewRecorder()
+	keysHandler(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Logf("Want 401 with the wrong token, got %d", rr.Code)
+		t.Fail()
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/system/keys", strings.NewReader(`{"name":"ci"}`))
+	req.SetBasicAuth("admin", "s3cret")
+	rr = httptest.NewRecorder()
+	keysHandler(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Logf("Want 201 with the admin token as basic auth, got %d", rr.Code)
+		t.Fail()
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/system/keys", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	rr = httptest.NewRecorder()
+	keysHandler(rr, req)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"ci"`) {
+		t.Logf("Want the keys with the admin token as a bearer token, got %d %s", rr.Code, rr.Body.String())
+		t.Fail()
+	}
+}
+
+func signRS256(key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestAuth_JWT(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	jwks := fmt.Sprintf(`{"keys":[{"kty":"RSA","kid":"k1","n":%q,"e":%q}]}`,
+		base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()))
+
+	dir, _ := ioutil.TempDir("", "jwks")
+	defer os.RemoveAll(dir)
+	jwksFile := filepath.Join(dir, "jwks.json")
+	ioutil.WriteFile(jwksFile, []byte(jwks), 0600)
+
+	verifier := handlers.NewJWTVerifier(jwksFile, "https://issuer", "gateway", time.Minute, http.DefaultClient)
+	router := makeAuthRouter(map[string]string{handlers.AuthLabel: "jwt"}, nil, verifier)
+
+	valid := map[string]interface{}{"sub": "alice", "iss": "https://issuer", "aud": []string{"gateway"}, "exp": time.Now().Add(time.Hour).Unix()}
+	if rr := callWithHeader(router, "Authorization", "Bearer "+signRS256(key, "k1", valid)); rr.Code != http.StatusOK || rr.Body.String() != "alice" {
+		t.Logf("Want 200 with the sub claim forwarded, got %d %s", rr.Code, rr.Body.String())
+		t.Fail()
+	}
+
+	cases := map[string]map[string]interface{}{
+		"expired":        {"sub": "alice", "iss": "https://issuer", "aud": "gateway", "exp": time.Now().Add(-time.Hour).Unix()},
+		"wrong issuer":   {"sub": "alice", "iss": "https://other", "aud": "gateway", "exp": time.Now().Add(time.Hour).Unix()},
+		"wrong audience": {"sub": "alice", "iss": "https://issuer", "aud": "other", "exp": time.Now().Add(time.Hour).Unix()},
+	}
+	for name, claims := range cases {
+		if rr := callWithHeader(router, "Authorization", "Bearer "+signRS256(key, "k1", claims)); rr.Code != http.StatusUnauthorized {
+			t.Logf("%s: want 401, got %d", name, rr.Code)
+			t.Fail()
+		}
+	}
+
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	if rr := callWithHeader(router, "Authorization", "Bearer "+signRS256(other, "k1", valid)); rr.Code != http.StatusUnauthorized {
+		t.Logf("Want 401 for a token signed by another key, got %d", rr.Code)
+		t.Fail()
+	}
+}
@@ -0,0 +1,93 @@
+package tests
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	cfclient "github.com/nwright-nz/go-cfclient"
+	"github.com/nwright-nz/openfaas-cf-backend/handlers"
+)
+
+func staticDiscovery(addresses ...string) handlers.InstanceDiscovery {
+	return func(app cfclient.App) ([]string, error) {
+		return addresses, nil
+	}
+}
+
+func TestBalancer_RoundRobinCyclesInstances(t *testing.T) {
+	balancer := handlers.NewInstanceBalancer(staticDiscovery("10.0.0.1:61001", "10.0.0.2:61002"), handlers.RoundRobin, time.Minute, time.Minute)
+	app := cfclient.App{Name: "echoit"}
+
+	seen := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		endpoint, err := balancer.Acquire(app)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[endpoint.Address]++
+		balancer.Release(endpoint, false)
+	}
+
+	if seen["10.0.0.1:61001"] != 2 || seen["10.0.0.2:61002"] != 2 {
+		t.Logf("Expected calls spread evenly, got: %v", seen)
+		t.Fail()
+	}
+}
+
+func TestBalancer_LeastInflightAvoidsBusyInstance(t *testing.T) {
+	balancer := handlers.NewInstanceBalancer(staticDiscovery("10.0.0.1:61001", "10.0.0.2:61002"), handlers.LeastInflight, time.Minute, time.Minute)
+	app := cfclient.App{Name: "echoit"}
+
+	busy, _ := balancer.Acquire(app)
+	for i := 0; i < 3; i++ {
+		endpoint, _ := balancer.Acquire(app)
+		if endpoint.Address == busy.Address {
+			t.Logf("Expected %s to be avoided while it has a call in flight", busy.Address)
+			t.Fail()
+		}
+		balancer.Release(endpoint, false)
+	}
+}
+
+func TestBalancer_FailedInstanceIsEjected(t *testing.T) {
+	balancer := handlers.NewInstanceBalancer(staticDiscovery("10.0.0.1:61001", "10.0.0.2:61002"), handlers.RoundRobin, time.Minute, time.Minute)
+	app := cfclient.App{Name: "echoit"}
+
+	failed, _ := balancer.Acquire(app)
+	balancer.Release(failed, true)
+
+	for i := 0; i < 4; i++ {
+		endpoint, _ := balancer.Acquire(app)
+		if endpoint.Address == failed.Address {
+			t.Logf("Expected ejected instance %s not to be picked", failed.Address)
+			t.Fail()
+		}
+		balancer.Release(endpoint, false)
+	}
+}
+
+func TestBalancer_AllEjectedStillRoutes(t *testing.T) {
+	balancer := handlers.NewInstanceBalancer(staticDiscovery("10.0.0.1:61001"), handlers.RoundRobin, time.Minute, time.Minute)
+	app := cfclient.App{Name: "echoit"}
+
+	endpoint, _ := balancer.Acquire(app)
+	balancer.Release(endpoint, true)
+
+	if _, err := balancer.Acquire(app); err != nil {
+		t.Logf("Expected an ejected instance to be used when nothing else is left, got: %s", err)
+		t.Fail()
+	}
+}
+
+func TestBalancer_DiscoveryErrorReturned(t *testing.T) {
+	discovery := func(app cfclient.App) ([]string, error) {
+		return nil, errors.New("stats unavailable")
+	}
+	balancer := handlers.NewInstanceBalancer(discovery, handlers.RoundRobin, time.Minute, time.Minute)
+
+	if _, err := balancer.Acquire(cfclient.App{Name: "echoit"}); err == nil {
+		t.Log("Expected discovery error to be returned")
+		t.Fail()
+	}
+}
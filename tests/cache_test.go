@@ -0,0 +1,175 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/nwright-nz/openfaas-cf-backend/handlers"
+	"github.com/nwright-nz/openfaas-cf-backend/metrics"
+)
+
+func makeCachedRouter(cacheControl string, calls *int) (*mux.Router, *handlers.ResponseCache) {
+	lookup := func(name string) (map[string]string, error) {
+		return map[string]string{handlers.CacheLabel: "true"}, nil
+	}
+	function := func(w http.ResponseWriter, r *http.Request) {
+		*calls++
+		if len(cacheControl) > 0 {
+			w.Header().Set("Cache-Control", cacheControl)
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("result"))
+	}
+
+	cache := handlers.NewResponseCache(1024 * 1024)
+	router := mux.NewRouter()
+	router.HandleFunc("/function/{name}", handlers.MakeCacheHandler(function, lookup, cache, nil, metrics.BuildMetricsOptions()))
+	return router, cache
+}
+
+func callCached(router *mux.Router, body string) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/function/lookup?id=1", strings.NewReader(body)))
+	return rr
+}
+
+func TestCacheHandler_RepeatedCallIsServedFromCache(t *testing.T) {
+	calls := 0
+	router, _ := makeCachedRouter("max-age=60", &calls)
+
+	first := callCached(router, "input")
+	second := callCached(router, "input")
+
+	if calls != 1 {
+		t.Logf("Expected the function to be called once, got: %d", calls)
+		t.Fail()
+	}
+	if first.Header().Get("X-Cache") != "MISS" || second.Header().Get("X-Cache") != "HIT" {
+		t.Logf("Expected a miss then a hit, got: %s and %s", first.Header().Get("X-Cache"), second.Header().Get("X-Cache"))
+		t.Fail()
+	}
+	if second.Body.String() != "result" || second.Header().Get("Cache-Control") != "max-age=60" {
+		t.Logf("Expected the cached body and headers, got: %q %v", second.Body.String(), second.Header())
+		t.Fail()
+	}
+}
+
+func TestCacheHandler_BodyIsPartOfKey(t *testing.T) {
+	calls := 0
+	router, _ := makeCachedRouter("", &calls)
+
+	callCached(router, "input-a")
+	callCached(router, "input-b")
+
+	if calls != 2 {
+		t.Logf("Expected different bodies to miss the cache, got %d calls", calls)
+		t.Fail()
+	}
+}
+
+func TestCacheHandler_NoStoreIsHonoured(t *testing.T) {
+	calls := 0
+	router, _ := makeCachedRouter("no-store", &calls)
+
+	callCached(router, "input")
+	callCached(router, "input")
+
+	if calls != 2 {
+		t.Logf("Expected no-store responses not to be cached, got %d calls", calls)
+		t.Fail()
+	}
+}
+
+func TestResponseCache_Purge(t *testing.T) {
+	calls := 0
+	router, cache := makeCachedRouter("max-age=60", &calls)
+
+	callCached(router, "input")
+	if purged := cache.Purge("lookup"); purged != 1 {
+		t.Logf("Expected to purge one response, got: %d", purged)
+		t.Fail()
+	}
+
+	callCached(router, "input")
+	if calls != 2 {
+		t.Logf("Expected the call after a purge to reach the function, got %d calls", calls)
+		t.Fail()
+	}
+}
+
+func makeCallerCachedRouter(labels map[string]string, setCookie bool, calls *int) *mux.Router {
+	lookup := func(name string) (map[string]string, error) {
+		return labels, nil
+	}
+	function := func(w http.ResponseWriter, r *http.Request) {
+		*calls++
+		if setCookie {
+			w.Header().Set("Set-Cookie", "session=abc")
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("result for " + r.Header.Get("X-Api-Key-Id")))
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/function/{name}", handlers.MakeCacheHandler(function, lookup, handlers.NewResponseCache(1024*1024), nil, metrics.BuildMetricsOptions()))
+	return router
+}
+
+func callCachedAs(router *mux.Router, keyID string) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/function/profile", nil)
+	req.Header.Set("X-Api-Key-Id", keyID)
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestCacheHandler_CallersDontShareResponses(t *testing.T) {
+	calls := 0
+	router := makeCallerCachedRouter(map[string]string{handlers.CacheLabel: "true"}, false, &calls)
+
+	callCachedAs(router, "alice")
+	bob := callCachedAs(router, "bob")
+	again := callCachedAs(router, "alice")
+
+	if calls != 2 {
+		t.Logf("Expected each caller to reach the function once, got %d calls", calls)
+		t.Fail()
+	}
+	if bob.Body.String() != "result for bob" {
+		t.Logf("Expected bob's own response, got: %q", bob.Body.String())
+		t.Fail()
+	}
+	if again.Header().Get("X-Cache") != "HIT" || again.Body.String() != "result for alice" {
+		t.Logf("Expected alice's response from cache, got: %s %q", again.Header().Get("X-Cache"), again.Body.String())
+		t.Fail()
+	}
+}
+
+func TestCacheHandler_PublicResponsesAreShared(t *testing.T) {
+	calls := 0
+	router := makeCallerCachedRouter(map[string]string{handlers.CacheLabel: "true", handlers.CachePublicLabel: "true"}, false, &calls)
+
+	callCachedAs(router, "alice")
+	bob := callCachedAs(router, "bob")
+
+	if calls != 1 || bob.Header().Get("X-Cache") != "HIT" {
+		t.Logf("Expected public responses to be shared, got %d calls and %s", calls, bob.Header().Get("X-Cache"))
+		t.Fail()
+	}
+}
+
+func TestCacheHandler_SetCookieIsNotStored(t *testing.T) {
+	calls := 0
+	router := makeCallerCachedRouter(map[string]string{handlers.CacheLabel: "true", handlers.CachePublicLabel: "true"}, true, &calls)
+
+	callCachedAs(router, "alice")
+	callCachedAs(router, "alice")
+
+	if calls != 2 {
+		t.Logf("Expected responses with Set-Cookie not to be cached, got %d calls", calls)
+		t.Fail()
+	}
+}
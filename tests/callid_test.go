@@ -0,0 +1,65 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nwright-nz/openfaas-cf-backend/handlers"
+)
+
+func callWithCallID(callID string) (*httptest.ResponseRecorder, *http.Request) {
+	var seen *http.Request
+	handler := handlers.MakeCallIDHandler(func(w http.ResponseWriter, r *http.Request) {
+		seen = r
+		w.WriteHeader(http.StatusOK)
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/function/echoit", nil)
+	if len(callID) > 0 {
+		req.Header.Set(handlers.CallIDHeader, callID)
+	}
+	rr := httptest.NewRecorder()
+	handler(rr, req)
+	return rr, seen
+}
+
+func TestCallIDHandler_GeneratesCallID(t *testing.T) {
+	rr, req := callWithCallID("")
+
+	callID := rr.Header().Get(handlers.CallIDHeader)
+	if len(callID) != 36 {
+		t.Logf("Expected a UUID call ID, got: %q", callID)
+		t.Fail()
+	}
+	if req.Header.Get(handlers.CallIDHeader) != callID {
+		t.Logf("Expected the call ID to be passed on, got: %q", req.Header.Get(handlers.CallIDHeader))
+		t.Fail()
+	}
+	if len(req.Header.Get(handlers.StartTimeHeader)) == 0 {
+		t.Log("Expected X-Start-Time to be set")
+		t.Fail()
+	}
+	if len(rr.Header().Get(handlers.DurationHeader)) == 0 {
+		t.Log("Expected X-Duration-Seconds on the response")
+		t.Fail()
+	}
+}
+
+func TestCallIDHandler_KeepsClientCallID(t *testing.T) {
+	rr, _ := callWithCallID("order-1234")
+
+	if callID := rr.Header().Get(handlers.CallIDHeader); callID != "order-1234" {
+		t.Logf("Expected the client's call ID, got: %q", callID)
+		t.Fail()
+	}
+}
+
+func TestCallIDHandler_ReplacesUnsafeCallID(t *testing.T) {
+	rr, _ := callWithCallID("bad id\nwith newline")
+
+	if callID := rr.Header().Get(handlers.CallIDHeader); callID == "bad id\nwith newline" || len(callID) != 36 {
+		t.Logf("Expected an unsafe call ID to be replaced, got: %q", callID)
+		t.Fail()
+	}
+}
@@ -0,0 +1,73 @@
+package tests
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	cfclient "github.com/nwright-nz/go-cfclient"
+)
+
+// fakeCloudController answers Cloud Controller calls with canned JSON, keyed by method and path,
+// and keeps the query and body of each call made.
+type fakeCloudController struct {
+	server    *httptest.Server
+	responses map[string]string
+
+	mu      sync.Mutex
+	calls   map[string][]byte
+	queries map[string]string
+}
+
+func newFakeCloudController(t *testing.T, responses map[string]string) (*fakeCloudController, *cfclient.Client) {
+	fake := &fakeCloudController{responses: responses, calls: make(map[string][]byte), queries: make(map[string]string)}
+	fake.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		call := r.Method + " " + r.URL.Path
+		body, _ := ioutil.ReadAll(r.Body)
+		fake.mu.Lock()
+		fake.calls[call] = body
+		fake.queries[call] = r.URL.RawQuery
+		fake.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		if call == "GET /v2/info" {
+			w.Write([]byte(`{"authorization_endpoint": "` + fake.server.URL + `", "token_endpoint": "` + fake.server.URL + `"}`))
+			return
+		}
+		response, ok := fake.responses[call]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"code": 10000, "description": "Unknown request", "error_code": "CF-NotFound"}`))
+			return
+		}
+		w.Write([]byte(response))
+	}))
+
+	client, err := cfclient.NewClient(&cfclient.Config{ApiAddress: fake.server.URL, Token: "token", HttpClient: &http.Client{}})
+	if err != nil {
+		fake.server.Close()
+		t.Fatal(err)
+	}
+	return fake, client
+}
+
+// called returns the body of a call and whether it was made.
+func (fake *fakeCloudController) called(call string) ([]byte, bool) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	body, ok := fake.calls[call]
+	return body, ok
+}
+
+// query returns the query string of a call.
+func (fake *fakeCloudController) query(call string) string {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	return fake.queries[call]
+}
+
+func (fake *fakeCloudController) Close() {
+	fake.server.Close()
+}
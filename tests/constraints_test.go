@@ -0,0 +1,66 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/nwright-nz/openfaas-cf-backend/handlers"
+)
+
+func TestParsePlacement_IsolationSegmentAndSpace(t *testing.T) {
+	placement, err := handlers.ParsePlacement([]string{"isolation_segment == gpu-free", "space==regulated"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if placement.IsolationSegment != "gpu-free" {
+		t.Logf("IsolationSegment want: %s, got: %s", "gpu-free", placement.IsolationSegment)
+		t.Fail()
+	}
+	if placement.Space != "regulated" {
+		t.Logf("Space want: %s, got: %s", "regulated", placement.Space)
+		t.Fail()
+	}
+	if len(placement.Org) != 0 {
+		t.Logf("Org should be left for the default, got: %s", placement.Org)
+		t.Fail()
+	}
+}
+
+func TestParsePlacement_NoConstraints(t *testing.T) {
+	placement, err := handlers.ParsePlacement(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if placement != (handlers.Placement{}) {
+		t.Logf("Expected empty placement, got: %v", placement)
+		t.Fail()
+	}
+}
+
+func TestParsePlacement_OtherConstraintsAreIgnored(t *testing.T) {
+	placement, err := handlers.ParsePlacement([]string{"node.platform.os == linux", "node.role != manager", "space == regulated"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if placement != (handlers.Placement{Space: "regulated"}) {
+		t.Logf("Expected only the space to be placed, got: %v", placement)
+		t.Fail()
+	}
+}
+
+func TestParsePlacement_Invalid(t *testing.T) {
+	invalid := []string{
+		"isolation_segment = gpu-free",
+		"space != regulated",
+		"space ==",
+	}
+
+	for _, constraint := range invalid {
+		if _, err := handlers.ParsePlacement([]string{constraint}); err == nil {
+			t.Logf("Expected error for constraint: %s", constraint)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nwright-nz/openfaas-cf-backend/handlers"
+)
+
+func makeCORSRouter(labels map[string]string) *mux.Router {
+	lookup := func(name string) (map[string]string, error) {
+		return labels, nil
+	}
+	defaults := handlers.CORSPolicy{
+		Origins: []string{"https://app.example.com"},
+		Methods: []string{"GET", "POST"},
+		Headers: []string{"Content-Type"},
+		MaxAge:  10 * time.Minute,
+	}
+	function := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("called"))
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/function/{name}", handlers.MakeCORSHandler(function, lookup, defaults))
+	return router
+}
+
+func preflight(router *mux.Router, origin string, method string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodOptions, "/function/orders", nil)
+	req.Header.Set("Origin", origin)
+	req.Header.Set("Access-Control-Request-Method", method)
+	req.Header.Set("Access-Control-Request-Headers", "X-Custom")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestCORS_PreflightUsesDefaults(t *testing.T) {
+	router := makeCORSRouter(map[string]string{})
+
+	rr := preflight(router, "https://app.example.com", "POST")
+	if rr.Code != http.StatusNoContent || rr.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" ||
+		rr.Header().Get("Access-Control-Max-Age") != "600" || rr.Body.Len() > 0 {
+		t.Logf("Want 204 allowing the origin, got %d %v", rr.Code, rr.Header())
+		t.Fail()
+	}
+
+	if rr := preflight(router, "https://evil.example.com", "POST"); rr.Code != http.StatusForbidden {
+		t.Logf("Want 403 for another origin, got %d", rr.Code)
+		t.Fail()
+	}
+	if rr := preflight(router, "https://app.example.com", "DELETE"); rr.Code != http.StatusForbidden {
+		t.Logf("Want 403 for a method not allowed, got %d", rr.Code)
+		t.Fail()
+	}
+}
+
+func TestCORS_LabelsOverrideDefaults(t *testing.T) {
+	router := makeCORSRouter(map[string]string{
+		handlers.CORSOriginsLabel:     "*",
+		handlers.CORSHeadersLabel:     "*",
+		handlers.CORSCredentialsLabel: "true",
+	})
+
+	rr := preflight(router, "https://other.example.com", "GET")
+	if rr.Header().Get("Access-Control-Allow-Origin") != "*" ||
+		rr.Header().Get("Access-Control-Allow-Headers") != "X-Custom" ||
+		len(rr.Header().Get("Access-Control-Allow-Credentials")) > 0 {
+		t.Logf("Want any origin allowed without credentials and the headers echoed, got %v", rr.Header())
+		t.Fail()
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/function/orders", nil)
+	req.Header.Set("Origin", "https://other.example.com")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Body.String() != "called" || rr.Header().Get("Access-Control-Allow-Origin") != "*" ||
+		len(rr.Header().Get("Access-Control-Allow-Credentials")) > 0 {
+		t.Logf("Want the call made with CORS headers, got %s %v", rr.Body.String(), rr.Header())
+		t.Fail()
+	}
+}
+
+func TestCORS_CredentialsNeedExplicitOrigins(t *testing.T) {
+	router := makeCORSRouter(map[string]string{
+		handlers.CORSOriginsLabel:     "https://app.example.com",
+		handlers.CORSCredentialsLabel: "true",
+	})
+
+	rr := preflight(router, "https://app.example.com", "GET")
+	if rr.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" ||
+		rr.Header().Get("Access-Control-Allow-Credentials") != "true" {
+		t.Logf("Want credentials allowed for a listed origin, got %v", rr.Header())
+		t.Fail()
+	}
+}
@@ -0,0 +1,38 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nwright-nz/openfaas-cf-backend/handlers"
+	"github.com/nwright-nz/openfaas-cf-backend/metrics"
+	"github.com/nwright-nz/openfaas-cf-backend/types"
+)
+
+func TestDeployHandler_RedeployCantMoveFunction(t *testing.T) {
+	fake, client := newFakeCloudController(t, map[string]string{
+		"GET /v2/organizations": `{"resources": [{"metadata": {"guid": "org-1"}, "entity": {"name": "faas"}}]}`,
+		"GET /v2/spaces":        `{"resources": [{"metadata": {"guid": "space-2"}, "entity": {"name": "regulated"}}]}`,
+		"GET /v2/apps": `{"resources": [{"metadata": {"guid": "app-1"}, "entity": {"name": "echoit", "space_guid": "space-1",
+			"environment_json": {"function": "true"}}}]}`,
+	})
+	defer fake.Close()
+
+	deploy := handlers.MakeNewFunctionHandler(metrics.BuildMetricsOptions(), client, types.GatewayConfig{CFOrg: "faas", CFSpace: "dev"}, nil, 0)
+	rr := httptest.NewRecorder()
+	deploy(rr, httptest.NewRequest(http.MethodPost, "/system/functions",
+		strings.NewReader(`{"service": "echoit", "image": "functions/echoit", "constraints": ["space == regulated"]}`)))
+
+	if rr.Code != http.StatusConflict {
+		t.Logf("Expected 409 for a redeploy into another space, got: %d %s", rr.Code, rr.Body.String())
+		t.Fail()
+	}
+	for _, call := range []string{"PUT /v2/apps/app-1", "PATCH /v3/apps/app-1"} {
+		if _, ok := fake.called(call); ok {
+			t.Logf("Expected the function to be left as it was, got: %s", call)
+			t.Fail()
+		}
+	}
+}
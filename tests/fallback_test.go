@@ -0,0 +1,91 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nwright-nz/openfaas-cf-backend/handlers"
+)
+
+func makeFallbackRouter(delay time.Duration) *mux.Router {
+	lookup := func(name string) (map[string]string, error) {
+		return map[string]string{handlers.AsyncAfterLabel: "50ms"}, nil
+	}
+	function := func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("report"))
+	}
+
+	results := handlers.NewMemoryResultStore(time.Minute)
+	router := mux.NewRouter()
+	router.HandleFunc("/function/{name}", handlers.MakeAsyncFallbackHandler(function, lookup, results, http.DefaultClient))
+	router.HandleFunc("/system/results/{id}", handlers.MakeResultHandler(results))
+	return router
+}
+
+func TestAsyncFallback_FastCallsStaySynchronous(t *testing.T) {
+	router := makeFallbackRouter(0)
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/function/reports", nil))
+	if rr.Code != http.StatusCreated || rr.Body.String() != "report" {
+		t.Logf("Want the function's response, got %d %s", rr.Code, rr.Body.String())
+		t.Fail()
+	}
+}
+
+func TestAsyncFallback_SlowCallsAreAcceptedAndStored(t *testing.T) {
+	delivered := make(chan string, 1)
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		delivered <- r.Header.Get("X-Function-Status")
+	}))
+	defer callback.Close()
+
+	router := makeFallbackRouter(200 * time.Millisecond)
+
+	req := httptest.NewRequest(http.MethodPost, "/function/reports", nil)
+	req.Header.Set("X-Call-Id", "report-1")
+	req.Header.Set("X-Callback-Url", callback.URL)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	accepted := map[string]string{}
+	json.Unmarshal(rr.Body.Bytes(), &accepted)
+	if rr.Code != http.StatusAccepted || accepted["callId"] != "report-1" || !strings.HasPrefix(accepted["statusUrl"], "/system/results/") {
+		t.Logf("Want 202 with a status URL, got %d %s", rr.Code, rr.Body.String())
+		t.Fail()
+		return
+	}
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, accepted["statusUrl"], nil))
+	if rr.Code != http.StatusAccepted {
+		t.Logf("Want 202 while pending, got %d", rr.Code)
+		t.Fail()
+	}
+
+	select {
+	case status := <-delivered:
+		if status != "201" {
+			t.Logf("Want the result delivered with status 201, got %s", status)
+			t.Fail()
+		}
+	case <-time.After(2 * time.Second):
+		t.Log("Want the result delivered to the callback")
+		t.Fail()
+	}
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, accepted["statusUrl"], nil))
+	if rr.Code != http.StatusCreated || rr.Body.String() != "report" || rr.Header().Get("Content-Type") != "text/plain" {
+		t.Logf("Want the stored response, got %d %s", rr.Code, rr.Body.String())
+		t.Fail()
+	}
+}
@@ -0,0 +1,96 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nwright-nz/openfaas-cf-backend/handlers"
+)
+
+func makeIdempotentRouter(calls *int, status int) *mux.Router {
+	function := func(w http.ResponseWriter, r *http.Request) {
+		*calls++
+		w.Header().Set(handlers.CallIDHeader, "order-call")
+		w.WriteHeader(status)
+		w.Write([]byte("order created"))
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/function/{name}", handlers.MakeIdempotencyHandler(function, handlers.NewMemoryIdempotencyStore(), time.Minute))
+	return router
+}
+
+func callIdempotent(router *mux.Router, key string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/function/orders", strings.NewReader(body))
+	req.Header.Set(handlers.IdempotencyKeyHeader, key)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestIdempotency_RepeatGetsFirstResponse(t *testing.T) {
+	calls := 0
+	router := makeIdempotentRouter(&calls, http.StatusCreated)
+
+	callIdempotent(router, "abc", `{"item":1}`)
+	rr := callIdempotent(router, "abc", `{"item":1}`)
+
+	if calls != 1 {
+		t.Logf("Want the function called once, got %d", calls)
+		t.Fail()
+	}
+	if rr.Code != http.StatusCreated || rr.Body.String() != "order created" ||
+		rr.Header().Get(handlers.CallIDHeader) != "order-call" || rr.Header().Get("Idempotent-Replayed") != "true" {
+		t.Logf("Want the first response replayed, got %d %s %v", rr.Code, rr.Body.String(), rr.Header())
+		t.Fail()
+	}
+
+	if rr := callIdempotent(router, "abc", `{"item":2}`); rr.Code != http.StatusUnprocessableEntity {
+		t.Logf("Want 422 for a different body, got %d", rr.Code)
+		t.Fail()
+	}
+
+	callIdempotent(router, "def", `{"item":1}`)
+	if calls != 2 {
+		t.Logf("Want a new key to call the function, got %d calls", calls)
+		t.Fail()
+	}
+}
+
+func TestIdempotency_RetryableFailuresAreNotKept(t *testing.T) {
+	calls := 0
+	router := makeIdempotentRouter(&calls, http.StatusServiceUnavailable)
+
+	callIdempotent(router, "abc", "{}")
+	callIdempotent(router, "abc", "{}")
+
+	if calls != 2 {
+		t.Logf("Want a retry after a 503 to call the function again, got %d calls", calls)
+		t.Fail()
+	}
+}
+
+func TestIdempotency_KeysArePerCaller(t *testing.T) {
+	calls := 0
+	router := makeIdempotentRouter(&calls, http.StatusCreated)
+
+	call := func(keyID string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/function/orders", strings.NewReader(body))
+		req.Header.Set(handlers.IdempotencyKeyHeader, "abc")
+		req.Header.Set("X-Api-Key-Id", keyID)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	call("alice", `{"item":1}`)
+	rr := call("bob", `{"item":2}`)
+	if rr.Code != http.StatusCreated || len(rr.Header().Get("Idempotent-Replayed")) > 0 || calls != 2 {
+		t.Logf("Expected another caller's key to be separate, got %d after %d calls", rr.Code, calls)
+		t.Fail()
+	}
+}
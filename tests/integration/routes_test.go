@@ -47,10 +47,10 @@ func fireRequestWithHeaders(url string, method string, reqBody string, headers m
 	return string(body), res.StatusCode, readErr
 }
 
-func TestGet_Rejected(t *testing.T) {
+func TestGet_Forwarded(t *testing.T) {
 	var reqBody string
 	_, code, err := fireRequest("http://localhost:8080/function/func_echoit", http.MethodGet, reqBody)
-	want := http.StatusMethodNotAllowed
+	want := http.StatusOK
 	if code != want {
 		t.Logf("Failed got: %d, wanted: %d", code, want)
 		t.Fail()
@@ -0,0 +1,64 @@
+package tests
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nwright-nz/openfaas-cf-backend/handlers"
+)
+
+func TestConcurrencyLimiter_RejectsWhenQueueFull(t *testing.T) {
+	limiter := handlers.NewConcurrencyLimiter(nil, nil)
+
+	if err := limiter.Acquire(context.Background(), 1, 0, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := limiter.Acquire(context.Background(), 1, 0, time.Second); err != handlers.ErrQueueFull {
+		t.Logf("Expected ErrQueueFull with no queue, got: %v", err)
+		t.Fail()
+	}
+}
+
+func TestConcurrencyLimiter_QueuedCallTimesOut(t *testing.T) {
+	limiter := handlers.NewConcurrencyLimiter(nil, nil)
+	limiter.Acquire(context.Background(), 1, 1, time.Second)
+
+	if err := limiter.Acquire(context.Background(), 1, 1, 10*time.Millisecond); err != handlers.ErrQueueTimeout {
+		t.Logf("Expected ErrQueueTimeout, got: %v", err)
+		t.Fail()
+	}
+
+	if inflight, queued := limiter.Inflight(); inflight != 1 || queued != 0 {
+		t.Logf("Expected 1 in flight and none queued, got: %d and %d", inflight, queued)
+		t.Fail()
+	}
+}
+
+func TestConcurrencyLimiter_ReleaseAdmitsQueuedCall(t *testing.T) {
+	limiter := handlers.NewConcurrencyLimiter(nil, nil)
+	limiter.Acquire(context.Background(), 1, 1, time.Second)
+
+	admitted := make(chan error)
+	go func() {
+		admitted <- limiter.Acquire(context.Background(), 1, 1, time.Second)
+	}()
+
+	for {
+		if _, queued := limiter.Inflight(); queued == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	limiter.Release()
+
+	if err := <-admitted; err != nil {
+		t.Logf("Expected the queued call to be admitted, got: %v", err)
+		t.Fail()
+	}
+	if inflight, queued := limiter.Inflight(); inflight != 1 || queued != 0 {
+		t.Logf("Expected the slot to pass to the queued call, got: %d in flight and %d queued", inflight, queued)
+		t.Fail()
+	}
+}
@@ -0,0 +1,196 @@
+package tests
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nwright-nz/openfaas-cf-backend/handlers"
+	"github.com/nwright-nz/openfaas-cf-backend/queue"
+	"github.com/nwright-nz/openfaas-cf-backend/requests"
+)
+
+func makePipelineRouter(store handlers.PipelineStore) *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/function/{name}", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		switch mux.Vars(r)["name"] {
+		case "upper":
+			w.Header().Set("Content-Type", "text/upper")
+			w.Write([]byte(strings.ToUpper(string(body))))
+		case "exclaim":
+			w.Write([]byte(string(body) + "! " + r.Header.Get("Content-Type")))
+		case "slow":
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+			w.Write(body)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("no such function"))
+		}
+	})
+	pipeline := handlers.MakePipelineHandler(router, store)
+	router.HandleFunc("/pipeline", pipeline)
+	router.HandleFunc("/pipeline/{name}", pipeline)
+	return router
+}
+
+func TestPipeline_PassesEachResponseToTheNextStep(t *testing.T) {
+	store := handlers.NewMemoryPipelineStore()
+	store.Save(requests.Pipeline{Name: "shout", Steps: []requests.PipelineStep{{Function: "upper"}, {Function: "exclaim"}}})
+	router := makePipelineRouter(store)
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/pipeline/shout", strings.NewReader("hi")))
+
+	if rr.Code != http.StatusOK || rr.Body.String() != "HI! text/upper" {
+		t.Logf("Want 200 HI! text/upper, got %d %s", rr.Code, rr.Body.String())
+		t.Fail()
+	}
+	durations := rr.Header().Get(handlers.PipelineDurationsHeader)
+	if !strings.HasPrefix(durations, "upper=") || !strings.Contains(durations, ", exclaim=") {
+		t.Logf("Want durations for both steps, got %s", durations)
+		t.Fail()
+	}
+}
+
+func TestPipeline_StopsAtFailedStep(t *testing.T) {
+	router := makePipelineRouter(handlers.NewMemoryPipelineStore())
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/pipeline?functions=upper,missing,exclaim", strings.NewReader("hi")))
+
+	if rr.Code != http.StatusNotFound {
+		t.Logf("Want 404 from the failed step, got %d", rr.Code)
+		t.Fail()
+	}
+	if failed := rr.Header().Get(handlers.PipelineFailedStepHeader); failed != "2:missing" {
+		t.Logf("Want failed step 2:missing, got %s", failed)
+		t.Fail()
+	}
+	if strings.Contains(rr.Header().Get(handlers.PipelineDurationsHeader), "exclaim") {
+		t.Log("Want steps after the failure to be skipped")
+		t.Fail()
+	}
+}
+
+func TestPipeline_StepTimeout(t *testing.T) {
+	router := makePipelineRouter(handlers.NewMemoryPipelineStore())
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/pipeline?functions=upper,slow&timeout=50ms", strings.NewReader("hi")))
+
+	if rr.Code != http.StatusGatewayTimeout {
+		t.Logf("Want 504, got %d", rr.Code)
+		t.Fail()
+	}
+}
+
+func TestPipelinesHandler_RejectsInvalidPipeline(t *testing.T) {
+	handler := handlers.MakePipelinesHandler(handlers.NewMemoryPipelineStore())
+
+	for _, body := range []string{
+		`{"name":"empty","steps":[]}`,
+		`{"name":"bad/name","steps":[{"function":"upper"}]}`,
+		`{"name":"timeout","steps":[{"function":"upper","timeout":"soon"}]}`,
+	} {
+		rr := httptest.NewRecorder()
+		handler(rr, httptest.NewRequest(http.MethodPost, "/system/pipelines", strings.NewReader(body)))
+		if rr.Code != http.StatusBadRequest {
+			t.Logf("Want 400 for %s, got %d", body, rr.Code)
+			t.Fail()
+		}
+	}
+}
+
+// callbackStep reports a queued step's result to the pipeline callback the way a queue worker does.
+func callbackStep(pipelineQueue *handlers.PipelineQueue, req *queue.Request, contentType string, body string) *httptest.ResponseRecorder {
+	callback := httptest.NewRequest(http.MethodPost, req.CallbackURL.RequestURI(), strings.NewReader(body))
+	callback.Header.Set("Content-Type", contentType)
+	callback.Header.Set(handlers.CallIDHeader, req.Header.Get(handlers.CallIDHeader))
+	callback.Header.Set("X-Function-Status", "200")
+	callback.Header.Set(handlers.DurationHeader, "0.100000")
+	rr := httptest.NewRecorder()
+	handlers.MakePipelineCallbackHandler(pipelineQueue, http.DefaultClient)(rr, callback)
+	return rr
+}
+
+func TestAsyncPipeline_StepsGetTheCallersHeaders(t *testing.T) {
+	q := queue.NewMemoryQueue()
+	defer q.Close()
+	pipelineQueue := &handlers.PipelineQueue{Queue: q, GatewayURL: "http://gateway", Secret: []byte("secret")}
+
+	req := httptest.NewRequest(http.MethodPost, "/async-pipeline?functions=upper,exclaim,upper", strings.NewReader("hi"))
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("X-Tenant", "acme")
+	req.Header.Set("Authorization", "Bearer token")
+	rr := httptest.NewRecorder()
+	handlers.MakeAsyncPipelineHandler(handlers.NewMemoryPipelineStore(), pipelineQueue, nil)(rr, req)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("Want 202, got %d %s", rr.Code, rr.Body.String())
+	}
+
+	first := receiveWithin(t, q)
+	q.Ack(first)
+	if rr := callbackStep(pipelineQueue, first.Request, "text/upper", "HI"); rr.Code != http.StatusAccepted {
+		t.Fatalf("Want 202 for the first step's callback, got %d %s", rr.Code, rr.Body.String())
+	}
+
+	second := receiveWithin(t, q)
+	q.Ack(second)
+	header := second.Request.Header
+	if second.Request.Function != "exclaim" || header.Get("X-Tenant") != "acme" || header.Get("Content-Type") != "text/upper" {
+		t.Logf("Want exclaim called with the caller's headers, got %s %v", second.Request.Function, header)
+		t.Fail()
+	}
+	for _, name := range []string{"Authorization", "X-Function-Status", handlers.DurationHeader} {
+		if len(header.Get(name)) > 0 {
+			t.Logf("Want %s left out of the next step, got %v", name, header)
+			t.Fail()
+		}
+	}
+}
+
+func TestAsyncPipeline_CallbackOnlyTakenOnce(t *testing.T) {
+	q := queue.NewMemoryQueue()
+	defer q.Close()
+	pipelineQueue := &handlers.PipelineQueue{Queue: q, GatewayURL: "http://gateway", Secret: []byte("secret")}
+
+	rr := httptest.NewRecorder()
+	handlers.MakeAsyncPipelineHandler(handlers.NewMemoryPipelineStore(), pipelineQueue, nil)(rr, httptest.NewRequest(http.MethodPost, "/async-pipeline?functions=upper,exclaim", strings.NewReader("hi")))
+	first := receiveWithin(t, q)
+	q.Ack(first)
+
+	callbackStep(pipelineQueue, first.Request, "text/upper", "HI")
+	if rr := callbackStep(pipelineQueue, first.Request, "text/upper", "FORGED"); rr.Code != http.StatusConflict {
+		t.Logf("Want 409 when the callback is replayed, got %d", rr.Code)
+		t.Fail()
+	}
+	if q.Len() != 1 {
+		t.Logf("Want only the next step queued, got %d", q.Len())
+		t.Fail()
+	}
+}
+
+func TestAsyncPipeline_CallbackExpires(t *testing.T) {
+	q := queue.NewMemoryQueue()
+	defer q.Close()
+	pipelineQueue := &handlers.PipelineQueue{Queue: q, GatewayURL: "http://gateway", Secret: []byte("secret"), Expiry: time.Millisecond}
+
+	rr := httptest.NewRecorder()
+	handlers.MakeAsyncPipelineHandler(handlers.NewMemoryPipelineStore(), pipelineQueue, nil)(rr, httptest.NewRequest(http.MethodPost, "/async-pipeline?functions=upper,exclaim", strings.NewReader("hi")))
+	first := receiveWithin(t, q)
+	q.Ack(first)
+
+	time.Sleep(5 * time.Millisecond)
+	if rr := callbackStep(pipelineQueue, first.Request, "text/upper", "HI"); rr.Code != http.StatusBadRequest {
+		t.Logf("Want 400 for an expired callback, got %d", rr.Code)
+		t.Fail()
+	}
+}
@@ -0,0 +1,106 @@
+package tests
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nwright-nz/openfaas-cf-backend/types"
+)
+
+func proxyClientConfig(keepAlive bool) types.GatewayConfig {
+	return types.GatewayConfig{
+		UpstreamKeepAlive:           keepAlive,
+		UpstreamMaxIdleConns:        512,
+		UpstreamMaxIdleConnsPerHost: 64,
+		UpstreamIdleTimeout:         90 * time.Second,
+		UpstreamDialTimeout:         3 * time.Second,
+		UpstreamTLSTimeout:          10 * time.Second,
+	}
+}
+
+func TestProxyClient_ReusesConnections(t *testing.T) {
+	var connections int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&connections, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	client := types.NewProxyClient(proxyClientConfig(true))
+	for i := 0; i < 5; i++ {
+		callUpstream(t, client, server.URL)
+	}
+
+	if opened := atomic.LoadInt32(&connections); opened != 1 {
+		t.Logf("Expected one pooled connection for sequential calls, got: %d", opened)
+		t.Fail()
+	}
+}
+
+func callUpstream(tb testing.TB, client *http.Client, url string) {
+	res, err := client.Get(url)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+}
+
+func benchmarkProxyClient(b *testing.B, keepAlive bool) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer server.Close()
+
+	client := types.NewProxyClient(proxyClientConfig(keepAlive))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		callUpstream(b, client, server.URL)
+	}
+}
+
+func BenchmarkProxyClient_KeepAlive(b *testing.B) {
+	benchmarkProxyClient(b, true)
+}
+
+func BenchmarkProxyClient_NoKeepAlive(b *testing.B) {
+	benchmarkProxyClient(b, false)
+}
+
+type upstreamEnv map[string]string
+
+func (e upstreamEnv) Getenv(key string) string {
+	return e[key]
+}
+
+func TestReadConfig_UpstreamBools(t *testing.T) {
+	cases := []struct {
+		value string
+		want  bool
+	}{
+		{"", true},
+		{"true", true},
+		{"false", false},
+		{"0", false},
+	}
+
+	for _, c := range cases {
+		config := types.ReadConfig{}.Read(upstreamEnv{"upstream_keepalive": c.value, "upstream_http2": c.value})
+		if config.UpstreamKeepAlive != c.want || config.UpstreamHTTP2 != c.want {
+			t.Logf("Expected %q to read as %v, got keepalive: %v http2: %v", c.value, c.want, config.UpstreamKeepAlive, config.UpstreamHTTP2)
+			t.Fail()
+		}
+	}
+}
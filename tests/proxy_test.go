@@ -0,0 +1,163 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/nwright-nz/openfaas-cf-backend/handlers"
+	"github.com/nwright-nz/openfaas-cf-backend/metrics"
+	"github.com/nwright-nz/openfaas-cf-backend/types"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// proxyGateway serves the proxy in front of a single function called echoit, whose app is
+// found through a fake Cloud Controller and whose instance is function.
+type proxyGateway struct {
+	server   *httptest.Server
+	function *httptest.Server
+	fake     *fakeCloudController
+	metrics  metrics.MetricOptions
+}
+
+func newProxyGateway(t *testing.T, function http.Handler, labels map[string]string, config types.GatewayConfig) *proxyGateway {
+	gateway := &proxyGateway{function: httptest.NewServer(function), metrics: metrics.BuildMetricsOptions()}
+
+	labelBytes, _ := json.Marshal(labels)
+	app := map[string]interface{}{
+		"resources": []interface{}{map[string]interface{}{
+			"metadata": map[string]string{"guid": "app-1"},
+			"entity": map[string]interface{}{
+				"name":             "echoit",
+				"environment_json": map[string]string{"function": "true", "function_labels": string(labelBytes)},
+			},
+		}},
+	}
+	appBytes, _ := json.Marshal(app)
+
+	fake, client := newFakeCloudController(t, map[string]string{"GET /v2/apps": string(appBytes)})
+	gateway.fake = fake
+
+	address := strings.TrimPrefix(gateway.function.URL, "http://")
+	balancer := handlers.NewInstanceBalancer(staticDiscovery(address), handlers.RoundRobin, time.Minute, time.Minute)
+	proxy := handlers.MakeProxy(gateway.metrics, true, client, balancer, nil, handlers.NewResilience(gateway.metrics), config, &http.Client{}, logrus.New())
+
+	router := mux.NewRouter()
+	router.HandleFunc("/function/{name}", proxy)
+	router.PathPrefix("/function/{name}/").HandlerFunc(proxy)
+
+	gateway.server = httptest.NewUnstartedServer(router)
+	gateway.server.Config.ReadTimeout = config.ReadTimeout
+	gateway.server.Config.WriteTimeout = config.WriteTimeout
+	gateway.server.Start()
+	return gateway
+}
+
+func (gateway *proxyGateway) Close() {
+	gateway.server.Close()
+	gateway.function.Close()
+	gateway.fake.Close()
+}
+
+func histogramCount(observer prometheus.Observer) uint64 {
+	metric := dto.Metric{}
+	observer.(prometheus.Metric).Write(&metric)
+	return metric.GetHistogram().GetSampleCount()
+}
+
+// eventually polls condition until it holds or a second has passed, for metrics recorded
+// after the response has gone out.
+func eventually(condition func() bool) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if condition() {
+			return true
+		}
+	}
+	return condition()
+}
+
+func TestProxy_ExecTimeoutIsGatewayTimeout(t *testing.T) {
+	cases := []struct {
+		name   string
+		label  string
+		header string
+	}{
+		{"label", "100ms", ""},
+		{"header shortens label", "10s", "100ms"},
+		{"header can't extend label", "100ms", "10s"},
+	}
+
+	for _, c := range cases {
+		release := make(chan struct{})
+		slow := func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		}
+		gateway := newProxyGateway(t, http.HandlerFunc(slow), map[string]string{handlers.ExecTimeoutLabel: c.label}, types.GatewayConfig{})
+
+		request, _ := http.NewRequest(http.MethodGet, gateway.server.URL+"/function/echoit", nil)
+		if len(c.header) > 0 {
+			request.Header.Set(handlers.ExecTimeoutHeader, c.header)
+		}
+		start := time.Now()
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+
+		if response.StatusCode != http.StatusGatewayTimeout || !strings.Contains(string(body), "timed out after 100ms") {
+			t.Logf("%s: expected 504 after 100ms, got: %d %q", c.name, response.StatusCode, body)
+			t.Fail()
+		}
+		if took := time.Since(start); took > 5*time.Second {
+			t.Logf("%s: expected the call to end at the timeout, took: %s", c.name, took)
+			t.Fail()
+		}
+		if timeouts := counterValue(gateway.metrics.GatewayFunctionTimeouts.WithLabelValues("echoit", "")); timeouts != 1 {
+			t.Logf("%s: expected 1 in gateway_function_timeouts_total, got: %f", c.name, timeouts)
+			t.Fail()
+		}
+
+		close(release)
+		gateway.Close()
+	}
+}
+
+func TestProxy_ClientCancellationReachesFunction(t *testing.T) {
+	cancelled := make(chan struct{})
+	slow := func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		close(cancelled)
+	}
+	gateway := newProxyGateway(t, http.HandlerFunc(slow), nil, types.GatewayConfig{})
+	defer gateway.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	request, _ := http.NewRequestWithContext(ctx, http.MethodGet, gateway.server.URL+"/function/echoit", nil)
+	if _, err := http.DefaultClient.Do(request); err == nil {
+		t.Fatal("Expected the client's call to be cancelled")
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the function's call to be cancelled when the client went away")
+	}
+	if timeouts := counterValue(gateway.metrics.GatewayFunctionTimeouts.WithLabelValues("echoit", "")); timeouts != 0 {
+		t.Logf("Expected a client going away not to count as a timeout, got: %f", timeouts)
+		t.Fail()
+	}
+}
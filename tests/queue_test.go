@@ -0,0 +1,144 @@
+package tests
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nwright-nz/openfaas-cf-backend/queue"
+)
+
+func receiveWithin(t *testing.T, consumer queue.Consumer) *queue.Delivery {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	delivery, err := consumer.Receive(ctx)
+	if err != nil {
+		t.Fatalf("Receive failed: %s", err)
+	}
+	return delivery
+}
+
+func TestMemoryQueue_NackRedelivers(t *testing.T) {
+	q := queue.NewMemoryQueue()
+	defer q.Close()
+
+	q.Queue(&queue.Request{Function: "first"})
+	q.Queue(&queue.Request{Function: "second"})
+
+	delivery := receiveWithin(t, q)
+	if delivery.Request.Function != "first" {
+		t.Logf("Expected first, got %s", delivery.Request.Function)
+		t.Fail()
+	}
+	q.Nack(delivery)
+
+	delivery = receiveWithin(t, q)
+	q.Ack(delivery)
+	delivery = receiveWithin(t, q)
+	if delivery.Request.Function != "first" || delivery.Attempts != 1 {
+		t.Logf("Expected first redelivered once, got %s after %d attempts", delivery.Request.Function, delivery.Attempts)
+		t.Fail()
+	}
+	q.Ack(delivery)
+
+	if q.Len() != 0 {
+		t.Logf("Expected an empty queue, got %d", q.Len())
+		t.Fail()
+	}
+}
+
+func TestMemoryQueue_CloseStopsReceive(t *testing.T) {
+	q := queue.NewMemoryQueue()
+	q.Close()
+
+	if _, err := q.Receive(context.Background()); err != queue.ErrClosed {
+		t.Logf("Expected ErrClosed, got %v", err)
+		t.Fail()
+	}
+	if err := q.Queue(&queue.Request{Function: "late"}); err != queue.ErrClosed {
+		t.Logf("Expected ErrClosed, got %v", err)
+		t.Fail()
+	}
+}
+
+func TestFileQueue_RedeliversAfterRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := queue.NewFileQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Queue(&queue.Request{Function: "resize", Body: []byte("image"), Method: "POST"})
+
+	// The gateway stops before acking.
+	receiveWithin(t, q)
+	q.Close()
+
+	q, err = queue.NewFileQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	delivery := receiveWithin(t, q)
+	if delivery.Request.Function != "resize" || string(delivery.Request.Body) != "image" {
+		t.Logf("Expected the resize request, got %+v", delivery.Request)
+		t.Fail()
+	}
+	if delivery.Attempts != 1 {
+		t.Logf("Expected 1 attempt, got %d", delivery.Attempts)
+		t.Fail()
+	}
+	q.Ack(delivery)
+
+	pending, _ := ioutil.ReadDir(dir + "/pending")
+	inflight, _ := ioutil.ReadDir(dir + "/inflight")
+	if len(pending)+len(inflight) != 0 {
+		t.Logf("Expected no files after ack, got %d pending and %d in flight", len(pending), len(inflight))
+		t.Fail()
+	}
+}
+
+func TestFileQueue_SharedDirKeepsOtherInstancesCalls(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	running, err := queue.NewFileQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer running.Close()
+	running.Queue(&queue.Request{Function: "resize"})
+	delivery := receiveWithin(t, running)
+
+	// A second instance starts while the first is still running the call.
+	second, err := queue.NewFileQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+	if duplicate, err := second.Receive(ctx); err == nil {
+		t.Logf("Expected the call to stay with the first instance, got %+v", duplicate.Request)
+		t.Fail()
+	}
+
+	running.Ack(delivery)
+	inflight, _ := ioutil.ReadDir(dir + "/inflight")
+	if len(inflight) != 0 {
+		t.Logf("Expected no calls in flight after ack, got %d", len(inflight))
+		t.Fail()
+	}
+}
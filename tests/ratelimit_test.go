@@ -0,0 +1,249 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nwright-nz/openfaas-cf-backend/handlers"
+	"github.com/nwright-nz/openfaas-cf-backend/metrics"
+)
+
+func TestMemoryRateLimitStore_AllowsBurstThenRejects(t *testing.T) {
+	store := handlers.NewMemoryRateLimitStore()
+
+	for i := 0; i < 3; i++ {
+		result, _ := store.Take("echoit/ip:10.0.0.1", 0.1, 3)
+		if !result.Allowed {
+			t.Fatalf("Expected call %d within the burst to be allowed", i+1)
+		}
+	}
+
+	result, _ := store.Take("echoit/ip:10.0.0.1", 0.1, 3)
+	if result.Allowed {
+		t.Log("Expected the call after the burst to be rejected")
+		t.Fail()
+	}
+	if result.RetryAfter <= 0 {
+		t.Logf("Expected a wait before the next token, got: %s", result.RetryAfter)
+		t.Fail()
+	}
+
+	if other, _ := store.Take("echoit/ip:10.0.0.2", 0.1, 3); !other.Allowed {
+		t.Log("Expected another caller to have its own bucket")
+		t.Fail()
+	}
+}
+
+func TestMemoryRateLimitStore_FastCallsDontRefillSlowBuckets(t *testing.T) {
+	store := handlers.NewMemoryRateLimitStore()
+	now := time.Now()
+	store.Now = func() time.Time { return now }
+
+	if slow, _ := store.Take("report/ip:10.0.0.1", 1.0/600, 1); !slow.Allowed {
+		t.Fatal("Expected the first call to the slow function to be allowed")
+	}
+
+	// Two minutes only refills a fifth of a token at the slow rate, but the fast calls sweep idle buckets.
+	now = now.Add(2 * time.Minute)
+	for i := 0; i < 2048; i++ {
+		store.Take("echoit/ip:10.0.0.2", 1000, 5000)
+	}
+
+	if slow, _ := store.Take("report/ip:10.0.0.1", 1.0/600, 1); slow.Allowed {
+		t.Log("Expected the slow function's bucket to still be empty")
+		t.Fail()
+	}
+}
+
+func makeRateLimitedRouter(labels map[string]string) *mux.Router {
+	lookup := func(name string) (map[string]string, error) {
+		return labels, nil
+	}
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	// httptest requests come from 192.0.2.1, which stands in for the gorouter.
+	trusted, _ := handlers.ParseTrustedProxies("192.0.2.1")
+
+	router := mux.NewRouter()
+	router.HandleFunc("/function/{name}", handlers.MakeClientIPHandler(handlers.MakeRateLimitHandler(ok, lookup, handlers.NewMemoryRateLimitStore(), metrics.BuildMetricsOptions()), trusted))
+	return router
+}
+
+func TestRateLimitHandler_KeyedByHeader(t *testing.T) {
+	router := makeRateLimitedRouter(map[string]string{
+		handlers.RateLimitRateLabel:  "0.01",
+		handlers.RateLimitBurstLabel: "1",
+		handlers.RateLimitKeyLabel:   "header:X-Tenant",
+	})
+
+	call := func(tenant string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/function/webhook", nil)
+		req.Header.Set("X-Tenant", tenant)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := call("acme"); rr.Code != http.StatusOK || rr.Header().Get("RateLimit-Limit") != "1" {
+		t.Logf("Expected first call to pass with RateLimit headers, got: %d %v", rr.Code, rr.Header())
+		t.Fail()
+	}
+
+	rr := call("acme")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Logf("Expected 429 for the second call, got: %d", rr.Code)
+		t.Fail()
+	}
+	if rr.Header().Get("RateLimit-Remaining") != "0" || len(rr.Header().Get("Retry-After")) == 0 {
+		t.Logf("Expected RateLimit-Remaining of 0 and Retry-After, got: %v", rr.Header())
+		t.Fail()
+	}
+
+	if rr := call("globex"); rr.Code != http.StatusOK {
+		t.Logf("Expected another tenant to be allowed, got: %d", rr.Code)
+		t.Fail()
+	}
+}
+
+func TestRateLimitHandler_NoLimitWithoutLabels(t *testing.T) {
+	router := makeRateLimitedRouter(map[string]string{})
+
+	for i := 0; i < 10; i++ {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/function/webhook", nil))
+		if rr.Code != http.StatusOK || len(rr.Header().Get("RateLimit-Limit")) > 0 {
+			t.Logf("Expected calls to pass without rate limit headers, got: %d %v", rr.Code, rr.Header())
+			t.Fail()
+		}
+	}
+}
+
+func TestRateLimitHandler_IgnoresClientForwardedFor(t *testing.T) {
+	router := makeRateLimitedRouter(map[string]string{
+		handlers.RateLimitRateLabel:  "0.01",
+		handlers.RateLimitBurstLabel: "1",
+	})
+
+	call := func(forwardedFor string) int {
+		req := httptest.NewRequest(http.MethodPost, "/function/webhook", nil)
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if code := call("1.1.1.1, 203.0.113.7"); code != http.StatusOK {
+		t.Logf("Expected the first call to pass, got: %d", code)
+		t.Fail()
+	}
+	if code := call("2.2.2.2, 203.0.113.7"); code != http.StatusTooManyRequests {
+		t.Logf("Expected the client's own X-Forwarded-For entries to be ignored, got: %d", code)
+		t.Fail()
+	}
+}
+
+func TestRateLimitHandler_ForwardedForOnlyFromTrustedProxies(t *testing.T) {
+	router := makeRateLimitedRouter(map[string]string{
+		handlers.RateLimitRateLabel:  "0.01",
+		handlers.RateLimitBurstLabel: "1",
+	})
+
+	call := func(remoteAddr, forwardedFor string) int {
+		req := httptest.NewRequest(http.MethodPost, "/function/webhook", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if code := call("198.51.100.9:4000", "203.0.113.7"); code != http.StatusOK {
+		t.Logf("Expected the first call to pass, got: %d", code)
+		t.Fail()
+	}
+	if code := call("198.51.100.9:4001", "203.0.113.8"); code != http.StatusTooManyRequests {
+		t.Logf("Expected X-Forwarded-For from an untrusted address to be ignored, got: %d", code)
+		t.Fail()
+	}
+	if code := call("192.0.2.1:4000", "198.51.100.9"); code != http.StatusTooManyRequests {
+		t.Logf("Expected the trusted proxy's X-Forwarded-For to name the same caller, got: %d", code)
+		t.Fail()
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	trusted, err := handlers.ParseTrustedProxies("10.0.0.0/8, 192.168.1.5,::1")
+	if err != nil || len(trusted) != 3 {
+		t.Fatalf("Expected 3 trusted proxies, got: %v %s", trusted, err)
+	}
+	if _, err := handlers.ParseTrustedProxies("10.0.0.0/8,gorouter"); err == nil {
+		t.Log("Expected an error for an entry which isn't an IP or CIDR")
+		t.Fail()
+	}
+}
+
+func TestRateLimitHandler_KeyedByCheckedAPIKey(t *testing.T) {
+	router := makeRateLimitedRouter(map[string]string{
+		handlers.RateLimitRateLabel:  "0.01",
+		handlers.RateLimitBurstLabel: "1",
+		handlers.RateLimitKeyLabel:   "apikey",
+	})
+
+	call := func(rawKey string) int {
+		req := httptest.NewRequest(http.MethodPost, "/function/webhook", nil)
+		req.Header.Set("X-API-Key", rawKey)
+		req.Header.Set("X-Api-Key-Id", "0123456789abcdef")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	call("first")
+	if code := call("second"); code != http.StatusTooManyRequests {
+		t.Logf("Expected calls with the same checked key to share a limit, got: %d", code)
+		t.Fail()
+	}
+}
+
+func TestRateLimitHandler_KeysWithTheSameNameDontShareALimit(t *testing.T) {
+	lookup := func(name string) (map[string]string, error) {
+		return map[string]string{
+			handlers.AuthLabel:           "apikey",
+			handlers.RateLimitRateLabel:  "0.01",
+			handlers.RateLimitBurstLabel: "1",
+			handlers.RateLimitKeyLabel:   "apikey",
+		}, nil
+	}
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}
+	keys := handlers.NewAPIKeys(handlers.NewMemoryAPIKeyStore(), time.Minute)
+	authenticator := handlers.NewAuthenticator(lookup, keys, nil, metrics.BuildMetricsOptions())
+	limited := handlers.MakeRateLimitHandler(ok, lookup, handlers.NewMemoryRateLimitStore(), metrics.BuildMetricsOptions())
+
+	router := mux.NewRouter()
+	router.HandleFunc("/function/{name}", handlers.MakeAuthHandler(limited, authenticator))
+
+	call := func(rawKey string) int {
+		req := httptest.NewRequest(http.MethodPost, "/function/webhook", nil)
+		req.Header.Set("X-API-Key", rawKey)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	first, _ := keys.Create("ci", nil)
+	second, _ := keys.Create("ci", nil)
+	if code := call(first.Key); code != http.StatusOK {
+		t.Fatalf("Expected the first key to be allowed, got: %d", code)
+	}
+	if code := call(second.Key); code != http.StatusOK {
+		t.Logf("Expected another key named ci to have its own limit, got: %d", code)
+		t.Fail()
+	}
+}
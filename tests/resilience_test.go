@@ -0,0 +1,122 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nwright-nz/openfaas-cf-backend/handlers"
+)
+
+func TestParseResiliencePolicy_ReadsLabels(t *testing.T) {
+	policy := handlers.ParseResiliencePolicy(map[string]string{
+		handlers.RetryAttemptsLabel:   "5",
+		handlers.RetryBackoffLabel:    "50ms",
+		handlers.BreakerFailuresLabel: "0",
+		handlers.BreakerOpenLabel:     "10",
+	})
+
+	if policy.Attempts != 5 || policy.Backoff != 50*time.Millisecond {
+		t.Logf("Expected 5 attempts with 50ms backoff, got: %+v", policy)
+		t.Fail()
+	}
+	if policy.BreakerFailures != 0 || policy.BreakerOpen != 10*time.Second {
+		t.Logf("Expected a disabled breaker open for 10s, got: %+v", policy)
+		t.Fail()
+	}
+	if policy.MaxBackoff != 2*time.Second {
+		t.Logf("Expected default max backoff of 2s, got: %s", policy.MaxBackoff)
+		t.Fail()
+	}
+}
+
+func TestParseResiliencePolicy_RetriesAndBreakerAreOptIn(t *testing.T) {
+	policy := handlers.ParseResiliencePolicy(map[string]string{})
+
+	if policy.Attempts != 1 || policy.BreakerFailures != 0 {
+		t.Logf("Expected a single attempt and no breaker without labels, got: %+v", policy)
+		t.Fail()
+	}
+}
+
+func TestResiliencePolicy_BackoffDoublesUpToMax(t *testing.T) {
+	policy := handlers.ResiliencePolicy{Backoff: 100 * time.Millisecond, MaxBackoff: 350 * time.Millisecond}
+
+	want := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 350 * time.Millisecond, 350 * time.Millisecond}
+	for i, expected := range want {
+		if backoff := policy.BackoffFor(i + 1); backoff != expected {
+			t.Logf("Retry %d expected backoff %s, got: %s", i+1, expected, backoff)
+			t.Fail()
+		}
+	}
+}
+
+func TestCircuitBreaker_OpensAfterConsecutiveFailures(t *testing.T) {
+	breaker := handlers.NewCircuitBreaker(nil)
+
+	for i := 0; i < 3; i++ {
+		if allowed, _ := breaker.Allow(); !allowed {
+			t.Fatalf("Expected call %d to be allowed", i+1)
+		}
+		breaker.Failure(3, time.Minute)
+	}
+
+	allowed, wait := breaker.Allow()
+	if allowed || breaker.State() != handlers.BreakerOpen {
+		t.Logf("Expected the breaker to open after 3 failures, state: %d", breaker.State())
+		t.Fail()
+	}
+	if wait <= 0 || wait > time.Minute {
+		t.Logf("Expected to wait up to a minute, got: %s", wait)
+		t.Fail()
+	}
+}
+
+func TestCircuitBreaker_SuccessResetsFailures(t *testing.T) {
+	breaker := handlers.NewCircuitBreaker(nil)
+
+	breaker.Failure(2, time.Minute)
+	breaker.Success()
+	breaker.Failure(2, time.Minute)
+
+	if breaker.State() != handlers.BreakerClosed {
+		t.Logf("Expected failures which aren't consecutive to keep the breaker closed, state: %d", breaker.State())
+		t.Fail()
+	}
+}
+
+func TestCircuitBreaker_HalfOpenProbe(t *testing.T) {
+	breaker := handlers.NewCircuitBreaker(nil)
+	breaker.Failure(1, 10*time.Millisecond)
+
+	time.Sleep(20 * time.Millisecond)
+
+	if allowed, _ := breaker.Allow(); !allowed {
+		t.Fatal("Expected a probe to be allowed once the breaker has been open long enough")
+	}
+	if allowed, _ := breaker.Allow(); allowed {
+		t.Log("Expected only one probe while half-open")
+		t.Fail()
+	}
+
+	breaker.Success()
+	if breaker.State() != handlers.BreakerClosed {
+		t.Logf("Expected a successful probe to close the breaker, state: %d", breaker.State())
+		t.Fail()
+	}
+}
+
+func TestCircuitBreaker_FailedProbeReopens(t *testing.T) {
+	breaker := handlers.NewCircuitBreaker(nil)
+	for i := 0; i < 5; i++ {
+		breaker.Failure(5, 10*time.Millisecond)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	breaker.Allow()
+	breaker.Failure(5, time.Minute)
+
+	if allowed, _ := breaker.Allow(); allowed || breaker.State() != handlers.BreakerOpen {
+		t.Logf("Expected a failed probe to open the breaker again, state: %d", breaker.State())
+		t.Fail()
+	}
+}
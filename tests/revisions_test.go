@@ -0,0 +1,120 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/nwright-nz/openfaas-cf-backend/handlers"
+	"github.com/nwright-nz/openfaas-cf-backend/metrics"
+	"github.com/nwright-nz/openfaas-cf-backend/requests"
+)
+
+var revisionsResponses = map[string]string{
+	"GET /v2/apps": `{"resources": [{"metadata": {"guid": "app-1"}, "entity": {"name": "echoit",
+		"environment_json": {"function": "true", "fprocess": "cat", "API_TOKEN": "new", "ADDED": "later"}}}]}`,
+	"GET /v3/apps/app-1/droplets": `{"resources": [
+		{"guid": "droplet-3", "state": "FAILED", "image": "echoit:3"},
+		{"guid": "droplet-2", "state": "STAGED", "image": "echoit:2", "created_at": "2018-02-02T00:00:00Z",
+			"metadata": {"annotations": {"openfaas.env-ref": "env-2", "openfaas.env-sha256": "hash-2"}}},
+		{"guid": "droplet-1", "state": "STAGED", "image": "echoit:1", "created_at": "2018-01-01T00:00:00Z",
+			"metadata": {"annotations": {"openfaas.env-ref": "env-1", "openfaas.env-sha256": "hash-1"}}}]}`,
+	"GET /v3/apps/app-1/relationships/current_droplet":   `{"data": {"guid": "droplet-2"}}`,
+	"PATCH /v3/apps/app-1/relationships/current_droplet": `{"data": {"guid": "droplet-1"}}`,
+	"GET /v2/user_provided_service_instances/env-1": `{"metadata": {"guid": "env-1"},
+		"entity": {"credentials": {"function": "true", "fprocess": "cat", "API_TOKEN": "old"}}}`,
+	"PUT /v2/apps/app-1":                  `{}`,
+	"POST /v3/apps/app-1/actions/restart": `{}`,
+}
+
+func makeRevisionsRouter(handler http.HandlerFunc) *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/system/functions/{name}/revisions", handler)
+	router.HandleFunc("/system/functions/{name}/rollback", handler)
+	return router
+}
+
+func TestRevisionsHandler_ListsStagedDropletsNewestFirst(t *testing.T) {
+	fake, client := newFakeCloudController(t, revisionsResponses)
+	defer fake.Close()
+
+	router := makeRevisionsRouter(handlers.MakeRevisionsHandler(metrics.BuildMetricsOptions(), client))
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/system/functions/echoit/revisions", nil))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got: %d %s", rr.Code, rr.Body.String())
+	}
+	revisions := []requests.FunctionRevision{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &revisions); err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 2 || revisions[0].Revision != "droplet-2" || revisions[1].Revision != "droplet-1" {
+		t.Fatalf("Expected the two staged droplets newest first, got: %v", revisions)
+	}
+	if !revisions[0].Current || revisions[1].Current {
+		t.Logf("Expected only droplet-2 to be current, got: %v", revisions)
+		t.Fail()
+	}
+	if revisions[1].Image != "echoit:1" || revisions[1].EnvHash != "hash-1" {
+		t.Logf("Expected the image and environment hash of droplet-1, got: %v", revisions[1])
+		t.Fail()
+	}
+}
+
+func TestRollbackHandler_RestoresEnvironmentOfRevision(t *testing.T) {
+	fake, client := newFakeCloudController(t, revisionsResponses)
+	defer fake.Close()
+
+	router := makeRevisionsRouter(handlers.MakeRollbackHandler(metrics.BuildMetricsOptions(), client))
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/system/functions/echoit/rollback?revision=droplet-1", nil))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got: %d %s", rr.Code, rr.Body.String())
+	}
+
+	body, ok := fake.called("PUT /v2/apps/app-1")
+	if !ok {
+		t.Fatal("Expected the environment to be restored")
+	}
+	update := struct {
+		Environment map[string]string `json:"environment_json"`
+	}{}
+	json.Unmarshal(body, &update)
+	if update.Environment["API_TOKEN"] != "old" || update.Environment["fprocess"] != "cat" {
+		t.Logf("Expected the environment of droplet-1, got: %v", update.Environment)
+		t.Fail()
+	}
+	if _, ok := update.Environment["ADDED"]; ok {
+		t.Logf("Expected keys added since droplet-1 to be removed, got: %v", update.Environment)
+		t.Fail()
+	}
+	if _, ok := fake.called("POST /v3/apps/app-1/actions/restart"); !ok {
+		t.Log("Expected the function to be restarted")
+		t.Fail()
+	}
+}
+
+func TestRollbackHandler_UnknownRevisionIsNotFound(t *testing.T) {
+	fake, client := newFakeCloudController(t, revisionsResponses)
+	defer fake.Close()
+
+	router := makeRevisionsRouter(handlers.MakeRollbackHandler(metrics.BuildMetricsOptions(), client))
+	for _, revision := range []string{"droplet-9", "droplet-3"} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/system/functions/echoit/rollback?revision="+revision, nil))
+
+		if rr.Code != http.StatusNotFound || !strings.Contains(rr.Body.String(), revision) {
+			t.Logf("Expected 404 for %s, got: %d %s", revision, rr.Code, rr.Body.String())
+			t.Fail()
+		}
+	}
+	if _, ok := fake.called("POST /v3/apps/app-1/actions/restart"); ok {
+		t.Log("Expected the function not to be restarted")
+		t.Fail()
+	}
+}
@@ -0,0 +1,127 @@
+package tests
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nwright-nz/openfaas-cf-backend/handlers"
+	"github.com/nwright-nz/openfaas-cf-backend/requests"
+)
+
+func makeRoutedGateway(routes ...requests.FunctionRoute) http.Handler {
+	store := handlers.NewMemoryRouteStore()
+	for _, route := range routes {
+		store.Save(route)
+	}
+	router := mux.NewRouter()
+	function := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(mux.Vars(r)["name"] + " " + r.URL.Path))
+	}
+	router.HandleFunc("/function/{name}", function)
+	router.PathPrefix("/function/{name}/").HandlerFunc(function)
+	gateway := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("gateway"))
+	}
+	router.HandleFunc("/", gateway)
+	router.HandleFunc("/system/functions", gateway)
+	return handlers.MakeRouteHandler(router, handlers.NewRouteTable(store, time.Minute))
+}
+
+func TestRouteHandler_MatchesHostAndLongestPath(t *testing.T) {
+	gateway := makeRoutedGateway(
+		requests.FunctionRoute{Host: "api.example.com", Path: "/", Function: "api-fn"},
+		requests.FunctionRoute{Host: "api.example.com", Path: "/orders", Function: "orders-fn", StripPrefix: true},
+		requests.FunctionRoute{Path: "/shop", Function: "shop-fn"},
+	)
+
+	cases := []struct {
+		host string
+		path string
+		want string
+	}{
+		{"api.example.com", "/orders/1", "orders-fn /function/orders-fn/1"},
+		{"API.example.com:8080", "/ordersx", "api-fn /function/api-fn/ordersx"},
+		{"gateway.local", "/shop/cart", "shop-fn /function/shop-fn/shop/cart"},
+		{"gateway.local", "/", "gateway"},
+		{"api.example.com", "/system/functions", "gateway"},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, c.path, nil)
+		req.Host = c.host
+		rr := httptest.NewRecorder()
+		gateway.ServeHTTP(rr, req)
+		if rr.Body.String() != c.want {
+			t.Logf("%s%s: want %q, got %q", c.host, c.path, c.want, rr.Body.String())
+			t.Fail()
+		}
+	}
+}
+
+func TestRouteHandler_XFunctionFallback(t *testing.T) {
+	gateway := makeRoutedGateway()
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("{}"))
+	req.Header.Set("X-Function", "echo")
+	rr := httptest.NewRecorder()
+	gateway.ServeHTTP(rr, req)
+
+	if rr.Body.String() != "echo /function/echo/" {
+		t.Logf("Want the call routed to echo, got %q", rr.Body.String())
+		t.Fail()
+	}
+}
+
+func TestRoutesHandler_RejectsGatewayPaths(t *testing.T) {
+	table := handlers.NewRouteTable(handlers.NewMemoryRouteStore(), time.Minute)
+	handler := handlers.MakeRoutesHandler(table)
+
+	rr := httptest.NewRecorder()
+	handler(rr, httptest.NewRequest(http.MethodPost, "/system/routes", strings.NewReader(`{"path":"/system/functions","function":"evil"}`)))
+	if rr.Code != http.StatusBadRequest {
+		t.Logf("Want 400, got %d", rr.Code)
+		t.Fail()
+	}
+
+	rr = httptest.NewRecorder()
+	handler(rr, httptest.NewRequest(http.MethodPost, "/system/routes", strings.NewReader(`{"host":"api.example.com","path":"/system","function":"evil"}`)))
+	if rr.Code != http.StatusBadRequest {
+		t.Logf("Want 400 for a gateway path on a host, got %d", rr.Code)
+		t.Fail()
+	}
+
+	rr = httptest.NewRecorder()
+	handler(rr, httptest.NewRequest(http.MethodPost, "/system/routes", strings.NewReader(`{"host":"Shop.Example.com","path":"orders/","function":"orders-fn"}`)))
+	routes, _ := table.Routes()
+	if rr.Code != http.StatusOK || len(routes) != 1 || routes[0].Host != "shop.example.com" || routes[0].Path != "/orders" {
+		t.Logf("Want the route saved normalised, got %d %+v", rr.Code, routes)
+		t.Fail()
+	}
+}
+
+type failingRouteStore struct {
+	handlers.MemoryRouteStore
+	lists int
+}
+
+func (s *failingRouteStore) List() ([]requests.FunctionRoute, error) {
+	s.lists++
+	return nil, errors.New("cloud controller unavailable")
+}
+
+func TestRouteTable_RemembersFailures(t *testing.T) {
+	store := &failingRouteStore{}
+	table := handlers.NewRouteTable(store, time.Minute)
+
+	for i := 0; i < 10; i++ {
+		table.Match("api.example.com", "/orders")
+	}
+	if store.lists != 1 {
+		t.Logf("Want the store read once while it's failing, got %d", store.lists)
+		t.Fail()
+	}
+}
@@ -0,0 +1,119 @@
+package tests
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nwright-nz/openfaas-cf-backend/handlers"
+	"github.com/nwright-nz/openfaas-cf-backend/requests"
+)
+
+func makeScatterRouter(inflight, peak *int32) *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/function/{name}", func(w http.ResponseWriter, r *http.Request) {
+		current := atomic.AddInt32(inflight, 1)
+		defer atomic.AddInt32(inflight, -1)
+		for {
+			seen := atomic.LoadInt32(peak)
+			if current <= seen || atomic.CompareAndSwapInt32(peak, seen, current) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+
+		body, _ := ioutil.ReadAll(r.Body)
+		if mux.Vars(r)["name"] == "broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if mux.Vars(r)["name"] == "aborted" {
+			w.Write([]byte("partial"))
+			panic(http.ErrAbortHandler)
+		}
+		w.Write([]byte(mux.Vars(r)["name"] + ":" + string(body)))
+	})
+	router.HandleFunc("/system/scatter", handlers.MakeScatterHandler(router))
+	return router
+}
+
+func TestScatter_ReportsEachResultInOrder(t *testing.T) {
+	var inflight, peak int32
+	router := makeScatterRouter(&inflight, &peak)
+
+	body := `{"body":"x","parallelism":2,"calls":[{"function":"a"},{"function":"broken"},{"function":"b","body":"y"},{"function":"c"}]}`
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/system/scatter", strings.NewReader(body)))
+
+	if rr.Code != http.StatusOK {
+		t.Logf("Want 200 with partial failures, got %d", rr.Code)
+		t.Fail()
+		return
+	}
+
+	response := requests.ScatterResponse{}
+	json.Unmarshal(rr.Body.Bytes(), &response)
+	want := []string{"a:x", "", "b:y", "c:x"}
+	for i, result := range response.Results {
+		if result.Body != want[i] {
+			t.Logf("Result %d: want %q, got %q", i, want[i], result.Body)
+			t.Fail()
+		}
+	}
+	if response.Results[1].Status != http.StatusInternalServerError || len(response.Results[1].Error) == 0 {
+		t.Logf("Want the broken call reported as 500, got %+v", response.Results[1])
+		t.Fail()
+	}
+	if peak > 2 {
+		t.Logf("Want at most 2 calls in progress, got %d", peak)
+		t.Fail()
+	}
+}
+
+func TestScatter_Multipart(t *testing.T) {
+	var inflight, peak int32
+	router := makeScatterRouter(&inflight, &peak)
+
+	req := httptest.NewRequest(http.MethodPost, "/system/scatter", strings.NewReader(`{"function":"a","calls":[{"body":"1"},{"body":"2"}]}`))
+	req.Header.Set("Accept", "multipart/mixed")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	boundary := strings.TrimPrefix(rr.Header().Get("Content-Type"), "multipart/mixed; boundary=")
+	reader := multipart.NewReader(rr.Body, boundary)
+	for _, want := range []string{"a:1", "a:2"} {
+		part, err := reader.NextPart()
+		if err != nil {
+			t.Log(err)
+			t.Fail()
+			return
+		}
+		got, _ := ioutil.ReadAll(part)
+		if string(got) != want || part.Header.Get("X-Function-Status") != "200" {
+			t.Logf("Want part %s with status 200, got %s %s", want, got, part.Header.Get("X-Function-Status"))
+			t.Fail()
+		}
+	}
+}
+
+func TestScatter_AbortedCallIsBadGateway(t *testing.T) {
+	var inflight, peak int32
+	router := makeScatterRouter(&inflight, &peak)
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/system/scatter", strings.NewReader(`{"calls":[{"function":"aborted"},{"function":"a"}]}`)))
+
+	response := requests.ScatterResponse{}
+	json.Unmarshal(rr.Body.Bytes(), &response)
+	if len(response.Results) != 2 || response.Results[0].Status != http.StatusBadGateway || response.Results[1].Status != http.StatusOK {
+		t.Logf("Want the aborted call reported as 502, got %+v", response.Results)
+		t.Fail()
+	}
+}
@@ -0,0 +1,105 @@
+package tests
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nwright-nz/openfaas-cf-backend/handlers"
+	"github.com/nwright-nz/openfaas-cf-backend/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+type shadowCall struct {
+	function string
+	body     string
+	path     string
+}
+
+func counterValue(counter prometheus.Counter) float64 {
+	metric := dto.Metric{}
+	counter.Write(&metric)
+	return metric.GetCounter().GetValue()
+}
+
+func TestShadow_CopiesCallsWithoutDelayingPrimary(t *testing.T) {
+	lookup := func(name string) (map[string]string, error) {
+		return map[string]string{handlers.ShadowLabel: "orders-v2", handlers.ShadowPercentLabel: "100"}, nil
+	}
+	primary := func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}
+
+	release := make(chan struct{})
+	calls := make(chan shadowCall, 1)
+	shadow := func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		body, _ := ioutil.ReadAll(r.Body)
+		calls <- shadowCall{function: r.Header.Get("X-Function"), body: string(body), path: r.URL.Path}
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+
+	router := mux.NewRouter()
+	router.PathPrefix("/function/{name}/").HandlerFunc(handlers.MakeShadowHandler(primary, lookup, shadow, metrics.BuildMetricsOptions()))
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/function/orders/items", strings.NewReader("order")))
+	if rr.Code != http.StatusOK || rr.Body.String() != "order" {
+		t.Logf("Want the primary's response while the shadow is still running, got %d %s", rr.Code, rr.Body.String())
+		t.Fail()
+	}
+
+	close(release)
+	select {
+	case call := <-calls:
+		if call.function != "orders-v2" || call.body != "order" || call.path != "/function/orders-v2/items" {
+			t.Logf("Want a copy of the call for orders-v2, got %+v", call)
+			t.Fail()
+		}
+	case <-time.After(time.Second):
+		t.Log("Want the call copied to the shadow")
+		t.Fail()
+	}
+}
+
+func TestShadow_AbortedCopyCountsAsError(t *testing.T) {
+	lookup := func(name string) (map[string]string, error) {
+		return map[string]string{handlers.ShadowLabel: "orders-v2", handlers.ShadowPercentLabel: "100"}, nil
+	}
+	primary := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}
+	aborted := make(chan struct{})
+	shadow := func(w http.ResponseWriter, r *http.Request) {
+		defer close(aborted)
+		w.WriteHeader(http.StatusOK)
+		panic(http.ErrAbortHandler)
+	}
+
+	metricsOptions := metrics.BuildMetricsOptions()
+	router := mux.NewRouter()
+	router.HandleFunc("/function/{name}", handlers.MakeShadowHandler(primary, lookup, shadow, metricsOptions))
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/function/orders", strings.NewReader("order")))
+	if rr.Code != http.StatusOK {
+		t.Logf("Want the primary's response, got %d", rr.Code)
+		t.Fail()
+	}
+
+	<-aborted
+	errors := metricsOptions.GatewayShadowCalls.WithLabelValues("orders", "orders-v2", "200", "error")
+	for i := 0; i < 100 && counterValue(errors) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if counterValue(errors) != 1 {
+		t.Log("Want the aborted copy counted as an error")
+		t.Fail()
+	}
+}
@@ -0,0 +1,136 @@
+package tests
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nwright-nz/openfaas-cf-backend/types"
+)
+
+func echoBody(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return
+	}
+	w.Write(body)
+}
+
+func TestStream_RequestOverLimitIsRejected(t *testing.T) {
+	gateway := newProxyGateway(t, http.HandlerFunc(echoBody), nil, types.GatewayConfig{MaxRequestBytes: 16})
+	defer gateway.Close()
+
+	body := strings.Repeat("x", 32)
+	// A declared length over the limit and a chunked body which goes over it are both refused.
+	for _, reader := range []io.Reader{strings.NewReader(body), io.MultiReader(strings.NewReader(body))} {
+		response, err := http.Post(gateway.server.URL+"/function/echoit", "text/plain", reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+
+		if response.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Logf("Expected 413, got: %d", response.StatusCode)
+			t.Fail()
+		}
+	}
+
+	response, err := http.Post(gateway.server.URL+"/function/echoit", "text/plain", strings.NewReader("small"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if reply, _ := ioutil.ReadAll(response.Body); response.StatusCode != http.StatusOK || string(reply) != "small" {
+		t.Logf("Expected a body within the limit to reach the function, got: %d %q", response.StatusCode, reply)
+		t.Fail()
+	}
+}
+
+func TestStream_ResponseWithLengthOverLimitIsBadGateway(t *testing.T) {
+	function := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "32")
+		w.Write(bytes.Repeat([]byte("x"), 32))
+	}
+	gateway := newProxyGateway(t, http.HandlerFunc(function), nil, types.GatewayConfig{MaxResponseBytes: 16})
+	defer gateway.Close()
+
+	response, err := http.Get(gateway.server.URL + "/function/echoit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusBadGateway {
+		t.Logf("Expected 502, got: %d", response.StatusCode)
+		t.Fail()
+	}
+}
+
+func TestStream_StreamedResponseOverLimitIsAborted(t *testing.T) {
+	function := func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte("x"), 8))
+		w.(http.Flusher).Flush()
+		time.Sleep(50 * time.Millisecond)
+		w.Write(bytes.Repeat([]byte("x"), 32))
+	}
+	gateway := newProxyGateway(t, http.HandlerFunc(function), nil, types.GatewayConfig{MaxResponseBytes: 16})
+	defer gateway.Close()
+
+	response, err := http.Get(gateway.server.URL + "/function/echoit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err == nil {
+		t.Logf("Expected the response to be cut off, got all of: %q", body)
+		t.Fail()
+	}
+	if string(body) != "xxxxxxxx" {
+		t.Logf("Expected only the bytes within the limit before the abort, got: %q", body)
+		t.Fail()
+	}
+}
+
+func TestStream_ResponseIsFlushedAsWritten(t *testing.T) {
+	release := make(chan struct{})
+	function := func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "first\n")
+		w.(http.Flusher).Flush()
+		<-release
+		fmt.Fprint(w, "second\n")
+	}
+	gateway := newProxyGateway(t, http.HandlerFunc(function), nil, types.GatewayConfig{})
+	defer gateway.Close()
+	defer close(release)
+
+	response, err := http.Get(gateway.server.URL + "/function/echoit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	lines := make(chan string)
+	go func() {
+		line, _ := bufio.NewReader(response.Body).ReadString('\n')
+		lines <- line
+	}()
+
+	select {
+	case line := <-lines:
+		if line != "first\n" {
+			t.Logf("Expected the first line, got: %q", line)
+			t.Fail()
+		}
+	case <-time.After(time.Second):
+		t.Log("Expected the first line before the function finished")
+		t.Fail()
+	}
+}
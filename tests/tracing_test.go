@@ -0,0 +1,151 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/nwright-nz/openfaas-cf-backend/tracing"
+)
+
+type collectedSpan struct {
+	TraceID      string `json:"traceId"`
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+	Kind         int    `json:"kind"`
+}
+
+// startCollector runs an in-process OTLP/HTTP collector which keeps the spans it receives.
+func startCollector(t *testing.T) (*httptest.Server, func() []collectedSpan) {
+	var mu sync.Mutex
+	var spans []collectedSpan
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			t.Logf("Expected spans on /v1/traces, got: %s", r.URL.Path)
+			t.Fail()
+		}
+
+		payload := struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []collectedSpan `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Fatal(err)
+		}
+
+		mu.Lock()
+		for _, resource := range payload.ResourceSpans {
+			for _, scope := range resource.ScopeSpans {
+				spans = append(spans, scope.Spans...)
+			}
+		}
+		mu.Unlock()
+	}))
+
+	return server, func() []collectedSpan {
+		mu.Lock()
+		defer mu.Unlock()
+		return spans
+	}
+}
+
+func TestTracer_ExportsServerAndChildSpans(t *testing.T) {
+	collector, collected := startCollector(t)
+	defer collector.Close()
+
+	exporter := tracing.NewOTLPExporter(collector.URL, "gateway", 0, http.DefaultClient)
+	tracer := tracing.NewTracer(exporter, 1)
+
+	var injected http.Header
+	handler := tracer.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, span := tracing.StartSpan(r.Context(), "call echoit", tracing.Client)
+		injected = make(http.Header)
+		span.Inject(injected)
+		span.Finish()
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/function/echoit", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if err := exporter.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := collected()
+	if len(spans) != 2 {
+		t.Fatalf("Expected 2 spans, got: %d", len(spans))
+	}
+
+	client, server := spans[0], spans[1]
+	if server.ParentSpanID != "00f067aa0ba902b7" || server.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Logf("Expected the server span to continue the caller's trace, got: %+v", server)
+		t.Fail()
+	}
+	if client.ParentSpanID != server.SpanID || client.Kind != tracing.Client {
+		t.Logf("Expected the client span to be a child of the server span, got: %+v", client)
+		t.Fail()
+	}
+
+	if want := "00-4bf92f3577b34da6a3ce929d0e0e4736-" + client.SpanID + "-01"; injected.Get("traceparent") != want {
+		t.Logf("Expected traceparent %s, got: %s", want, injected.Get("traceparent"))
+		t.Fail()
+	}
+	if injected.Get("X-B3-TraceId") != client.TraceID || injected.Get("X-B3-Sampled") != "1" {
+		t.Logf("Expected B3 headers for the call, got: %v", injected)
+		t.Fail()
+	}
+}
+
+func TestTracer_UnsampledTraceIsNotExported(t *testing.T) {
+	collector, collected := startCollector(t)
+	defer collector.Close()
+
+	exporter := tracing.NewOTLPExporter(collector.URL, "gateway", 0, http.DefaultClient)
+	tracer := tracing.NewTracer(exporter, 0)
+
+	handler := tracer.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/system/functions", nil))
+	exporter.Flush()
+
+	if spans := collected(); len(spans) != 0 {
+		t.Logf("Expected no spans with a sample ratio of 0, got: %d", len(spans))
+		t.Fail()
+	}
+}
+
+func TestExtract_B3Headers(t *testing.T) {
+	header := make(http.Header)
+	header.Set("X-B3-TraceId", "a3ce929d0e0e4736")
+	header.Set("X-B3-SpanId", "00f067aa0ba902b7")
+	header.Set("X-B3-Sampled", "1")
+
+	sc, ok := tracing.Extract(header)
+	if !ok || !sc.Sampled {
+		t.Fatalf("Expected a sampled span context from B3 headers, got: %+v", sc)
+	}
+	if sc.TraceID[7] != 0 || sc.TraceID[8] != 0xa3 {
+		t.Logf("Expected a 64 bit trace ID to be left-padded, got: %x", sc.TraceID)
+		t.Fail()
+	}
+}
+
+func TestExtract_InvalidTraceparent(t *testing.T) {
+	header := make(http.Header)
+	header.Set("traceparent", "00-00000000000000000000000000000000-00f067aa0ba902b7-01")
+
+	if _, ok := tracing.Extract(header); ok {
+		t.Log("Expected an all-zero trace ID to be rejected")
+		t.Fail()
+	}
+}
@@ -0,0 +1,133 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nwright-nz/openfaas-cf-backend/handlers"
+	"github.com/nwright-nz/openfaas-cf-backend/requests"
+)
+
+func TestPickVersion_SingleWeightedVersion(t *testing.T) {
+	policy := requests.TrafficPolicy{Weights: map[string]int{"v2": 100, "v3": 0}}
+
+	for i := 0; i < 20; i++ {
+		if version := handlers.PickVersion(policy, ""); version != "v2" {
+			t.Logf("Expected only v2 to receive traffic, got: %s", version)
+			t.Fail()
+		}
+	}
+}
+
+func TestPickVersion_SplitsByWeight(t *testing.T) {
+	policy := requests.TrafficPolicy{Weights: map[string]int{"v2": 90, "v3": 10}}
+
+	counts := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		counts[handlers.PickVersion(policy, "")]++
+	}
+
+	if counts["v3"] < 700 || counts["v3"] > 1300 {
+		t.Logf("Expected roughly 10%% of calls for v3, got: %v", counts)
+		t.Fail()
+	}
+}
+
+func TestPickVersion_StickyValueKeepsVersion(t *testing.T) {
+	policy := requests.TrafficPolicy{Weights: map[string]int{"v2": 50, "v3": 50}}
+
+	first := handlers.PickVersion(policy, "user-1234")
+	for i := 0; i < 20; i++ {
+		if version := handlers.PickVersion(policy, "user-1234"); version != first {
+			t.Logf("Expected sticky value to stay on %s, got: %s", first, version)
+			t.Fail()
+		}
+	}
+}
+
+func TestPickVersion_NoWeights(t *testing.T) {
+	if version := handlers.PickVersion(requests.TrafficPolicy{}, ""); version != "" {
+		t.Logf("Expected no version, got: %s", version)
+		t.Fail()
+	}
+}
+
+var versionsResponses = map[string]string{
+	"GET /v3/apps": `{"resources": [
+		{"guid": "app-v1", "name": "echoit-v1", "metadata": {
+			"labels": {"openfaas.com/function": "echoit", "openfaas.com/version": "v1"},
+			"annotations": {"openfaas.com/traffic": "{\"weights\": {\"v1\": 100}}"}}},
+		{"guid": "app-v2", "name": "echoit-v2", "metadata": {
+			"labels": {"openfaas.com/function": "echoit", "openfaas.com/version": "v2"}}}]}`,
+	"PATCH /v3/apps/app-v1": `{}`,
+	"PATCH /v3/apps/app-v2": `{}`,
+}
+
+func makeTrafficRouter(splitter *handlers.TrafficSplitter) *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/system/functions/{name}/traffic", handlers.MakeTrafficHandler(splitter))
+	return router
+}
+
+func TestTrafficSplitter_FindsVersionsByLabel(t *testing.T) {
+	fake, client := newFakeCloudController(t, versionsResponses)
+	defer fake.Close()
+
+	policy, err := handlers.NewTrafficSplitter(client, time.Minute).Policy("echoit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy == nil || policy.Weights["v1"] != 100 {
+		t.Logf("Expected the policy annotated on v1, got: %v", policy)
+		t.Fail()
+	}
+
+	query, _ := url.ParseQuery(fake.query("GET /v3/apps"))
+	if query.Get("label_selector") != "openfaas.com/function=echoit" {
+		t.Logf("Expected versions to be listed by label, got query: %v", query)
+		t.Fail()
+	}
+}
+
+func TestTrafficHandler_StoresPolicyOnEachVersion(t *testing.T) {
+	fake, client := newFakeCloudController(t, versionsResponses)
+	defer fake.Close()
+
+	rr := httptest.NewRecorder()
+	makeTrafficRouter(handlers.NewTrafficSplitter(client, time.Minute)).ServeHTTP(rr,
+		httptest.NewRequest(http.MethodPost, "/system/functions/echoit/traffic", strings.NewReader(`{"v1": 90, "v2": 10}`)))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got: %d %s", rr.Code, rr.Body.String())
+	}
+	for _, call := range []string{"PATCH /v3/apps/app-v1", "PATCH /v3/apps/app-v2"} {
+		body, ok := fake.called(call)
+		if !ok || !strings.Contains(string(body), `"openfaas.com/traffic"`) {
+			t.Logf("Expected %s to annotate the policy, got: %s", call, body)
+			t.Fail()
+		}
+	}
+}
+
+func TestTrafficHandler_UnknownVersionIsRejected(t *testing.T) {
+	fake, client := newFakeCloudController(t, versionsResponses)
+	defer fake.Close()
+
+	rr := httptest.NewRecorder()
+	makeTrafficRouter(handlers.NewTrafficSplitter(client, time.Minute)).ServeHTTP(rr,
+		httptest.NewRequest(http.MethodPost, "/system/functions/echoit/traffic", strings.NewReader(`{"v1": 50, "v9": 50}`)))
+
+	if rr.Code != http.StatusBadRequest {
+		t.Logf("Expected 400 for an unknown version, got: %d", rr.Code)
+		t.Fail()
+	}
+	if _, ok := fake.called("PATCH /v3/apps/app-v1"); ok {
+		t.Log("Expected no version to be annotated")
+		t.Fail()
+	}
+}
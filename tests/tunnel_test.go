@@ -0,0 +1,115 @@
+package tests
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nwright-nz/openfaas-cf-backend/types"
+)
+
+// upperEcho accepts a WebSocket upgrade and echoes each line back in upper case.
+func upperEcho(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Upgrade") != "websocket" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	conn, buffered, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	buffered.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	buffered.Flush()
+	for {
+		line, err := buffered.ReadString('\n')
+		if err != nil {
+			return
+		}
+		buffered.WriteString(strings.ToUpper(line))
+		buffered.Flush()
+	}
+}
+
+func TestTunnel_WebSocketRoundTrip(t *testing.T) {
+	gateway := newProxyGateway(t, http.HandlerFunc(upperEcho), nil, types.GatewayConfig{ReadTimeout: 200 * time.Millisecond, WriteTimeout: 200 * time.Millisecond})
+	defer gateway.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(gateway.server.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	fmt.Fprint(conn, "GET /function/echoit HTTP/1.1\r\nHost: gateway\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols || response.Header.Get("Upgrade") != "websocket" {
+		t.Fatalf("Expected the switch to a WebSocket, got: %d %v", response.StatusCode, response.Header)
+	}
+
+	// Messages keep flowing after the server's read and write timeouts have passed.
+	for _, message := range []string{"hello", "later"} {
+		fmt.Fprintf(conn, "%s\n", message)
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != strings.ToUpper(message)+"\n" {
+			t.Logf("Expected %s echoed through the tunnel, got: %q", message, line)
+			t.Fail()
+		}
+		time.Sleep(300 * time.Millisecond)
+	}
+	conn.Close()
+
+	connections := gateway.metrics.GatewayConnectionSeconds.WithLabelValues("echoit", "", "websocket")
+	if !eventually(func() bool { return histogramCount(connections) == 1 }) {
+		t.Logf("Expected the closed connection in gateway_function_connection_seconds, got: %d", histogramCount(connections))
+		t.Fail()
+	}
+}
+
+func TestTunnel_EventStreamOutlivesWriteTimeout(t *testing.T) {
+	events := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		for i := 0; i < 5; i++ {
+			fmt.Fprintf(w, "data: %d\n\n", i)
+			w.(http.Flusher).Flush()
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	gateway := newProxyGateway(t, http.HandlerFunc(events), nil, types.GatewayConfig{ReadTimeout: 200 * time.Millisecond, WriteTimeout: 200 * time.Millisecond})
+	defer gateway.Close()
+
+	response, err := http.Get(gateway.server.URL + "/function/echoit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		t.Fatalf("Expected the stream to outlive the write timeout, got: %s after %q", err, body)
+	}
+	if strings.Count(string(body), "data: ") != 5 {
+		t.Logf("Expected all 5 events, got: %q", body)
+		t.Fail()
+	}
+
+	connections := gateway.metrics.GatewayConnectionSeconds.WithLabelValues("echoit", "", "sse")
+	if !eventually(func() bool { return histogramCount(connections) == 1 }) {
+		t.Logf("Expected the stream in gateway_function_connection_seconds, got: %d", histogramCount(connections))
+		t.Fail()
+	}
+}
@@ -0,0 +1,164 @@
+package tests
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nwright-nz/openfaas-cf-backend/handlers"
+	"github.com/nwright-nz/openfaas-cf-backend/queue"
+)
+
+type workerCallback struct {
+	status string
+	callID string
+	body   string
+}
+
+func startWorker(function http.HandlerFunc, reqs ...*queue.Request) (*queue.MemoryQueue, chan workerCallback, func()) {
+	callbacks := make(chan workerCallback, len(reqs))
+	callbackServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		callbacks <- workerCallback{status: r.Header.Get("X-Function-Status"), callID: r.Header.Get(handlers.CallIDHeader), body: string(body)}
+	}))
+	callbackURL, _ := url.Parse(callbackServer.URL)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/function/{name}", function)
+
+	q := queue.NewMemoryQueue()
+	for _, req := range reqs {
+		req.CallbackURL = callbackURL
+		q.Queue(req)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go handlers.NewQueueWorker(q, router, http.DefaultClient, 2, 3).Run(ctx)
+	return q, callbacks, func() {
+		cancel()
+		callbackServer.Close()
+	}
+}
+
+func waitForCallback(t *testing.T, callbacks chan workerCallback) workerCallback {
+	select {
+	case callback := <-callbacks:
+		return callback
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the callback")
+	}
+	return workerCallback{}
+}
+
+func TestQueueWorker_CallsFunctionAndPostsResult(t *testing.T) {
+	function := func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(mux.Vars(r)["name"] + ":" + string(body) + ":" + r.URL.Query().Get("size")))
+	}
+	header := http.Header{}
+	header.Set(handlers.CallIDHeader, "resize-call")
+
+	q, callbacks, stop := startWorker(function, &queue.Request{
+		Function:    "resize",
+		Method:      http.MethodPost,
+		QueryString: "size=10",
+		Body:        []byte("image"),
+		Header:      header,
+	})
+	defer stop()
+
+	callback := waitForCallback(t, callbacks)
+	if callback.status != "201" || callback.body != "resize:image:10" || callback.callID != "resize-call" {
+		t.Logf("Unexpected callback: %+v", callback)
+		t.Fail()
+	}
+	if q.Len() != 0 {
+		t.Logf("Expected the request to be taken off the queue, got %d waiting", q.Len())
+		t.Fail()
+	}
+}
+
+func TestQueueWorker_RetriesUnavailableFunction(t *testing.T) {
+	var calls int32
+	function := func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("done"))
+	}
+
+	_, callbacks, stop := startWorker(function, &queue.Request{Function: "flaky"})
+	defer stop()
+
+	callback := waitForCallback(t, callbacks)
+	if callback.status != "200" || callback.body != "done" {
+		t.Logf("Expected the retried call's result, got %+v", callback)
+		t.Fail()
+	}
+	if atomic.LoadInt32(&calls) != 2 {
+		t.Logf("Expected 2 calls, got %d", calls)
+		t.Fail()
+	}
+}
+
+func TestQueueWorker_RecoversAbortedCall(t *testing.T) {
+	var calls int32
+	function := func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.Write([]byte("partial"))
+			panic(http.ErrAbortHandler)
+		}
+		w.Write([]byte("done"))
+	}
+
+	_, callbacks, stop := startWorker(function, &queue.Request{Function: "slow"})
+	defer stop()
+
+	callback := waitForCallback(t, callbacks)
+	if callback.status != "200" || callback.body != "done" {
+		t.Logf("Expected the aborted call to be retried, got %+v", callback)
+		t.Fail()
+	}
+}
+
+func TestQueueWorker_IdempotencyKeyOfSyncCallIsNotReplayed(t *testing.T) {
+	var calls int32
+	function := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("call " + strconv.Itoa(int(atomic.AddInt32(&calls, 1)))))
+	}
+	idempotent := handlers.MakeIdempotencyHandler(function, handlers.NewMemoryIdempotencyStore(), time.Minute)
+
+	header := http.Header{}
+	header.Set(handlers.IdempotencyKeyHeader, "order-1")
+	header.Set("X-Api-Key-Id", "0123456789abcdef")
+
+	router := mux.NewRouter()
+	router.HandleFunc("/function/{name}", idempotent)
+	syncCall := httptest.NewRequest(http.MethodPost, "/function/orders", strings.NewReader("item"))
+	syncCall.Header = header.Clone()
+	router.ServeHTTP(httptest.NewRecorder(), syncCall)
+
+	_, callbacks, stop := startWorker(idempotent, &queue.Request{
+		Function: "orders",
+		Method:   http.MethodPost,
+		Body:     []byte("item"),
+		Header:   header,
+	})
+	defer stop()
+
+	callback := waitForCallback(t, callbacks)
+	if callback.body != "call 2" {
+		t.Logf("Expected the queued call to reach the function, got: %q", callback.body)
+		t.Fail()
+	}
+}
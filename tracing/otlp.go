@@ -0,0 +1,154 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxBatch is the number of spans which triggers an export before the interval.
+const maxBatch = 512
+
+// OTLPExporter sends spans in batches to a collector with OTLP over HTTP, encoded as JSON.
+type OTLPExporter struct {
+	url         string
+	serviceName string
+	client      *http.Client
+
+	mu    sync.Mutex
+	batch []*Span
+}
+
+// NewOTLPExporter creates an exporter for the collector at endpoint i.e. http://otel-collector:4318,
+// spans are sent every interval.
+func NewOTLPExporter(endpoint string, serviceName string, interval time.Duration, client *http.Client) *OTLPExporter {
+	exporter := &OTLPExporter{
+		url:         strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		serviceName: serviceName,
+		client:      client,
+	}
+
+	if interval > 0 {
+		go func() {
+			for range time.Tick(interval) {
+				if err := exporter.Flush(); err != nil {
+					log.Printf("Unable to export spans: %s", err)
+				}
+			}
+		}()
+	}
+	return exporter
+}
+
+// ExportSpan implements Exporter.
+func (e *OTLPExporter) ExportSpan(span *Span) {
+	e.mu.Lock()
+	e.batch = append(e.batch, span)
+	full := len(e.batch) >= maxBatch
+	e.mu.Unlock()
+
+	if full {
+		go e.Flush()
+	}
+}
+
+// Flush sends the spans recorded since the last export.
+func (e *OTLPExporter) Flush() error {
+	e.mu.Lock()
+	batch := e.batch
+	e.batch = nil
+	e.mu.Unlock()
+
+	if len(batch) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(e.encode(batch))
+	if err != nil {
+		return err
+	}
+
+	res, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("collector returned %d for %d spans", res.StatusCode, len(batch))
+	}
+	return nil
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+func (e *OTLPExporter) encode(batch []*Span) map[string]interface{} {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, span := range batch {
+		encoded := otlpSpan{
+			TraceID:           hex.EncodeToString(span.Context.TraceID[:]),
+			SpanID:            hex.EncodeToString(span.Context.SpanID[:]),
+			Name:              span.Name,
+			Kind:              span.Kind,
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+		}
+		if span.ParentSpanID != [8]byte{} {
+			encoded.ParentSpanID = hex.EncodeToString(span.ParentSpanID[:])
+		}
+		for k, v := range span.Attributes() {
+			encoded.Attributes = append(encoded.Attributes, otlpAttribute{Key: k, Value: otlpValue{StringValue: v}})
+		}
+		if len(span.Error) > 0 {
+			encoded.Status = otlpStatus{Code: 2, Message: span.Error}
+		}
+		spans = append(spans, encoded)
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []otlpAttribute{{Key: "service.name", Value: otlpValue{StringValue: e.serviceName}}},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "github.com/nwright-nz/openfaas-cf-backend/tracing"},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	}
+}
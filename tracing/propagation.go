@@ -0,0 +1,101 @@
+package tracing
+
+import (
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// Extract reads a caller's span context from W3C traceparent or, for legacy callers, B3 headers.
+func Extract(header http.Header) (SpanContext, bool) {
+	if sc, ok := parseTraceparent(header.Get("traceparent")); ok {
+		return sc, true
+	}
+	if sc, ok := parseB3Single(header.Get("b3")); ok {
+		return sc, true
+	}
+	return parseB3(header.Get("X-B3-TraceId"), header.Get("X-B3-SpanId"), header.Get("X-B3-Sampled"))
+}
+
+// Inject writes sc as traceparent and B3 headers.
+func Inject(sc SpanContext, header http.Header) {
+	flags, sampled := "00", "0"
+	if sc.Sampled {
+		flags, sampled = "01", "1"
+	}
+
+	traceID := hex.EncodeToString(sc.TraceID[:])
+	spanID := hex.EncodeToString(sc.SpanID[:])
+
+	header.Set("traceparent", "00-"+traceID+"-"+spanID+"-"+flags)
+	header.Del("b3")
+	header.Set("X-B3-TraceId", traceID)
+	header.Set("X-B3-SpanId", spanID)
+	header.Set("X-B3-Sampled", sampled)
+	header.Del("X-B3-ParentSpanId")
+}
+
+// parseTraceparent reads version-format-traceid-spanid-flags i.e.
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+func parseTraceparent(value string) (SpanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[3]) != 2 {
+		return SpanContext{}, false
+	}
+
+	sc, ok := parseIDs(parts[1], parts[2])
+	if !ok {
+		return SpanContext{}, false
+	}
+
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return SpanContext{}, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, true
+}
+
+// parseB3Single reads traceid-spanid-sampled-parentspanid from the b3 header.
+func parseB3Single(value string) (SpanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 2 {
+		return SpanContext{}, false
+	}
+	sampled := ""
+	if len(parts) > 2 {
+		sampled = parts[2]
+	}
+	return parseB3(parts[0], parts[1], sampled)
+}
+
+func parseB3(traceID string, spanID string, sampled string) (SpanContext, bool) {
+	// 64 bit trace IDs are left-padded to 128 bits.
+	if len(traceID) == 16 {
+		traceID = strings.Repeat("0", 16) + traceID
+	}
+
+	sc, ok := parseIDs(traceID, spanID)
+	if !ok {
+		return SpanContext{}, false
+	}
+	sc.Sampled = sampled == "1" || sampled == "true" || sampled == "d"
+	return sc, true
+}
+
+func parseIDs(traceID string, spanID string) (SpanContext, bool) {
+	sc := SpanContext{}
+	if len(traceID) != 32 || len(spanID) != 16 {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(traceID)); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(spanID)); err != nil {
+		return sc, false
+	}
+	if sc.TraceID == [16]byte{} || sc.SpanID == [8]byte{} {
+		return sc, false
+	}
+	return sc, true
+}
@@ -0,0 +1,217 @@
+// Package tracing records spans for calls through the gateway and propagates them to functions
+// with W3C traceparent and B3 headers.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Span kinds as defined by OTLP.
+const (
+	Internal = 1
+	Server   = 2
+	Client   = 3
+	Producer = 4
+)
+
+// SpanContext identifies a span within a trace.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// Exporter sends finished spans to a collector.
+type Exporter interface {
+	ExportSpan(span *Span)
+}
+
+// Tracer creates spans, sampling new traces by ratio and following the decision of a caller's trace.
+type Tracer struct {
+	exporter Exporter
+	ratio    float64
+}
+
+// NewTracer creates a Tracer, with a nil exporter spans are only propagated.
+func NewTracer(exporter Exporter, ratio float64) *Tracer {
+	return &Tracer{exporter: exporter, ratio: ratio}
+}
+
+// Span is a timed operation within a trace.
+type Span struct {
+	Name         string
+	Kind         int
+	Context      SpanContext
+	ParentSpanID [8]byte
+	Start        time.Time
+	End          time.Time
+	Error        string
+
+	mu         sync.Mutex
+	attributes map[string]string
+	tracer     *Tracer
+	ended      bool
+}
+
+type spanKey struct{}
+
+// Start begins a span, a child of the span in ctx or of parent when ctx has none.
+func (t *Tracer) Start(ctx context.Context, name string, kind int, parent *SpanContext) (context.Context, *Span) {
+	span := &Span{
+		Name:       name,
+		Kind:       kind,
+		Start:      time.Now(),
+		attributes: make(map[string]string),
+		tracer:     t,
+	}
+	rand.Read(span.Context.SpanID[:])
+
+	if current := FromContext(ctx); current != nil {
+		parent = &current.Context
+	}
+
+	if parent != nil {
+		span.Context.TraceID = parent.TraceID
+		span.Context.Sampled = parent.Sampled
+		span.ParentSpanID = parent.SpanID
+	} else {
+		rand.Read(span.Context.TraceID[:])
+		span.Context.Sampled = t.sample(span.Context.TraceID)
+	}
+
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// sample keeps a ratio of traces, deciding on the trace ID so that all gateways agree.
+func (t *Tracer) sample(traceID [16]byte) bool {
+	if t.ratio >= 1 {
+		return true
+	}
+	if t.ratio <= 0 {
+		return false
+	}
+	return float64(binary.BigEndian.Uint64(traceID[8:])) < t.ratio*float64(^uint64(0))
+}
+
+// FromContext returns the current span, nil when there is none.
+func FromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// StartSpan begins a child of the span in ctx. Without a span in ctx it returns a span which
+// isn't recorded, so instrumented code doesn't need to know whether tracing is enabled.
+func StartSpan(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	current := FromContext(ctx)
+	if current == nil {
+		return ctx, &Span{Name: name, Kind: kind, attributes: make(map[string]string)}
+	}
+	return current.tracer.Start(ctx, name, kind, nil)
+}
+
+// SetAttribute records a key/value on the span.
+func (s *Span) SetAttribute(key string, value string) {
+	s.mu.Lock()
+	s.attributes[key] = value
+	s.mu.Unlock()
+}
+
+// Attributes returns a copy of the span's attributes.
+func (s *Span) Attributes() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	attributes := make(map[string]string, len(s.attributes))
+	for k, v := range s.attributes {
+		attributes[k] = v
+	}
+	return attributes
+}
+
+// SetError marks the span as failed.
+func (s *Span) SetError(err error) {
+	s.mu.Lock()
+	s.Error = err.Error()
+	s.mu.Unlock()
+}
+
+// Finish ends the span and exports it when sampled, only the first call has an effect.
+func (s *Span) Finish() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	s.mu.Unlock()
+
+	if s.tracer != nil && s.tracer.exporter != nil && s.Context.Sampled {
+		s.tracer.exporter.ExportSpan(s)
+	}
+}
+
+// Inject adds the span's context to outgoing headers, in both W3C and B3 formats. A span
+// which isn't recorded leaves the headers as they are.
+func (s *Span) Inject(header http.Header) {
+	if s.tracer == nil {
+		return
+	}
+	Inject(s.Context, header)
+}
+
+// statusWriter keeps the status code for the server span.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(data []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(data)
+}
+
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+func (sw *statusWriter) Flush() {
+	if flusher, ok := sw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Handler starts a server span for every request, continuing the caller's trace when it sent one.
+func (t *Tracer) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var parent *SpanContext
+		if sc, ok := Extract(r.Header); ok {
+			parent = &sc
+		}
+
+		ctx, span := t.Start(r.Context(), r.Method+" "+r.URL.Path, Server, parent)
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.target", r.URL.RequestURI())
+		defer span.Finish()
+
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(ctx))
+
+		span.SetAttribute("http.status_code", strconv.Itoa(sw.status))
+	})
+}
@@ -39,6 +39,11 @@ func (w WriteAdapter) WriteHeader(i int) {
 	fmt.Println("GetHeaderCode before", w.HttpResult.HeaderCode)
 }
 
+// Unwrap gives http.ResponseController the underlying writer, for upgrades and flushing
+func (w WriteAdapter) Unwrap() http.ResponseWriter {
+	return w.Writer
+}
+
 // GetHeaderCode result from WriteHeader
 func (w *WriteAdapter) GetHeaderCode() int {
 	return w.HttpResult.HeaderCode
@@ -0,0 +1,41 @@
+// Copyright (c) Alex Ellis 2017. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package types
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// NewProxyClient creates the HTTP client for calls to functions and external providers.
+// One client is shared so that connections are pooled and re-used across handlers.
+func NewProxyClient(config GatewayConfig) *http.Client {
+	return &http.Client{
+		Transport: NewProxyTransport(config),
+	}
+}
+
+// NewProxyTransport creates a transport with a per-host pool of idle connections.
+func NewProxyTransport(config GatewayConfig) *http.Transport {
+	keepAlive := 30 * time.Second
+	if !config.UpstreamKeepAlive {
+		keepAlive = 0
+	}
+
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   config.UpstreamDialTimeout,
+			KeepAlive: keepAlive,
+		}).DialContext,
+		DisableKeepAlives:     !config.UpstreamKeepAlive,
+		MaxIdleConns:          config.UpstreamMaxIdleConns,
+		MaxIdleConnsPerHost:   config.UpstreamMaxIdleConnsPerHost,
+		IdleConnTimeout:       config.UpstreamIdleTimeout,
+		TLSHandshakeTimeout:   config.UpstreamTLSTimeout,
+		ExpectContinueTimeout: 1500 * time.Millisecond,
+		ForceAttemptHTTP2:     config.UpstreamHTTP2,
+	}
+}
@@ -4,6 +4,7 @@
 package types
 
 import (
+	"encoding/json"
 	"log"
 	"net/url"
 	"os"
@@ -82,6 +83,41 @@ func (ReadConfig) Read(hasEnv HasEnv) GatewayConfig {
 		}
 	}
 
+	cfg.NATSClusterID = "faas-cluster"
+	if clusterID := hasEnv.Getenv("faas_nats_cluster_id"); len(clusterID) > 0 {
+		cfg.NATSClusterID = clusterID
+	}
+	cfg.NATSClientID = "faas-publisher"
+	if clientID := hasEnv.Getenv("faas_nats_client_id"); len(clientID) > 0 {
+		cfg.NATSClientID = clientID
+	}
+	cfg.NATSSubject = "faas-request"
+	if subject := hasEnv.Getenv("faas_nats_subject"); len(subject) > 0 {
+		cfg.NATSSubject = subject
+	}
+
+	queueBackend := hasEnv.Getenv("faas_queue_backend")
+	switch {
+	case queueBackend == "nats" || queueBackend == "memory" || queueBackend == "file":
+		cfg.QueueBackend = queueBackend
+	case len(queueBackend) > 0:
+		log.Println("faas_queue_backend should be nats, memory or file: " + queueBackend)
+	case cfg.UseNATS():
+		cfg.QueueBackend = "nats"
+	}
+	cfg.QueueDir = "queue"
+	if queueDir := hasEnv.Getenv("faas_queue_dir"); len(queueDir) > 0 {
+		cfg.QueueDir = queueDir
+	}
+	cfg.QueueWorkers = parseIntValue(hasEnv.Getenv("faas_queue_workers"), 0)
+	cfg.QueueMaxAttempts = parseIntValue(hasEnv.Getenv("faas_queue_max_attempts"), 5)
+	cfg.NATSQueueGroup = "faas"
+	if queueGroup := hasEnv.Getenv("faas_nats_queue_group"); len(queueGroup) > 0 {
+		cfg.NATSQueueGroup = queueGroup
+	}
+	natsAckWait := parseIntValue(hasEnv.Getenv("faas_nats_ack_wait"), 300)
+	cfg.NATSAckWait = time.Duration(natsAckWait) * time.Second
+
 	prometheusPort := hasEnv.Getenv("faas_prometheus_port")
 	if len(prometheusPort) > 0 {
 		prometheusPortVal, err := strconv.Atoi(prometheusPort)
@@ -122,6 +158,113 @@ func (ReadConfig) Read(hasEnv HasEnv) GatewayConfig {
 		cfg.CFSpace = cfSpace
 	}
 
+	cfg.DirectFunctions = parseBoolValue(hasEnv.Getenv("direct_functions"))
+
+	cfg.LoadBalancer = "round_robin"
+	loadBalancer := hasEnv.Getenv("faas_load_balancer")
+	if loadBalancer == "round_robin" || loadBalancer == "least_inflight" {
+		cfg.LoadBalancer = loadBalancer
+	} else if len(loadBalancer) > 0 {
+		log.Println("faas_load_balancer should be round_robin or least_inflight, using round_robin")
+	}
+
+	internalDomain := hasEnv.Getenv("faas_internal_domain")
+	if len(internalDomain) > 0 {
+		cfg.InternalDomain = internalDomain
+	}
+	cfg.InternalPort = parseIntValue(hasEnv.Getenv("faas_internal_port"), 8080)
+
+	ejectionTime := parseIntValue(hasEnv.Getenv("faas_ejection_time"), 30)
+	cfg.EjectionTime = time.Duration(ejectionTime) * time.Second
+
+	instanceRefresh := parseIntValue(hasEnv.Getenv("faas_instance_refresh"), 10)
+	cfg.InstanceRefresh = time.Duration(instanceRefresh) * time.Second
+
+	cfg.MaxRequestBytes = int64(parseIntValue(hasEnv.Getenv("max_request_bytes"), 0))
+	cfg.MaxResponseBytes = int64(parseIntValue(hasEnv.Getenv("max_response_bytes"), 0))
+
+	cfg.UpstreamKeepAlive = true
+	if keepAlive := hasEnv.Getenv("upstream_keepalive"); len(keepAlive) > 0 {
+		cfg.UpstreamKeepAlive = parseBoolValue(keepAlive)
+	}
+	cfg.UpstreamHTTP2 = true
+	if http2 := hasEnv.Getenv("upstream_http2"); len(http2) > 0 {
+		cfg.UpstreamHTTP2 = parseBoolValue(http2)
+	}
+	cfg.UpstreamMaxIdleConns = parseIntValue(hasEnv.Getenv("upstream_max_idle_conns"), 512)
+	cfg.UpstreamMaxIdleConnsPerHost = parseIntValue(hasEnv.Getenv("upstream_max_idle_conns_per_host"), 64)
+
+	upstreamIdleTimeout := parseIntValue(hasEnv.Getenv("upstream_idle_timeout"), 90)
+	cfg.UpstreamIdleTimeout = time.Duration(upstreamIdleTimeout) * time.Second
+
+	upstreamDialTimeout := parseIntValue(hasEnv.Getenv("upstream_dial_timeout"), 3)
+	cfg.UpstreamDialTimeout = time.Duration(upstreamDialTimeout) * time.Second
+
+	upstreamTLSTimeout := parseIntValue(hasEnv.Getenv("upstream_tls_timeout"), 10)
+	cfg.UpstreamTLSTimeout = time.Duration(upstreamTLSTimeout) * time.Second
+
+	cfg.CacheMaxBytes = int64(parseIntValue(hasEnv.Getenv("faas_cache_max_bytes"), 64*1024*1024))
+
+	cfg.TracingEndpoint = hasEnv.Getenv("faas_tracing_endpoint")
+	cfg.TracingServiceName = "openfaas-cf-gateway"
+	if serviceName := hasEnv.Getenv("faas_tracing_service_name"); len(serviceName) > 0 {
+		cfg.TracingServiceName = serviceName
+	}
+	cfg.TracingSampleRatio = 1
+	if ratio := hasEnv.Getenv("faas_tracing_sample_ratio"); len(ratio) > 0 {
+		parsed, err := strconv.ParseFloat(ratio, 64)
+		if err == nil && parsed >= 0 && parsed <= 1 {
+			cfg.TracingSampleRatio = parsed
+		} else {
+			log.Println("faas_tracing_sample_ratio should be between 0 and 1: " + ratio)
+		}
+	}
+
+	cfg.AdminToken = hasEnv.Getenv("faas_admin_token")
+	cfg.AuthJWKS = hasEnv.Getenv("auth_jwks")
+	cfg.AuthJWTIssuer = hasEnv.Getenv("auth_jwt_issuer")
+	cfg.AuthJWTAudience = hasEnv.Getenv("auth_jwt_audience")
+
+	cfg.TrustedProxies = hasEnv.Getenv("faas_trusted_proxies")
+
+	cfg.CORSOrigins = hasEnv.Getenv("cors_allowed_origins")
+	cfg.CORSMethods = "GET, POST, PUT, PATCH, DELETE"
+	if methods := hasEnv.Getenv("cors_allowed_methods"); len(methods) > 0 {
+		cfg.CORSMethods = methods
+	}
+	cfg.CORSHeaders = "Content-Type, Authorization, X-API-Key, X-Call-Id, X-Callback-Url, X-Async-After, Idempotency-Key"
+	if headers := hasEnv.Getenv("cors_allowed_headers"); len(headers) > 0 {
+		cfg.CORSHeaders = headers
+	}
+	cfg.CORSCredentials = parseBoolValue(hasEnv.Getenv("cors_allow_credentials"))
+	corsMaxAge := parseIntValue(hasEnv.Getenv("cors_max_age"), 600)
+	cfg.CORSMaxAge = time.Duration(corsMaxAge) * time.Second
+
+	resultTTL := parseIntValue(hasEnv.Getenv("faas_result_ttl"), 3600)
+	cfg.ResultTTL = time.Duration(resultTTL) * time.Second
+
+	idempotencyTTL := parseIntValue(hasEnv.Getenv("faas_idempotency_ttl"), 86400)
+	cfg.IdempotencyTTL = time.Duration(idempotencyTTL) * time.Second
+
+	cfg.GatewayURL = hasEnv.Getenv("gateway_url")
+	cfg.CallbackSecret = hasEnv.Getenv("faas_callback_secret")
+
+	vcapApplication := hasEnv.Getenv("VCAP_APPLICATION")
+	if len(vcapApplication) > 0 {
+		application := struct {
+			ApplicationID   string   `json:"application_id"`
+			ApplicationURIs []string `json:"application_uris"`
+		}{}
+		if err := json.Unmarshal([]byte(vcapApplication), &application); err != nil {
+			log.Println("VCAP_APPLICATION invalid JSON: " + err.Error())
+		} else {
+			cfg.GatewayAppGUID = application.ApplicationID
+			if len(cfg.GatewayURL) == 0 && len(application.ApplicationURIs) > 0 {
+				cfg.GatewayURL = "https://" + application.ApplicationURIs[0]
+			}
+		}
+	}
+
 	return cfg
 }
 
@@ -132,6 +275,9 @@ type GatewayConfig struct {
 	FunctionsProviderURL *url.URL
 	NATSAddress          *string
 	NATSPort             *int
+	NATSClusterID        string
+	NATSClientID         string
+	NATSSubject          string
 	PrometheusHost       string
 	PrometheusPort       int
 	CFUrl                string
@@ -139,6 +285,87 @@ type GatewayConfig struct {
 	CFPass               string
 	CFOrg                string
 	CFSpace              string
+
+	// DirectFunctions bypasses the gorouter and balances calls across app instances.
+	DirectFunctions bool
+	// LoadBalancer is either round_robin or least_inflight.
+	LoadBalancer string
+	// InternalDomain is the container-to-container domain i.e. apps.internal,
+	// when empty instances are discovered via the Cloud Controller stats endpoint.
+	InternalDomain  string
+	InternalPort    int
+	EjectionTime    time.Duration
+	InstanceRefresh time.Duration
+	// GatewayAppGUID is the gateway's own app, read from VCAP_APPLICATION.
+	GatewayAppGUID string
+	// GatewayURL is where queued work calls back to the gateway, defaults to the app's first route.
+	GatewayURL string
+	// CallbackSecret signs the state queued work carries back to the gateway, it should be the
+	// same on every instance. A random secret is used when empty.
+	CallbackSecret string
+
+	// MaxRequestBytes and MaxResponseBytes limit bodies streamed through
+	// the function proxy, 0 means no limit.
+	MaxRequestBytes  int64
+	MaxResponseBytes int64
+
+	// Upstream settings tune the transport shared by calls to functions and providers.
+	UpstreamKeepAlive           bool
+	UpstreamHTTP2               bool
+	UpstreamMaxIdleConns        int
+	UpstreamMaxIdleConnsPerHost int
+	UpstreamIdleTimeout         time.Duration
+	UpstreamDialTimeout         time.Duration
+	UpstreamTLSTimeout          time.Duration
+
+	// CacheMaxBytes bounds the response cache of functions with the com.openfaas.cache label.
+	CacheMaxBytes int64
+
+	// TracingEndpoint is the OTLP/HTTP collector i.e. http://otel-collector:4318, tracing is off when empty.
+	TracingEndpoint    string
+	TracingServiceName string
+	// TracingSampleRatio is the share of new traces recorded, traces from callers follow their decision.
+	TracingSampleRatio float64
+
+	// AdminToken protects the gateway's admin API, /system/keys and /system/routes, which isn't served when empty.
+	AdminToken string
+
+	// AuthJWKS is the URL or file of the keys which sign JWTs, functions can't use jwt auth when empty.
+	AuthJWKS        string
+	AuthJWTIssuer   string
+	AuthJWTAudience string
+
+	// TrustedProxies lists the IPs and CIDRs, i.e. the gorouters, whose X-Forwarded-For is
+	// believed. The caller of other calls is their remote address.
+	TrustedProxies string
+
+	// CORS settings are the default policy of functions without com.openfaas.cors labels, no
+	// origins are allowed when CORSOrigins is empty. Lists are comma-separated.
+	CORSOrigins     string
+	CORSMethods     string
+	CORSHeaders     string
+	CORSCredentials bool
+	CORSMaxAge      time.Duration
+
+	// ResultTTL is how long the results of calls which carried on in the background are kept.
+	ResultTTL time.Duration
+
+	// IdempotencyTTL is how long the first response to a call with an Idempotency-Key is kept.
+	IdempotencyTTL time.Duration
+
+	// QueueBackend is nats, memory or file, async calls are off when empty.
+	QueueBackend string
+	// QueueDir is where the file backend keeps queued requests.
+	QueueDir string
+	// QueueWorkers is how many queued calls the gateway runs at once, 0 leaves them to a
+	// separate queue-worker.
+	QueueWorkers int
+	// QueueMaxAttempts is how many times a queued call failing with a 429, 502, 503 or 504 is tried.
+	QueueMaxAttempts int
+	// NATSQueueGroup is the durable queue group the gateway's queue workers receive in, and
+	// NATSAckWait how long a call may run before it's delivered again.
+	NATSQueueGroup string
+	NATSAckWait    time.Duration
 }
 
 // AppSpec for the application in Cloud Foundry